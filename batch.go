@@ -0,0 +1,119 @@
+package icapclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// BatchScanner scans many bodies one after another with a RESPMOD service on a single connection, which saves dialing for every one.
+// The connection is established with the first scan and kept as long as the server allows it, a new one is established
+// once it's lost. A BatchScanner is safe for concurrent use, the scans wait for each other then. It must be closed once done
+type BatchScanner struct {
+	client  Client
+	service string
+
+	mu   sync.Mutex
+	conn *ICAPConn
+}
+
+// NewBatchScanner returns a scanner which scans the bodies with the RESPMOD service through the client
+func NewBatchScanner(client Client, service string) *BatchScanner {
+	return &BatchScanner{
+		client:  client,
+		service: service,
+	}
+}
+
+// Scan scans the body of the content type as the body of an http response, the body is read entirely by the scan.
+// The X-Next-Services of the response are not followed
+func (s *BatchScanner) Scan(ctx context.Context, body io.Reader, contentType string) (*Response, error) {
+	httpResp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		ContentLength: -1,
+		Body:          io.NopCloser(body),
+	}
+
+	req, err := NewRequest(ctx, MethodRESPMOD, s.service, nil, httpResp)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, done, err := s.client.inFlight.start(req.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	req.ctx = ctx
+
+	if err := s.client.acquire(req.ctx); err != nil {
+		return nil, err
+	}
+	defer s.client.release()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.scan(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.client.icapFailure(res); err != nil {
+		return &res, err
+	}
+
+	return &res, nil
+}
+
+// scan makes the request on the connection of the scanner, a new connection is established if there's none
+// or the server closed it while it was idle
+func (s *BatchScanner) scan(req Request) (Response, error) {
+	cancel, err := s.client.begin(&req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer cancel()
+
+	// the connection is handed over to the request, release keeps it for the next scan if it can be kept
+	conn := s.conn
+	s.conn = nil
+
+	return s.client.useIdleOrDial(req, conn, func(conn Conn) (Response, error) {
+		return s.client.exchange(conn, req)
+	}, s.release)
+}
+
+// release keeps the connection for the next scan if it can be kept, it's closed otherwise
+func (s *BatchScanner) release(conn *ICAPConn, res Response, keep bool, err error) (Response, error) {
+	if keep {
+		s.conn = conn
+		return res, err
+	}
+
+	s.conn = nil
+
+	return res, errors.Join(err, conn.Close())
+}
+
+// Close closes the connection of the scanner, a further scan establishes a new one
+func (s *BatchScanner) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
@@ -3,14 +3,63 @@ package icapclient
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Client represents the icap client who makes the icap server calls
 type Client struct {
-	conn Conn
+	config Config
+	// requests limits the concurrent in-flight requests, no limit applies if nil
+	requests chan struct{}
+	// inFlight tracks the in-flight requests, so they can be aborted all at once on shutdown
+	inFlight *inFlight
+	// pool keeps the idle connections for reuse and counts the connection statistics
+	pool *connPool
+}
+
+// inFlight tracks the in-flight requests of a client, their contexts are derived from the root context of the client
+type inFlight struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// start registers a request, its context is canceled as soon as the client shuts down.
+// The returned function must be called once the request is done
+func (f *inFlight) start(ctx context.Context) (context.Context, func(), error) {
+	if f == nil {
+		return ctx, func() {}, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.ctx.Err() != nil {
+		return nil, nil, ErrClientShutdown
+	}
+
+	f.wg.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(f.ctx, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+		f.wg.Done()
+	}, nil
 }
 
 // NewClient creates a new icap client
@@ -20,54 +69,680 @@ func NewClient(options ...ConfigOption) (Client, error) {
 		option(&config)
 	}
 
-	conn, err := NewICAPConn(config.ICAPConn)
+	if config.clock == nil {
+		config.clock = realClock{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	client := Client{
+		config:   config,
+		inFlight: &inFlight{ctx: ctx, cancel: cancel},
+		pool:     newConnPool(config.MaxIdleConns, config.IdleConnTimeout, config.clock),
+	}
+
+	if config.MaxConcurrentRequests > 0 {
+		client.requests = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+
+	// the pings stop once the client shuts down
+	if config.KeepaliveInterval > 0 && config.MaxIdleConns > 0 {
+		go client.pool.keepalive(ctx, config.KeepaliveInterval, client.ping)
+	}
+
+	return client, nil
+}
+
+// Do is the main function of the client that makes the ICAP request.
+// If the client returns errors on ICAP failures, the failed response is returned along with the error
+func (c *Client) Do(req Request) (Response, error) {
+	req.trace.started(time.Now())
+
+	ctx, done, err := c.inFlight.start(req.ctx)
 	if err != nil {
-		return Client{}, err
+		return Response{}, err
 	}
+	defer done()
+	req.ctx = ctx
 
-	return Client{
-		conn: conn,
-	}, nil
+	if err := c.acquire(req.ctx); err != nil {
+		return Response{}, err
+	}
+	defer c.release()
+
+	res, err := c.do(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if err := c.icapFailure(res); err != nil || !c.config.FollowNextServices {
+		return res, err
+	}
+
+	host := req.URL.Host
+
+	// forward the content to the chained services one after another
+	for _, service := range res.NextServices() {
+		if err := c.nextServiceAllowed(host, service); err != nil {
+			return Response{}, err
+		}
+
+		req, err = req.forward(service, res)
+		if err != nil {
+			return Response{}, err
+		}
+
+		nextRes, err := c.do(req)
+		if err != nil {
+			return Response{}, err
+		}
+
+		if err := c.icapFailure(nextRes); err != nil {
+			return nextRes, err
+		}
+
+		// the service did not modify the content, the last modification stays the result of the chain
+		if nextRes.StatusCode == http.StatusNoContent && res.StatusCode != http.StatusNoContent {
+			continue
+		}
+
+		res = nextRes
+	}
+
+	return res, nil
 }
 
-// Do is the main function of the client that makes the ICAP request
-func (c *Client) Do(req Request) (res Response, err error) {
-	// establish connection to the icap server
-	err = c.conn.Connect(req.ctx, req.URL.Host)
+// DoSequence makes the requests one after another on a single connection, for example, an OPTIONS request followed by a RESPMOD,
+// which saves the round trips of connecting for every request. All requests must go to the same server, the connection is bound
+// to the context of the first one. The responses are returned in the order of the requests, if one fails the responses gathered
+// so far are returned along with the error. The X-Next-Services of the responses are not followed
+func (c *Client) DoSequence(reqs ...*Request) ([]*Response, error) {
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+
+	first := *reqs[0]
+	for _, req := range reqs[1:] {
+		if req.URL.Scheme != first.URL.Scheme || req.URL.Host != first.URL.Host {
+			return nil, fmt.Errorf("%w: %s", ErrSequenceHostMismatch, req.URL.Host)
+		}
+	}
+
+	ctx, done, err := c.inFlight.start(first.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	first.ctx = ctx
+
+	if err := c.acquire(first.ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	responses := make([]*Response, 0, len(reqs))
+
+	_, err = c.connected(first, func(conn Conn) (Response, error) {
+		var last Response
+
+		for _, r := range reqs {
+			r.trace.started(time.Now())
+
+			res, err := c.doOn(conn, *r)
+			if err != nil {
+				return Response{}, err
+			}
+
+			responses = append(responses, &res)
+
+			if err := c.icapFailure(res); err != nil {
+				return Response{}, err
+			}
+
+			last = res
+		}
+
+		// the last response tells if the connection can be kept
+		return last, nil
+	})
+
+	return responses, err
+}
+
+// doOn makes a single ICAP request on the established connection, which is closed if the request is canceled
+func (c *Client) doOn(conn Conn, req Request) (Response, error) {
+	cancel, err := c.begin(&req)
 	if err != nil {
 		return Response{}, err
 	}
-	defer func() {
-		err = errors.Join(err, c.conn.Close())
+	defer cancel()
+
+	stop := context.AfterFunc(req.ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	return c.exchange(conn, req)
+}
+
+// Shutdown aborts all in-flight requests of the client and waits for them to finish, unless the context is done first.
+// The connections of the aborted requests are closed, so are the idle connections of the pool.
+// The client can't be used anymore afterwards, further requests fail with ErrClientShutdown
+func (c *Client) Shutdown(ctx context.Context) error {
+	if c.inFlight == nil {
+		return nil
+	}
+
+	c.inFlight.mu.Lock()
+	c.inFlight.cancel()
+	c.inFlight.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		c.inFlight.wg.Wait()
+		close(finished)
 	}()
 
-	req.setDefaultRequestHeaders()
+	select {
+	case <-finished:
+		// the aborted requests don't put their connections back, so the pool stays empty from now on
+		c.pool.closeAll()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the connection statistics of the client, how often connections were dialed or reused for example
+func (c *Client) Stats() Stats {
+	return c.pool.stats()
+}
+
+// acquire waits for a free slot of the concurrent requests limit, unless the context is done first
+func (c *Client) acquire(ctx context.Context) error {
+	if c.requests == nil {
+		return nil
+	}
+
+	select {
+	case c.requests <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of the concurrent requests limit taken by acquire
+func (c *Client) release() {
+	if c.requests != nil {
+		<-c.requests
+	}
+}
+
+// icapFailure returns an error for the ICAP failure status codes of the response, if the client is configured to do so
+func (c *Client) icapFailure(res Response) error {
+	if !c.config.ReturnErrorOnICAPFailure || res.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %d %s", ErrICAPFailure, res.StatusCode, res.Status)
+
+	if res.StatusCode == http.StatusRequestTimeout {
+		err = errors.Join(ErrServerRequestTimeout, err)
+	}
+
+	return err
+}
+
+// nextServiceAllowed checks if the client is allowed to forward the content to the next service,
+// the services come from the server response, so only the host of the request and the configured hosts are allowed
+func (c *Client) nextServiceAllowed(host, service string) error {
+	u, err := url.Parse(service)
+	if err != nil {
+		return err
+	}
+
+	if u.Host != host && !slices.Contains(c.config.NextServicesHosts, u.Host) {
+		return fmt.Errorf("%w: %s", ErrNextServiceNotAllowed, service)
+	}
+
+	return nil
+}
+
+// do makes a single ICAP request
+func (c *Client) do(req Request) (Response, error) {
+	cancel, err := c.begin(&req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer cancel()
+
+	// the connection of a single request is not used for anything else, so it can be half-closed
+	req.halfCloseAfterPreview = c.config.HalfCloseAfterPreview
+
+	return c.connected(req, func(conn Conn) (Response, error) {
+		return c.exchange(conn, req)
+	})
+}
+
+// begin prepares the request to be made and applies its timeout through the context deadline,
+// the returned function releases the resources of the deadline once the request is done
+func (c *Client) begin(req *Request) (context.CancelFunc, error) {
+	if err := c.prepare(req); err != nil {
+		return nil, fmt.Errorf("icap: prepare request: %w", err)
+	}
+
+	if req.timeout <= 0 {
+		return func() {}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(req.ctx, req.timeout)
+	req.ctx = ctx
+
+	return cancel, nil
+}
+
+// connected passes a connection to the icap server of the request on, an idle one of the pool if there is any.
+// The connection is closed as soon as the request is canceled, so a hung server can't block it,
+// it's put back into the pool once done, unless it failed or the server asked to close it
+func (c *Client) connected(req Request, use func(conn Conn) (Response, error)) (Response, error) {
+	key := req.URL.Scheme + "://" + req.URL.Host
+
+	// every request has its own connection, so the client can be used concurrently
+	return c.useIdleOrDial(req, c.pool.get(key), use, func(conn *ICAPConn, res Response, keep bool, err error) (Response, error) {
+		return c.releaseConn(key, req.URL.String(), conn, res, keep, err)
+	})
+}
+
+// useIdleOrDial uses the idle connection for the request if there is one, a new connection is established otherwise.
+// If the server closed the idle connection in the meantime and nothing of the response was received, the idle connection is closed
+// and the request is made again on a new one, the ICAP requests are idempotent and the bodies are kept to be sent again.
+// The connection used last is passed to release along with the outcome of the request
+func (c *Client) useIdleOrDial(req Request, idle *ICAPConn, use func(conn Conn) (Response, error),
+	release func(conn *ICAPConn, res Response, keep bool, err error) (Response, error)) (Response, error) {
+	if idle != nil {
+		idle.bind(req.ctx)
+		received := idle.receivedBytes()
+
+		res, keep, err := c.use(idle, req, use)
+		if err == nil || !staleConnError(err) || idle.receivedBytes() != received || req.ctx.Err() != nil {
+			return release(idle, res, keep, err)
+		}
+
+		_ = idle.Close()
+	}
+
+	conn, err := c.dial(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	res, keep, err := c.use(conn, req, use)
+
+	return release(conn, res, keep, err)
+}
+
+// dial establishes a new connection to the icap server of the request
+func (c *Client) dial(req Request) (*ICAPConn, error) {
+	conn, err := NewICAPConn(c.connConfig(req))
+	if err != nil {
+		return nil, fmt.Errorf("icap: connect to %s: %w", req.URL.Host, err)
+	}
+
+	address := req.URL.Host
+	if c.config.AddressResolver != nil {
+		address, err = c.config.AddressResolver(req.ctx, req.URL.Host)
+		if err != nil {
+			return nil, fmt.Errorf("icap: resolve %s: %w", req.URL.Host, err)
+		}
+	}
+
+	// establish connection to the icap server
+	connectStart := time.Now()
+	err = conn.Connect(req.ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("icap: connect to %s: %w", req.URL.Host, err)
+	}
+	req.trace.connected(connectStart)
+	if c.pool != nil {
+		c.pool.dials.Add(1)
+	}
+
+	return conn, nil
+}
+
+// use uses the connection for the request, it reports whether the connection can be kept for further requests
+func (c *Client) use(conn *ICAPConn, req Request, use func(conn Conn) (Response, error)) (Response, bool, error) {
+	if c.pool != nil {
+		c.pool.active.Add(1)
+		defer c.pool.active.Add(-1)
+	}
+
+	stop := context.AfterFunc(req.ctx, func() {
+		_ = conn.Close()
+	})
+
+	res, err := use(conn)
+
+	// the connection was closed if the request was canceled
+	canceled := !stop()
+
+	// nothing can be sent on a half-closed connection anymore
+	keep := err == nil && !canceled && !conn.writeClosed.Load() && !strings.EqualFold(res.Header.Get("Connection"), "close")
+
+	return res, keep, err
+}
+
+// releaseConn puts the connection used for the service back into the pool if it can be kept, it's closed otherwise
+func (c *Client) releaseConn(key, service string, conn *ICAPConn, res Response, keep bool, err error) (Response, error) {
+	if keep {
+		c.pool.put(key, service, conn)
+		return res, err
+	}
+
+	return res, errors.Join(err, conn.Close())
+}
+
+// ping sends an OPTIONS request for the service on the idle connection, so the server doesn't close it for idling.
+// It fails if the server doesn't answer or announces to close the connection
+func (c *Client) ping(conn *ICAPConn, service string) error {
+	req, err := NewRequest(c.inFlight.ctx, MethodOPTIONS, service, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	message, err := toICAPRequest(req)
+	if err != nil {
+		return err
+	}
+
+	conn.bind(req.ctx)
+
+	data, err := conn.Send(message)
+	if err != nil {
+		return err
+	}
+
+	res, err := toClientResponse(bufio.NewReader(bytes.NewReader(data)), c.headerLimits())
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(res.Header.Get("Connection"), "close") {
+		return errConnClosing
+	}
+
+	return nil
+}
+
+// staleConnError determines if the error is caused by a connection the server closed while it was idle
+func staleConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// prepare applies the preview and the headers of the client configuration to the request before it's sent
+func (c *Client) prepare(req *Request) error {
+	// the request is passed by value, but its header is still the caller's map
+	req.Header = req.Header.Clone()
+
+	// the service previews each content type by its own size, unless the request chose a preview itself
+	if previews := c.config.ServicePreviews[serviceKey(req.URL)]; len(previews) > 0 && req.Method != MethodOPTIONS && !req.previewSet && !req.previewAdvertised {
+		if size, found := previewForContentType(previews, req.contentType()); found {
+			req.AdvertisePreview(size)
+		}
+	}
+
+	// the preview relies on chunking, so the bodies delimited by their length are sent in full,
+	// as are the content types the client must always send complete
+	if c.config.EncapsulatedBodyFraming == BodyFramingContentLength || contentTypeMatches(req.contentType(), c.config.ForceCompleteTypes) {
+		req.clearPreview()
+	}
+
+	// the preview is capped regardless of what the server advertised
+	if maxBytes := c.config.MaxPreviewBytes; maxBytes > 0 && req.PreviewBytes > maxBytes {
+		if req.previewSet {
+			if err := req.SetPreview(maxBytes); err != nil {
+				return err
+			}
+		}
+
+		if req.previewAdvertised && !req.previewSet {
+			req.AdvertisePreview(maxBytes)
+		}
+	}
+
+	// the advertised preview reads the body only now, right before sending it
+	if req.previewAdvertised && !req.previewSet {
+		if err := req.SetPreview(req.PreviewBytes); err != nil {
+			return err
+		}
+	}
+
+	req.setDefaultRequestHeaders(c.config.DefaultAllow)
+
+	// the server can't buffer a large body to answer with a 204, unless it's previewed
+	if maxBytes := c.config.Allow204MaxBodyBytes; maxBytes > 0 && !req.previewSet {
+		if size := req.bodySize(); size < 0 || size > maxBytes {
+			req.suppressAllow204()
+		}
+	}
+
+	if c.config.Authenticator != nil {
+		if err := c.config.Authenticator.Apply(req); err != nil {
+			return err
+		}
+	}
+
+	// remap the service path, the raw url is sent verbatim
+	if c.config.PathRewrite != nil && req.rawURL == "" {
+		u := *req.URL
+		u.Path, u.RawPath = c.config.PathRewrite(u.Path), ""
+		req.URL = &u
+	}
+
+	req.rewriteHTTPRequest = c.config.RewriteEncapsulatedRequest
+	req.noAutoAcceptEncoding = c.config.DisableAutoAcceptEncoding
+	req.bodyFraming = c.config.EncapsulatedBodyFraming
+	req.bodyTerminator = c.config.BodyTerminator
+
+	if c.config.CorrelationIDHeader != "" && c.config.CorrelationIDFromContext != nil {
+		if id := c.config.CorrelationIDFromContext(req.ctx); id != "" {
+			req.Header.Set(c.config.CorrelationIDHeader, id)
+		}
+	}
+
+	if c.config.ModifyHeader != nil {
+		c.config.ModifyHeader(req)
+	}
+
+	if c.config.StrictMode {
+		return req.validateStrict()
+	}
+
+	return nil
+}
+
+// exchange sends the prepared request on the connection and reads the response,
+// the rest of the body follows the preview if the server asks for it
+func (c *Client) exchange(conn Conn, req Request) (res Response, err error) {
+	// the response refers to the request as it's sent
+	defer func() {
+		if err == nil {
+			res.Request = &req
+		}
+	}()
 
 	// convert the request to icap message
 	message, err := toICAPRequest(req)
 	if err != nil {
-		return Response{}, err
+		return Response{}, fmt.Errorf("icap: build request: %w", err)
 	}
 
-	// send the icap message to the server
-	dataRes, err := c.conn.Send(message)
+	// send the icap message to the server, nothing follows a preview which holds the entire body
+	sendStart := time.Now()
+	closeWrite := req.halfCloseAfterPreview && req.previewSet && req.bodyFittedInPreview
+
+	var dataRes []byte
+	if body := req.streamedBody(); body != nil {
+		dataRes, err = c.sendStreamed(conn, req, message, body)
+	} else {
+		dataRes, err = c.send(conn, req, message, closeWrite)
+	}
 	if err != nil {
 		return Response{}, err
 	}
 
-	res, err = toClientResponse(bufio.NewReader(strings.NewReader(string(dataRes))))
+	// the server decides upon the preview with its first response
+	var decisionTime time.Duration
+	if req.previewSet {
+		decisionTime = time.Since(sendStart)
+	}
+
+	res, err = c.toResponse(req, dataRes)
 	if err != nil {
 		return Response{}, err
 	}
+	res.PreviewDecisionTime = decisionTime
+
+	// a server which asks for more although the entire body was sent is not answered, its final response is waited for
+	continueExpected := req.previewSet && !req.bodyFittedInPreview
+	for res.StatusCode == http.StatusContinue && !continueExpected {
+		if c.config.Warn != nil {
+			c.config.Warn(ErrUnexpectedContinue)
+		}
+
+		dataRes, err = c.send(conn, req, nil, false)
+		if err != nil {
+			return Response{}, err
+		}
+
+		res, err = c.toResponse(req, dataRes)
+		if err != nil {
+			return Response{}, err
+		}
+		res.PreviewDecisionTime = decisionTime
+	}
 
 	// check if the message is fully done scanning or if it needs to be sent another chunk
-	done := !(res.StatusCode == http.StatusContinue && !req.bodyFittedInPreview && req.previewSet)
-	if done {
+	if res.StatusCode != http.StatusContinue {
+		return res, nil
+	}
+
+	// the rest of the body is not sent if the request is aborted
+	if c.config.OnContinue != nil {
+		interim := res
+		interim.Request = &req
+
+		if err := c.config.OnContinue(&interim); err != nil {
+			return Response{}, err
+		}
+	}
+
+	// send the remaining body bytes to the server
+	dataRes, err = c.sendRemainingBody(conn, req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	res, err = c.toResponse(req, dataRes)
+	if err != nil {
+		return Response{}, err
+	}
+	res.PreviewDecisionTime = decisionTime
+
+	return res, nil
+}
+
+// toResponse reads the response of the server, a 200 response to a modification request must declare its encapsulated entities.
+// A lenient client accepts it anyway and reports it as a warning
+func (c *Client) toResponse(req Request, dataRes []byte) (Response, error) {
+	// a connection other than the ICAPConn might not tell the empty response apart
+	if len(dataRes) == 0 {
+		return Response{}, fmt.Errorf("icap: read response: %w", ErrEmptyResponse)
+	}
+
+	res, err := toClientResponse(bufio.NewReader(bytes.NewReader(dataRes)), c.headerLimits())
+	if err != nil {
+		return Response{}, fmt.Errorf("icap: parse response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK || req.Method == MethodOPTIONS || res.Header.Get(encapsulatedHeader) != "" {
 		return res, nil
 	}
 
-	// get the remaining body bytes
+	if !c.config.ICAPConn.LenientEncapsulation {
+		return Response{}, fmt.Errorf("icap: parse response: %w", ErrMissingEncapsulated)
+	}
+
+	if c.config.Warn != nil {
+		c.config.Warn(ErrMissingEncapsulated)
+	}
+
+	return res, nil
+}
+
+// headerLimits returns the limits of the response header lines as configured
+func (c *Client) headerLimits() headerLimits {
+	return headerLimits{
+		maxBytes:  c.config.MaxHeaderBytes,
+		maxLine:   c.config.MaxHeaderLine,
+		maxChunks: c.config.ICAPConn.MaxChunks,
+	}
+}
+
+// connConfig returns the configuration of the connection for the request, only icaps:// urls are connected through TLS,
+// presenting the client certificate if it's set
+func (c *Client) connConfig(req Request) ICAPConnConfig {
+	conf := c.config.ICAPConn
+
+	switch {
+	case req.URL.Scheme != schemeICAPS:
+		conf.TLSConfig = nil
+	case conf.TLSConfig == nil:
+		conf.TLSConfig = &tls.Config{}
+	}
+
+	// the client certificate is added to a copy, the TLS configuration might be shared
+	if conf.TLSConfig != nil && len(c.config.ClientCert.Certificate) > 0 {
+		conf.TLSConfig = conf.TLSConfig.Clone()
+		conf.TLSConfig.Certificates = append(conf.TLSConfig.Certificates, c.config.ClientCert)
+	}
+
+	// the header limits apply while the response is read as well
+	conf.MaxHeaderBytes, conf.MaxHeaderLine = c.config.MaxHeaderBytes, c.config.MaxHeaderLine
+
+	// the certificate is verified against the logical host, not the address it's resolved to
+	if conf.TLSConfig != nil && conf.TLSConfig.ServerName == "" && c.config.AddressResolver != nil {
+		conf.TLSConfig = conf.TLSConfig.Clone()
+		conf.TLSConfig.ServerName = req.URL.Hostname()
+	}
+
+	return conf
+}
+
+// sendRemainingBody sends the rest of the body which didn't fit into the preview, a body which can seek is read from the end
+// of the preview on. The ICAPConn streams it, other connections take it at once
+func (c *Client) sendRemainingBody(conn Conn, req Request) ([]byte, error) {
 	data := req.remainingPreviewBytes
+
+	if req.previewSeeker != nil {
+		if _, err := req.previewSeeker.Seek(int64(req.PreviewBytes), io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		if ic, ok := conn.(*ICAPConn); ok {
+			return c.sendWith(req, nil, func() ([]byte, error) {
+				return ic.sendChunked(nil, req.previewSeeker, req.bodyTerminator)
+			})
+		}
+
+		rest, err := io.ReadAll(req.previewSeeker)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+	}
+
 	if !bodyIsChunked(string(data)) {
 		data = []byte(addHexBodyByteNotations(string(data)))
 	}
@@ -76,12 +751,63 @@ func (c *Client) Do(req Request) (res Response, err error) {
 	if !bytes.HasSuffix(data, []byte(doubleCRLF)) {
 		data = append(data, []byte(crlf)...)
 	}
+	data = append(data, req.bodyTerminator...)
 
-	// send the remaining body bytes to the server
-	dataRes, err = c.conn.Send(data)
+	return c.send(conn, req, data, false)
+}
+
+// sendStreamed sends the message followed by the body which is streamed as its chunks from the reader.
+// The ICAPConn streams it, other connections take it at once
+func (c *Client) sendStreamed(conn Conn, req Request, message []byte, body io.Reader) ([]byte, error) {
+	if ic, ok := conn.(*ICAPConn); ok {
+		return c.sendWith(req, message, func() ([]byte, error) {
+			return ic.sendChunked(message, body, req.bodyTerminator)
+		})
+	}
+
+	data, err := io.ReadAll(body)
 	if err != nil {
-		return Response{}, err
+		return nil, err
+	}
+
+	message = append(message, addHexBodyByteNotations(string(data))...)
+	if !bytes.HasSuffix(message, []byte(doubleCRLF)) {
+		message = append(message, crlf...)
+	}
+	message = append(message, req.bodyTerminator...)
+
+	return c.send(conn, req, message, false)
+}
+
+// send sends the message to the icap server and records the exchange if the request is traced,
+// the writing side of the connection is shut down after the message if closeWrite is set and the connection supports it
+func (c *Client) send(conn Conn, req Request, message []byte, closeWrite bool) ([]byte, error) {
+	send := conn.Send
+	if ic, ok := conn.(*ICAPConn); ok && closeWrite {
+		send = ic.sendAndCloseWrite
 	}
 
-	return toClientResponse(bufio.NewReader(strings.NewReader(string(dataRes))))
+	return c.sendWith(req, message, func() ([]byte, error) {
+		return send(message)
+	})
+}
+
+// sendWith sends the message by the send function and records the exchange if the request is traced,
+// a streamed message is recorded without the bytes sent
+func (c *Client) sendWith(req Request, message []byte, send func() ([]byte, error)) ([]byte, error) {
+	start := time.Now()
+
+	dataRes, err := send()
+	if err != nil {
+		// the connection was closed because the request is canceled, the context tells why
+		if ctxErr := req.ctx.Err(); ctxErr != nil {
+			err = errors.Join(ctxErr, err)
+		}
+
+		return nil, fmt.Errorf("icap: send request: %w", err)
+	}
+
+	req.trace.exchanged(start, message, dataRes)
+
+	return dataRes, nil
 }
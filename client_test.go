@@ -1,16 +1,206 @@
 package icapclient
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
 	"reflect"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
+// startRawTestServer starts a tcp server on a free port and passes every accepted connection to the handler,
+// it returns the address the server is listening on
+func startRawTestServer(t *testing.T, handler func(conn net.Conn)) string {
+	t.Helper()
+
+	lstnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lstnr.Close() })
+
+	go func() {
+		for {
+			conn, err := lstnr.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+
+	return lstnr.Addr().String()
+}
+
+// startReplyTestServer starts a tcp server which answers every ICAP request with the given reply,
+// the received ICAP requests are passed on through the returned channel
+func startReplyTestServer(t *testing.T, reply string) (string, chan string) {
+	t.Helper()
+
+	received := make(chan string, 8)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		msg, _ := readTestICAPRequest(bufio.NewReader(conn))
+		received <- msg
+
+		_, _ = conn.Write([]byte(reply))
+	})
+
+	return addr, received
+}
+
+// readTestICAPRequest reads one entire ICAP request message, including the encapsulated body, from the reader
+func readTestICAPRequest(r *bufio.Reader) (string, error) {
+	msg, entity, err := readTestICAPHead(r)
+	if err != nil || entity == "" || entity == "null-body" {
+		return msg, err
+	}
+
+	return readTestChunkedBody(r, msg)
+}
+
+// readTestICAPHead reads the ICAP headers and the encapsulated headers of an ICAP request message from the reader,
+// along with the entity declared last by the Encapsulated header. The encapsulated body is left unread
+func readTestICAPHead(r *bufio.Reader) (string, string, error) {
+	msg := ""
+	encVal := ""
+
+	// reading the ICAP headers
+	for {
+		line, err := r.ReadString('\n')
+		msg += line
+		if err != nil {
+			return msg, "", err
+		}
+
+		if header, val := getHeaderValue(line); header == encapsulatedHeader {
+			encVal = val
+		}
+
+		if line == crlf {
+			break
+		}
+	}
+
+	entries := strings.Split(encVal, ",")
+	name, offset, _ := strings.Cut(strings.TrimSpace(entries[len(entries)-1]), "=")
+
+	n, err := strconv.Atoi(offset)
+	if err != nil {
+		return msg, "", nil
+	}
+
+	// reading the encapsulated headers
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return msg, name, err
+	}
+
+	return msg + string(b), name, nil
+}
+
+// readTestChunkedBody reads a chunked body from the reader and appends it to the message
+func readTestChunkedBody(r *bufio.Reader, msg string) (string, error) {
+	for {
+		line, err := r.ReadString('\n')
+		msg += line
+		if err != nil {
+			return msg, err
+		}
+
+		chunkSize, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(chunkSize), 16, 64)
+		if err != nil {
+			return msg, err
+		}
+
+		if size == 0 {
+			line, err := r.ReadString('\n')
+			return msg + line, err
+		}
+
+		chunk := make([]byte, size+int64(len(crlf)))
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return msg, err
+		}
+		msg += string(chunk)
+	}
+}
+
+// copyTestChunkedBody copies the chunks of a chunked body from the reader to the writer as they're read,
+// so the body is never held in memory
+func copyTestChunkedBody(w io.Writer, r *bufio.Reader) error {
+	buf := make([]byte, 32<<10)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		n, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			_, err := r.ReadString('\n')
+			return err
+		}
+
+		if _, err := io.CopyBuffer(w, io.LimitReader(r, n), buf); err != nil {
+			return err
+		}
+
+		if _, err := r.Discard(len(crlf)); err != nil {
+			return err
+		}
+	}
+}
+
+// newTestResponse returns the plain text http response with the body the tests send for scanning
+func newTestResponse(body string) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header: http.Header{
+			"Content-Type":   []string{"plain/text"},
+			"Content-Length": []string{strconv.Itoa(len(body))},
+		},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+}
+
 func TestClient_Do(t *testing.T) {
 	if !testServerRunning() {
 		go startTestServer()
@@ -445,3 +635,3744 @@ func TestClient_Do(t *testing.T) {
 		defer stopTestServer()
 	}
 }
+
+type readTracker struct {
+	io.Reader
+	read bool
+}
+
+func (r *readTracker) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+func TestClient_DoAdvertisedPreview(t *testing.T) {
+	received := make(chan string, 1)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		msg, _ := readTestICAPRequest(bufio.NewReader(conn))
+		received <- msg
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	body := &readTracker{Reader: strings.NewReader("This is a GOOD FILE")}
+	httpResp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header: http.Header{
+			"Content-Type":   []string{"plain/text"},
+			"Content-Length": []string{"19"},
+		},
+		ContentLength: 19,
+		Body:          io.NopCloser(body),
+	}
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.AdvertisePreview(4)
+
+	if body.read {
+		t.Error("Body must not be read before the request is sent")
+	}
+
+	if val := req.Header.Get(previewHeader); val != "4" {
+		t.Errorf("Wanted Preview header:%s, got:%s", "4", val)
+	}
+
+	client, _ := NewClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !body.read {
+		t.Error("Body must be read when the request is sent")
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if msg := <-received; !strings.HasSuffix(msg, "4\r\nThis\r\n0\r\n\r\n") {
+		t.Errorf("Wanted the preview portion of the body to be sent, got:%s", msg)
+	}
+}
+
+func TestClient_DoContinueWithFinalStatus(t *testing.T) {
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		if _, err := readTestICAPRequest(r); err != nil {
+			return
+		}
+
+		// the server decides right away, the final status follows the 100 Continue in the same write
+		_, _ = conn.Write([]byte(ICAP100ContinueMsg + "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"))
+
+		// the rest of the body the client sends after the 100 Continue is drained, it doesn't change the decision
+		_, _ = io.Copy(io.Discard, r)
+	})
+
+	httpResp := newTestResponse("This is a GOOD FILE")
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.SetPreview(4); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+func TestClient_DoUnexpectedContinue(t *testing.T) {
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		if _, err := readTestICAPRequest(r); err != nil {
+			return
+		}
+
+		// the server asks for more although the request had no preview, the final response follows later on
+		if _, err := conn.Write([]byte(ICAP100ContinueMsg)); err != nil {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"))
+	})
+
+	httpResp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"plain/text"}},
+		ContentLength: 19,
+		Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+	}
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []error
+	client, _ := NewClient(WithWarn(func(err error) {
+		warnings = append(warnings, err)
+	}))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted the final status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if len(warnings) != 1 || !errors.Is(warnings[0], ErrUnexpectedContinue) {
+		t.Errorf("Wanted the warning:%v, got:%v", ErrUnexpectedContinue, warnings)
+	}
+}
+
+func TestClient_DoREQMODBodyFitsInPreview(t *testing.T) {
+	received := make(chan string, 1)
+	continued := make(chan string, 1)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		msg, _ := readTestICAPRequest(r)
+		received <- msg
+
+		// the server decides right away, as the entire body was previewed
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+
+		// the client must not continue the message
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		rest, _ := io.ReadAll(r)
+		continued <- string(rest)
+	})
+
+	httpReq, _ := http.NewRequest(http.MethodPost, "http://someurl.com/upload", strings.NewReader("Hello World"))
+
+	req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.SetPreview(1024); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	msg := <-received
+	if !strings.Contains(msg, "\r\nPreview: 11\r\n") {
+		t.Errorf("Wanted the entire body to be previewed, got:%s", msg)
+	}
+
+	if !strings.HasSuffix(msg, "\r\n\r\nb\r\nHello World\r\n0; ieof\r\n\r\n") {
+		t.Errorf("Wanted the body to end with the ieof indicator, got:%q", msg)
+	}
+
+	if rest := <-continued; rest != "" {
+		t.Errorf("Wanted no continuation of the message, got:%q", rest)
+	}
+}
+
+func TestClient_DoOnContinue(t *testing.T) {
+	continued := make(chan string, 1)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		if _, err := readTestICAPRequest(r); err != nil {
+			return
+		}
+
+		_, _ = conn.Write([]byte(ICAP100ContinueMsg))
+
+		// the rest of the body must not be sent once the request is aborted
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		rest, _ := io.ReadAll(r)
+		continued <- string(rest)
+	})
+
+	httpResp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: 19,
+		Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+	}
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.SetPreview(4); err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("aborted")
+	var seen *Response
+
+	client, _ := NewClient(WithOnContinue(func(res *Response) error {
+		seen = res
+		return errAbort
+	}))
+
+	if _, err := client.Do(req); !errors.Is(err, errAbort) {
+		t.Errorf("Wanted error:%v, got:%v", errAbort, err)
+	}
+
+	if seen == nil || seen.StatusCode != http.StatusContinue {
+		t.Errorf("Wanted the 100 Continue response to be observed, got:%+v", seen)
+	}
+
+	if rest := <-continued; rest != "" {
+		t.Errorf("Wanted no rest of the body, got:%q", rest)
+	}
+}
+
+func TestClient_DoAllow204MaxBodyBytes(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n")
+
+	client, _ := NewClient(WithAllow204MaxBodyBytes(1024))
+
+	sampleTable := []struct {
+		name        string
+		body        string
+		preview     bool
+		wantedAllow bool
+	}{
+		{name: "small body", body: "This is a GOOD FILE", wantedAllow: true},
+		{name: "large body", body: strings.Repeat("a", 4096), wantedAllow: false},
+		{name: "large body previewed", body: strings.Repeat("a", 4096), preview: true, wantedAllow: true},
+	}
+
+	for _, sample := range sampleTable {
+		httpReq, _ := http.NewRequest(http.MethodPost, "http://someurl.com/upload", strings.NewReader(sample.body))
+
+		req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sample.preview {
+			if err := req.SetPreview(1024); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		if allowed := strings.Contains(<-received, "\r\nAllow: 204\r\n"); allowed != sample.wantedAllow {
+			t.Errorf("%s: Wanted Allow: 204 sent:%t, got:%t", sample.name, sample.wantedAllow, allowed)
+		}
+	}
+}
+
+func TestClient_DoForceCompleteTypes(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+	client, _ := NewClient(WithForceCompleteTypes("application/x-msdownload"))
+
+	sampleTable := []struct {
+		contentType   string
+		wantedPreview bool
+	}{
+		{contentType: "application/x-msdownload", wantedPreview: false},
+		{contentType: "text/plain; charset=utf-8", wantedPreview: true},
+	}
+
+	for _, sample := range sampleTable {
+		httpResp := &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{sample.contentType}},
+			ContentLength: 19,
+			Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+		}
+
+		req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := req.SetPreview(4); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := <-received
+		if previewed := strings.Contains(msg, "\r\nPreview: 4\r\n"); previewed != sample.wantedPreview {
+			t.Errorf("%s: Wanted previewed:%t, got:%t", sample.contentType, sample.wantedPreview, previewed)
+		}
+
+		if !sample.wantedPreview && !strings.HasSuffix(msg, "13\r\nThis is a GOOD FILE\r\n0\r\n\r\n") {
+			t.Errorf("%s: Wanted the whole body to be sent, got:%q", sample.contentType, msg)
+		}
+	}
+}
+
+func TestClient_DoServicePreviews(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+	client, _ := NewClient(WithServicePreviews(fmt.Sprintf("icap://%s/respmod", addr), map[string]int{
+		"text/":           4,
+		"application/zip": 8,
+	}))
+
+	sampleTable := []struct {
+		url           string
+		contentType   string
+		wantedPreview string
+	}{
+		{url: "icap://%s/respmod", contentType: "text/plain; charset=utf-8", wantedPreview: "4"},
+		{url: "icap://%s/respmod", contentType: "application/zip", wantedPreview: "8"},
+		{url: "icap://%s/respmod", contentType: "image/png"},
+		{url: "icap://%s/other", contentType: "text/plain"},
+	}
+
+	for _, sample := range sampleTable {
+		httpResp := &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{sample.contentType}},
+			ContentLength: 19,
+			Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+		}
+
+		req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf(sample.url, addr), nil, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := <-received
+		if sample.wantedPreview == "" && strings.Contains(msg, "\r\nPreview:") {
+			t.Errorf("%s: Wanted no preview, got:%q", sample.contentType, msg)
+		}
+
+		if sample.wantedPreview != "" && !strings.Contains(msg, "\r\nPreview: "+sample.wantedPreview+"\r\n") {
+			t.Errorf("%s: Wanted preview:%s, got:%q", sample.contentType, sample.wantedPreview, msg)
+		}
+	}
+}
+
+func TestClient_DoBodyTerminator(t *testing.T) {
+	terminator := []byte("\r\nEND\r\n")
+
+	sampleTable := []struct {
+		name    string
+		preview int
+	}{
+		{name: "complete body"},
+		{name: "body continued after the preview", preview: 4},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			received := make(chan string, 1)
+
+			// the server reads the terminator right after the last chunk of the complete body
+			addr := startRawTestServer(t, func(conn net.Conn) {
+				r := bufio.NewReader(conn)
+				msg, err := readTestICAPRequest(r)
+				if err != nil {
+					return
+				}
+
+				if sample.preview > 0 {
+					_, _ = conn.Write([]byte(ICAP100ContinueMsg))
+
+					if msg, err = readTestChunkedBody(r, msg); err != nil {
+						return
+					}
+				}
+
+				extra := make([]byte, len(terminator))
+				_, _ = io.ReadFull(r, extra)
+				received <- msg + string(extra)
+
+				_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+			})
+
+			httpResp := &http.Response{
+				Status:        "200 OK",
+				StatusCode:    http.StatusOK,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": []string{"text/plain"}},
+				ContentLength: 19,
+				Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+			}
+
+			req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sample.preview > 0 {
+				if err := req.SetPreview(sample.preview); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			client, _ := NewClient(WithBodyTerminator(terminator))
+			if _, err := client.Do(req); err != nil {
+				t.Fatal(err)
+			}
+
+			msg := <-received
+			if !strings.HasSuffix(msg, "0\r\n\r\n"+string(terminator)) {
+				t.Errorf("Wanted the terminator after the last chunk, got:%q", msg)
+			}
+
+			if strings.Count(msg, string(terminator)) != 1 {
+				t.Errorf("Wanted the terminator to be sent once, got:%q", msg)
+			}
+		})
+	}
+}
+
+func TestClient_DoHalfCloseAfterPreview(t *testing.T) {
+	halfClosed := make(chan bool, 4)
+
+	// the server tells whether the input ended right after the request, before it answers
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := readTestICAPRequest(r); err != nil {
+				return
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, err := r.ReadByte()
+			halfClosed <- err == io.EOF
+			_ = conn.SetReadDeadline(time.Time{})
+
+			if _, err := conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")); err != nil {
+				return
+			}
+		}
+	})
+
+	newRequest := func() Request {
+		httpResp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("Hello World")),
+		}
+
+		req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := req.SetPreview(1024); err != nil {
+			t.Fatal(err)
+		}
+
+		return req
+	}
+
+	for _, enabled := range []bool{false, true} {
+		options := []ConfigOption{WithMaxIdleConns(1)}
+		if enabled {
+			options = append(options, WithHalfCloseAfterPreview())
+		}
+
+		client, _ := NewClient(options...)
+
+		for i := 0; i < 2; i++ {
+			resp, err := client.Do(newRequest())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+			}
+
+			if got := <-halfClosed; got != enabled {
+				t.Errorf("Wanted the connection half-closed:%t, got:%t", enabled, got)
+			}
+		}
+
+		// the half-closed connections can't be reused
+		wantDials := int64(1)
+		if enabled {
+			wantDials = 2
+		}
+
+		if stats := client.Stats(); stats.Dials != wantDials {
+			t.Errorf("Wanted %d dials with half-closing:%t, got:%d", wantDials, enabled, stats.Dials)
+		}
+
+		_ = client.Shutdown(context.Background())
+	}
+}
+
+func TestClient_DoPreviewDecisionTime(t *testing.T) {
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		if _, err := readTestICAPRequest(r); err != nil {
+			return
+		}
+
+		// the server takes its time to decide upon the preview
+		time.Sleep(20 * time.Millisecond)
+		_, _ = conn.Write([]byte(ICAP100ContinueMsg))
+
+		if _, err := readTestChunkedBody(r, ""); err != nil {
+			return
+		}
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	httpResp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: 19,
+		Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+	}
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.SetPreview(4); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if resp.PreviewDecisionTime < 20*time.Millisecond {
+		t.Errorf("Wanted the preview decision time to be at least %s, got:%s", 20*time.Millisecond, resp.PreviewDecisionTime)
+	}
+}
+
+func TestClient_DoOptionsWithoutPreview(t *testing.T) {
+	received := make(chan string, 1)
+
+	// the service doesn't advertise a Preview header in its OPTIONS response
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		msg, _ := readTestICAPRequest(bufio.NewReader(conn))
+		if strings.HasPrefix(msg, MethodOPTIONS) {
+			_, _ = conn.Write([]byte("ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nAllow: 204\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"))
+			return
+		}
+
+		received <- msg
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	client, _ := NewClient()
+
+	optReq, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	optResp, err := client.Do(optReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpResp := newTestResponse("This is a GOOD FILE")
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the preview set before is dropped, as the service doesn't support it
+	if err := req.SetPreview(4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.UseOptions(&optResp); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	msg := <-received
+	if strings.Contains(msg, previewHeader+":") {
+		t.Errorf("Wanted no Preview header, got:%s", msg)
+	}
+
+	if !strings.HasSuffix(msg, "13\r\nThis is a GOOD FILE\r\n0\r\n\r\n") {
+		t.Errorf("Wanted the full body to be sent, got:%s", msg)
+	}
+}
+
+func TestClient_DoDefaultAllow(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n")
+
+	client, _ := NewClient(WithDefaultAllow())
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-received; strings.Contains(msg, "\r\nAllow:") {
+		t.Errorf("Wanted no Allow header, got:%s", msg)
+	}
+
+	// an Allow header added explicitly is sent anyway
+	req, err = NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Allow", "206")
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-received; !strings.Contains(msg, "\r\nAllow: 206\r\n") {
+		t.Errorf("Wanted the Allow header:%s, got:%s", "206", msg)
+	}
+}
+
+func TestClient_DoMissingEncapsulated(t *testing.T) {
+	// the modified response is sent without declaring it by the Encapsulated header
+	addr, _ := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nISTag: ICAP-TEST\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\n"+
+		"b\r\nHello World\r\n0\r\n\r\n")
+
+	newRequest := func() Request {
+		httpResp := &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			ContentLength: 19,
+			Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+		}
+
+		req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return req
+	}
+
+	client, _ := NewClient()
+	if _, err := client.Do(newRequest()); !errors.Is(err, ErrMissingEncapsulated) {
+		t.Errorf("Wanted error:%v, got:%v", ErrMissingEncapsulated, err)
+	}
+
+	var warnings []error
+	client, _ = NewClient(WithLenientEncapsulation(func(err error) {
+		warnings = append(warnings, err)
+	}))
+
+	resp, err := client.Do(newRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(warnings) != 1 || !errors.Is(warnings[0], ErrMissingEncapsulated) {
+		t.Errorf("Wanted the warning:%v, got:%v", ErrMissingEncapsulated, warnings)
+	}
+
+	if resp.ContentResponse == nil {
+		t.Fatal("Wanted the modified http response")
+	}
+
+	body, err := io.ReadAll(resp.ContentResponse.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "Hello World" {
+		t.Errorf("Wanted the modified body:%s, got:%s", "Hello World", string(body))
+	}
+
+	// the warn function set by WithWarn is kept if lenient parsing doesn't bring its own
+	warnings = nil
+	client, _ = NewClient(WithWarn(func(err error) {
+		warnings = append(warnings, err)
+	}), WithLenientEncapsulation(nil))
+
+	if _, err := client.Do(newRequest()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(warnings) != 1 || !errors.Is(warnings[0], ErrMissingEncapsulated) {
+		t.Errorf("Wanted the warning:%v, got:%v", ErrMissingEncapsulated, warnings)
+	}
+}
+
+func TestClient_DoAddressResolver(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n")
+
+	errUnknownService := errors.New("unknown service")
+	client, _ := NewClient(WithAddressResolver(func(ctx context.Context, host string) (string, error) {
+		if host != "my-icap-service" {
+			return "", errUnknownService
+		}
+
+		return addr, nil
+	}))
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, "icap://my-icap-service/respmod", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusOK, resp.StatusCode)
+	}
+
+	// the request still names the logical host
+	if msg := <-received; !strings.HasPrefix(msg, "OPTIONS icap://my-icap-service/respmod ICAP/1.0\r\n") {
+		t.Errorf("Wanted the logical host in the request line, got:%s", msg)
+	}
+
+	req, err = NewRequest(context.Background(), MethodOPTIONS, "icap://other-service/respmod", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Do(req); !errors.Is(err, errUnknownService) {
+		t.Errorf("Wanted error:%v, got:%v", errUnknownService, err)
+	}
+}
+
+func TestClient_DoEmptyResponse(t *testing.T) {
+	// the server accepts the connection, but closes it right away
+	addr := startRawTestServer(t, func(conn net.Conn) {})
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	if _, err := client.Do(req); !errors.Is(err, ErrEmptyResponse) {
+		t.Errorf("Wanted error:%v, got:%v", ErrEmptyResponse, err)
+	}
+}
+
+func TestClient_DoErrorContext(t *testing.T) {
+	// a listener which is closed right away leaves an address nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	emptyAddr := startRawTestServer(t, func(conn net.Conn) {})
+	// the body is declared beyond the end of the message
+	invalidAddr, _ := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nISTag: ICAP-TEST\r\n"+
+		"Encapsulated: res-hdr=0, res-body=500\r\n\r\nHTTP/1.1 200 OK\r\n\r\n")
+	missingAddr, _ := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nISTag: ICAP-TEST\r\n\r\n")
+
+	errUnknownService := errors.New("unknown service")
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		options    []ConfigOption
+		wantPrefix string
+		wantErr    error
+	}{
+		{
+			name:   "resolve",
+			method: MethodOPTIONS,
+			url:    "icap://my-icap-service/respmod",
+			options: []ConfigOption{WithAddressResolver(func(ctx context.Context, host string) (string, error) {
+				return "", errUnknownService
+			})},
+			wantPrefix: "icap: resolve my-icap-service: ",
+			wantErr:    errUnknownService,
+		},
+		{
+			name:       "connect",
+			method:     MethodOPTIONS,
+			url:        fmt.Sprintf("icap://%s/respmod", closedAddr),
+			wantPrefix: fmt.Sprintf("icap: connect to %s: ", closedAddr),
+			wantErr:    syscall.ECONNREFUSED,
+		},
+		{
+			name:       "send",
+			method:     MethodOPTIONS,
+			url:        fmt.Sprintf("icap://%s/respmod", emptyAddr),
+			wantPrefix: "icap: send request: ",
+			wantErr:    ErrEmptyResponse,
+		},
+		{
+			name:       "parse",
+			method:     MethodOPTIONS,
+			url:        fmt.Sprintf("icap://%s/respmod", invalidAddr),
+			wantPrefix: "icap: parse response: ",
+			wantErr:    ErrInvalidTCPMsg,
+		},
+		{
+			name:       "missing encapsulated",
+			method:     MethodREQMOD,
+			url:        fmt.Sprintf("icap://%s/reqmod", missingAddr),
+			wantPrefix: "icap: parse response: ",
+			wantErr:    ErrMissingEncapsulated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var httpReq *http.Request
+			if tt.method == MethodREQMOD {
+				httpReq, _ = http.NewRequest(http.MethodGet, "http://example.com", nil)
+			}
+
+			req, err := NewRequest(context.Background(), tt.method, tt.url, httpReq, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, _ := NewClient(tt.options...)
+
+			_, err = client.Do(req)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantPrefix) {
+				t.Errorf("Wanted the error to start with:%q, got:%v", tt.wantPrefix, err)
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Wanted error:%v, got:%v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestClient_DoStrictMode(t *testing.T) {
+	addr, _ := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+	tests := []struct {
+		name    string
+		method  string
+		modify  func(req *Request)
+		wantErr error
+	}{
+		{
+			name:   "compliant",
+			method: MethodRESPMOD,
+			modify: func(req *Request) {
+				req.AdvertisePreview(4)
+			},
+		},
+		{
+			name:   "empty Host",
+			method: MethodRESPMOD,
+			modify: func(req *Request) {
+				req.Header.Set("Host", "")
+			},
+			wantErr: ErrMissingHostHeader,
+		},
+		{
+			name:   "malformed Preview",
+			method: MethodRESPMOD,
+			modify: func(req *Request) {
+				req.Header.Set("Preview", "four")
+			},
+			wantErr: ErrInvalidPreviewHeader,
+		},
+		{
+			name:   "Preview for OPTIONS",
+			method: MethodOPTIONS,
+			modify: func(req *Request) {
+				req.Header.Set("Preview", "0")
+			},
+			wantErr: ErrInvalidPreviewHeader,
+		},
+		{
+			name:   "Encapsulated set",
+			method: MethodRESPMOD,
+			modify: func(req *Request) {
+				req.Header.Set("Encapsulated", "null-body=0")
+			},
+			wantErr: ErrInvalidEncapsulatedHeader,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newRequest := func() Request {
+				var httpResp *http.Response
+				if tt.method == MethodRESPMOD {
+					httpResp = &http.Response{
+						StatusCode: http.StatusOK,
+						Proto:      "HTTP/1.1",
+						ProtoMajor: 1,
+						ProtoMinor: 1,
+						Header:     http.Header{"Content-Type": []string{"text/plain"}},
+						Body:       io.NopCloser(strings.NewReader("Hello World")),
+					}
+				}
+
+				req, err := NewRequest(context.Background(), tt.method, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.modify(&req)
+
+				return req
+			}
+
+			// the lenient client sends the request as it's built
+			lenient, _ := NewClient()
+			if _, err := lenient.Do(newRequest()); err != nil {
+				t.Fatalf("Wanted the lenient client to accept the request, got:%v", err)
+			}
+
+			strict, _ := NewClient(WithStrictMode())
+			_, err := strict.Do(newRequest())
+
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Wanted the strict client to accept the request, got:%v", err)
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Wanted error:%v, got:%v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestClient_DoMaxChunks(t *testing.T) {
+	// the server trickles an endless body of single byte chunks
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		_, _ = readTestICAPRequest(bufio.NewReader(conn))
+
+		reply := "ICAP/1.0 200 OK\r\nISTag: ICAP-TEST\r\n" +
+			"Encapsulated: res-hdr=0, res-body=47\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+
+		for i := 0; i < 1000; i++ {
+			if _, err := conn.Write([]byte("1\r\na\r\n")); err != nil {
+				return
+			}
+		}
+	})
+
+	httpResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("Hello World")),
+	}
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient(WithMaxChunks(10))
+	if _, err := client.Do(req); !errors.Is(err, ErrTooManyChunks) {
+		t.Errorf("Wanted error:%v, got:%v", ErrTooManyChunks, err)
+	}
+}
+
+func TestClient_DoFollowNextServices(t *testing.T) {
+	// startService starts an ICAP service which passes the received messages on and answers with the given reply
+	startService := func(reply func() string) (string, chan string) {
+		received := make(chan string, 1)
+
+		addr := startRawTestServer(t, func(conn net.Conn) {
+			msg, _ := readTestICAPRequest(bufio.NewReader(conn))
+			received <- msg
+
+			_, _ = conn.Write([]byte(reply()))
+		})
+
+		return addr, received
+	}
+
+	noContentReply := func(nextServices ...string) func() string {
+		return func() string {
+			reply := "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n"
+			if len(nextServices) > 0 {
+				reply += "X-Next-Services: " + strings.Join(nextServices, ", ") + "\r\n"
+			}
+			return reply + "\r\n"
+		}
+	}
+
+	modifiedReply := func(nextServices ...string) func() string {
+		return func() string {
+			reply := "ICAP/1.0 200 OK\r\nISTag: ICAP-TEST\r\n"
+			if len(nextServices) > 0 {
+				reply += "X-Next-Services: " + strings.Join(nextServices, ", ") + "\r\n"
+			}
+			return reply + "Encapsulated: res-hdr=0, res-body=65\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n" +
+				"Content-Type: plain/text\r\n" +
+				"Content-Length: 12\r\n\r\n" +
+				"c\r\n" +
+				"Hello World!\r\n" +
+				"0\r\n\r\n"
+		}
+	}
+
+	newRequest := func(addr string) Request {
+		httpResp := newTestResponse("This is a GOOD FILE")
+
+		req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Client-IP", "10.0.0.1")
+
+		return req
+	}
+
+	t.Run("not following", func(t *testing.T) {
+		nextAddr, _ := startService(modifiedReply())
+		addr, _ := startService(noContentReply(fmt.Sprintf("icap://%s/respmod", nextAddr)))
+
+		client, _ := NewClient()
+		resp, err := client.Do(newRequest(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+		}
+	})
+
+	t.Run("unmodified then modified", func(t *testing.T) {
+		nextAddr, received := startService(modifiedReply())
+		addr, _ := startService(noContentReply(fmt.Sprintf("icap://%s/respmod", nextAddr)))
+
+		client, _ := NewClient(WithFollowNextServices(nextAddr))
+		resp, err := client.Do(newRequest(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Wanted status code:%d, got:%d", http.StatusOK, resp.StatusCode)
+		}
+
+		if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != "Hello World!" {
+			t.Errorf("Wanted the content of the next service, got:%s", string(body))
+		}
+
+		msg := <-received
+		if !strings.Contains(msg, "13\r\nThis is a GOOD FILE\r\n0\r\n\r\n") {
+			t.Errorf("Wanted the next service to receive the original content, got:%s", msg)
+		}
+
+		if !strings.Contains(msg, "X-Client-Ip: 10.0.0.1\r\n") {
+			t.Errorf("Wanted the next service to receive the ICAP headers of the request, got:%s", msg)
+		}
+	})
+
+	t.Run("modified then unmodified", func(t *testing.T) {
+		nextAddr, received := startService(noContentReply())
+		addr, _ := startService(modifiedReply(fmt.Sprintf("icap://%s/respmod", nextAddr)))
+
+		client, _ := NewClient(WithFollowNextServices(nextAddr))
+		resp, err := client.Do(newRequest(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Wanted the modification of the first service with status code:%d, got:%d", http.StatusOK, resp.StatusCode)
+		}
+
+		if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != "Hello World!" {
+			t.Errorf("Wanted the content of the first service, got:%s", string(body))
+		}
+
+		if msg := <-received; !strings.HasSuffix(msg, "\r\n\r\nc\r\nHello World!\r\n0\r\n\r\n") {
+			t.Errorf("Wanted the next service to receive the modified content, got:%s", msg)
+		}
+	})
+
+	t.Run("host not allowed", func(t *testing.T) {
+		nextAddr, _ := startService(modifiedReply())
+		addr, _ := startService(noContentReply(fmt.Sprintf("icap://%s/respmod", nextAddr)))
+
+		client, _ := NewClient(WithFollowNextServices())
+		if _, err := client.Do(newRequest(addr)); !errors.Is(err, ErrNextServiceNotAllowed) {
+			t.Errorf("Wanted error:%v, got:%v", ErrNextServiceNotAllowed, err)
+		}
+	})
+}
+
+func TestClient_DoEarlyNoContent(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+
+		// only the ICAP headers are read, the server decides without looking at the body
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == crlf {
+				break
+			}
+		}
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+
+		// the connection is kept open without reading the rest of the body
+		<-release
+	})
+
+	body := strings.Repeat("This is a GOOD FILE", 1<<18)
+	httpResp := newTestResponse(body)
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		resp Response
+		err  error
+	}
+	done := make(chan result, 1)
+
+	client, _ := NewClient(WithICAPConnectionTimeout(5 * time.Second))
+	go func() {
+		resp, err := client.Do(req)
+		done <- result{resp, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+
+		if res.resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, res.resp.StatusCode)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Do did not return after the early 204")
+	}
+
+	// the routine writing the rest of the body must not be held once the connection is closed
+	deadline := time.Now().Add(2 * time.Second)
+	for sendRoutineRunning() {
+		if time.Now().After(deadline) {
+			t.Fatal("The routine writing the message is still held after Do returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_DoEarlyNoContentNotPooled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == crlf {
+				break
+			}
+		}
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+
+		<-release
+	})
+
+	client, _ := NewClient(WithMaxIdleConns(1), WithICAPConnectionTimeout(5*time.Second))
+
+	for i := 0; i < 2; i++ {
+		req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, newTestResponse(strings.Repeat("This is a GOOD FILE", 1<<20)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+		}
+	}
+
+	// the body was still being written when the server answered, so the connection must not be used again
+	if stats := client.Stats(); stats.Dials != 2 || stats.Reuses != 0 {
+		t.Errorf("Wanted 2 dials and no reuse, got:%+v", stats)
+	}
+}
+
+// sendRoutineRunning determines if a routine started by ICAPConn.Send is running
+func sendRoutineRunning() bool {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	return bytes.Contains(buf, []byte("(*ICAPConn).Send.func"))
+}
+
+func TestClient_DoPathRewrite(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nEncapsulated: null-body=0\r\n\r\n")
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/scan", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient(WithPathRewrite(func(path string) string {
+		return strings.Replace(path, "/scan", "/av/respmod", 1)
+	}))
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := fmt.Sprintf("OPTIONS icap://%s/av/respmod ICAP/1.0\r\n", addr)
+	if msg := <-received; !strings.HasPrefix(msg, wanted) {
+		t.Errorf("Wanted request line:%s, got:%s", wanted, msg)
+	}
+
+	if req.URL.Path != "/scan" {
+		t.Errorf("Wanted the url of the request to stay:%s, got:%s", "/scan", req.URL.Path)
+	}
+}
+
+func TestClient_DoDialTimeout(t *testing.T) {
+	// the name of the server is never resolved, so dialing it only ends once it timed out
+	const hungURL = "icap://icap.invalid:1344/respmod"
+
+	hungResolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	timedOut := func(err error) bool {
+		var netErr net.Error
+		return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+	}
+
+	t.Run("client timeout", func(t *testing.T) {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, hungURL, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, _ := NewClient(WithICAPConnectionTimeout(100*time.Millisecond), WithResolver(hungResolver))
+
+		start := time.Now()
+		if _, err := client.Do(req); !timedOut(err) {
+			t.Fatalf("Wanted the dial to time out, got:%v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Wanted the dial to fail promptly, took:%v", elapsed)
+		}
+	})
+
+	t.Run("request timeout", func(t *testing.T) {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, hungURL, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetTimeout(100 * time.Millisecond)
+
+		client, _ := NewClient(WithICAPConnectionTimeout(time.Minute), WithResolver(hungResolver))
+
+		start := time.Now()
+		if _, err := client.Do(req); !timedOut(err) {
+			t.Fatalf("Wanted the dial to time out, got:%v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Wanted the dial to fail promptly, took:%v", elapsed)
+		}
+	})
+}
+
+func TestClient_DoServerRequestTimeout(t *testing.T) {
+	addr, _ := startReplyTestServer(t, "ICAP/1.0 408 Request Timeout\r\nISTag: ICAP-TEST\r\n\r\n")
+
+	newRequest := func() Request {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	client, _ := NewClient()
+	resp, err := client.Do(newRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusRequestTimeout, resp.StatusCode)
+	}
+
+	client, _ = NewClient(WithReturnErrorOnICAPFailure())
+	resp, err = client.Do(newRequest())
+
+	if !errors.Is(err, ErrServerRequestTimeout) {
+		t.Errorf("Wanted error:%v, got:%v", ErrServerRequestTimeout, err)
+	}
+
+	if !errors.Is(err, ErrICAPFailure) {
+		t.Errorf("Wanted error:%v, got:%v", ErrICAPFailure, err)
+	}
+
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Wanted the failed response with status code:%d, got:%d", http.StatusRequestTimeout, resp.StatusCode)
+	}
+}
+
+func TestClient_DoRawEncapsulatedBody(t *testing.T) {
+	httpReq, err := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpResp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header:     http.Header{"Content-Type": []string{"plain/text"}},
+		Body:       io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+	}
+
+	sampleTable := []struct {
+		method   string
+		kind     string
+		httpReq  *http.Request
+		httpResp *http.Response
+	}{
+		{method: MethodREQMOD, kind: "req-body", httpReq: httpReq},
+		{method: MethodRESPMOD, kind: "res-body", httpResp: httpResp},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.method, func(t *testing.T) {
+			addr, received := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+			req, err := NewRequest(context.Background(), sample.method, fmt.Sprintf("icap://%s/raw", addr), sample.httpReq, sample.httpResp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := req.SetRawEncapsulatedBody(sample.kind, []byte("<document/>")); err != nil {
+				t.Fatal(err)
+			}
+
+			client, _ := NewClient()
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+			}
+
+			// the raw body takes the place of the http message
+			msg := <-received
+			_, encapsulated, _ := strings.Cut(msg, "\r\n\r\n")
+			if !strings.Contains(msg, "Encapsulated:  "+sample.kind+"=0\r\n") || encapsulated != "b\r\n<document/>\r\n0\r\n\r\n" {
+				t.Errorf("Wanted the raw body as %s only, got:%s", sample.kind, msg)
+			}
+		})
+	}
+}
+
+func TestClient_DoRESPMODFromFile(t *testing.T) {
+	content := strings.Repeat("This is a GOOD FILE. ", 100)
+
+	f, err := os.CreateTemp(t.TempDir(), "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 2)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+
+		preview, _ := readTestICAPRequest(r)
+		received <- preview
+
+		_, _ = conn.Write([]byte(ICAP100ContinueMsg))
+
+		rest, _ := readTestChunkedBody(r, "")
+		received <- rest
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	req, err := NewRESPMODRequestFromFile(context.Background(), fmt.Sprintf("icap://%s/respmod", addr), f, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.HTTPResponse.ContentLength != int64(len(content)) {
+		t.Errorf("Wanted content length:%d, got:%d", len(content), req.HTTPResponse.ContentLength)
+	}
+
+	if err := req.SetPreview(previewBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient(WithICAPConnectionTimeout(5 * time.Second))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	preview := <-received
+	if !strings.Contains(preview, fmt.Sprintf("Content-Length: %d\r\n", len(content))) {
+		t.Errorf("Wanted the size of the file as Content-Length, got:%s", preview)
+	}
+
+	if wanted := fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", previewBytes, content[:previewBytes]); !strings.HasSuffix(preview, wanted) {
+		t.Errorf("Wanted the preview:%s, got:%s", wanted, preview)
+	}
+
+	rest := content[previewBytes:]
+	if wanted := fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(rest), rest); <-received != wanted {
+		t.Errorf("Wanted the rest of the file after the preview:%s", wanted)
+	}
+}
+
+// patternReadSeeker is a body of the given size which is generated as it's read, so it takes no memory itself
+type patternReadSeeker struct {
+	size, off int64
+}
+
+func (p *patternReadSeeker) Read(b []byte) (int, error) {
+	if p.off >= p.size {
+		return 0, io.EOF
+	}
+
+	n := int(min(int64(len(b)), p.size-p.off))
+	for i := range b[:n] {
+		b[i] = byte('a' + (p.off+int64(i))%26)
+	}
+	p.off += int64(n)
+
+	return n, nil
+}
+
+func (p *patternReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		p.off = offset
+	case io.SeekCurrent:
+		p.off += offset
+	case io.SeekEnd:
+		p.off = p.size + offset
+	}
+
+	return p.off, nil
+}
+
+func TestClient_DoSeekablePreviewContinuation(t *testing.T) {
+	const size = 32 << 20
+	const preview = 1024
+
+	// the checksum of the body the server received, its preview and the rest following the 100 Continue
+	checksum := make(chan uint32, 1)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		hash := crc32.NewIEEE()
+
+		msg, err := readTestICAPRequest(r)
+		if err != nil {
+			return
+		}
+
+		_, previewBody, _ := strings.Cut(msg, fmt.Sprintf("%x\r\n", preview))
+		hash.Write([]byte(strings.TrimSuffix(previewBody, "\r\n0\r\n\r\n")))
+
+		if _, err := conn.Write([]byte("ICAP/1.0 100 Continue\r\n\r\n")); err != nil {
+			return
+		}
+
+		// the rest of the body is checked as it's read, it's not held in memory
+		if err := copyTestChunkedBody(hash, r); err != nil {
+			return
+		}
+		checksum <- hash.Sum32()
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	req, err := NewRESPMODRequestFromReadSeeker(context.Background(), fmt.Sprintf("icap://%s/respmod", addr), &patternReadSeeker{size: size}, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.SetPreview(preview); err != nil {
+		t.Fatal(err)
+	}
+
+	if req.remainingPreviewBytes != nil {
+		t.Errorf("Wanted the rest of the body not to be held in memory, got %d bytes", len(req.remainingPreviewBytes))
+	}
+
+	client, _ := NewClient()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	wanted := crc32.NewIEEE()
+	if _, err := io.Copy(wanted, &patternReadSeeker{size: size}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-checksum; got != wanted.Sum32() {
+		t.Errorf("Wanted the entire body to be received, got checksum:%x, wanted:%x", got, wanted.Sum32())
+	}
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("Wanted the body to be sent with bounded memory, allocated %d bytes for a body of %d", allocated, size)
+	}
+}
+
+func TestClient_DoFileWithoutPreview(t *testing.T) {
+	const size = 32 << 20
+
+	f, err := os.CreateTemp(t.TempDir(), "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, &patternReadSeeker{size: size}); err != nil {
+		t.Fatal(err)
+	}
+
+	head := make(chan string, 1)
+	checksum := make(chan uint32, 1)
+
+	// the body is checked as it's read, it's not held in memory
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+
+		msg, _, err := readTestICAPHead(r)
+		if err != nil {
+			return
+		}
+		head <- msg
+
+		hash := crc32.NewIEEE()
+		if err := copyTestChunkedBody(hash, r); err != nil {
+			return
+		}
+		checksum <- hash.Sum32()
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	req, err := NewRESPMODRequestFromFile(context.Background(), fmt.Sprintf("icap://%s/respmod", addr), f, "application/octet-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.ReadMemStats(&after)
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	msg := <-head
+	if !strings.Contains(msg, ", res-body=") || !strings.Contains(msg, fmt.Sprintf("Content-Length: %d\r\n", size)) {
+		t.Errorf("Wanted the file to be encapsulated as the body with its size as Content-Length, got:%s", msg)
+	}
+
+	wanted := crc32.NewIEEE()
+	if _, err := io.Copy(wanted, &patternReadSeeker{size: size}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-checksum; got != wanted.Sum32() {
+		t.Errorf("Wanted the entire file to be received, got checksum:%x, wanted:%x", got, wanted.Sum32())
+	}
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("Wanted the file to be sent with bounded memory, allocated %d bytes for a file of %d", allocated, size)
+	}
+}
+
+func TestClient_DoProgress(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+	body := strings.Repeat("This is a GOOD FILE", 1<<14)
+	httpResp := newTestResponse(body)
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent, lastReceived []int64
+	client, _ := NewClient(WithProgress(func(s, r int64) {
+		sent = append(sent, s)
+		lastReceived = append(lastReceived, r)
+	}))
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-received
+
+	if len(sent) < 2 {
+		t.Fatalf("Wanted the progress to be reported periodically, got:%v", sent)
+	}
+
+	for i := 1; i < len(sent); i++ {
+		if sent[i] < sent[i-1] {
+			t.Fatalf("Wanted the sent bytes to grow monotonically, got:%d after:%d", sent[i], sent[i-1])
+		}
+	}
+
+	if got := sent[len(sent)-1]; got != int64(len(msg)) {
+		t.Errorf("Wanted the sent bytes to reach the message size:%d, got:%d", len(msg), got)
+	}
+
+	if got := lastReceived[len(lastReceived)-1]; got == 0 {
+		t.Error("Wanted the received bytes to be reported")
+	}
+}
+
+func TestClient_DoMaxPreviewBytes(t *testing.T) {
+	received := make(chan string, 2)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+
+		msg, _ := readTestICAPRequest(r)
+
+		// the OPTIONS request advertises a huge preview
+		if strings.HasPrefix(msg, MethodOPTIONS) {
+			_, _ = conn.Write([]byte("ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nPreview: 1073741824\r\nEncapsulated: null-body=0\r\n\r\n"))
+			return
+		}
+		received <- msg
+
+		_, _ = conn.Write([]byte(ICAP100ContinueMsg))
+
+		rest, _ := readTestChunkedBody(r, "")
+		received <- rest
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	urlStr := fmt.Sprintf("icap://%s/respmod", addr)
+
+	client, _ := NewClient(WithMaxPreviewBytes(8))
+
+	optReq, err := NewRequest(context.Background(), MethodOPTIONS, urlStr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	optResp, err := client.Do(optReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpResp := newTestResponse("This is a GOOD FILE")
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, urlStr, nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.SetPreview(optResp.PreviewBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	preview := <-received
+	if !strings.Contains(preview, "Preview: 8\r\n") || !strings.HasSuffix(preview, "8\r\nThis is \r\n0\r\n\r\n") {
+		t.Errorf("Wanted the preview to be capped to 8 bytes, got:%s", preview)
+	}
+
+	if rest := <-received; rest != "b\r\na GOOD FILE\r\n0\r\n\r\n" {
+		t.Errorf("Wanted the rest of the body after the capped preview, got:%s", rest)
+	}
+}
+
+func TestClient_DoTrace(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+	addr, received := startReplyTestServer(t, reply)
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace := &ICAPTrace{}
+	req.SetTrace(trace)
+
+	client, _ := NewClient()
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if trace.ConnectStart.IsZero() {
+		t.Error("Wanted the connect time to be recorded")
+	}
+
+	if len(trace.Exchanges) != 1 {
+		t.Fatalf("Wanted one exchange, got:%d", len(trace.Exchanges))
+	}
+
+	if sent := string(trace.Exchanges[0].Sent); sent != <-received {
+		t.Errorf("Wanted the sent OPTIONS request to be recorded, got:%s", sent)
+	}
+
+	if got := string(trace.Exchanges[0].Received); got != reply {
+		t.Errorf("Wanted the received reply:%s, got:%s", reply, got)
+	}
+
+	if trace.Duration < trace.Exchanges[0].Duration {
+		t.Errorf("Wanted the total duration:%v to cover the exchange:%v", trace.Duration, trace.Exchanges[0].Duration)
+	}
+}
+
+func TestClient_DoTracePooledConnection(t *testing.T) {
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := readTestICAPRequest(r); err != nil {
+				return
+			}
+
+			if _, err := conn.Write([]byte("ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n")); err != nil {
+				return
+			}
+		}
+	})
+
+	client, _ := NewClient(WithMaxIdleConns(1))
+
+	traces := []*ICAPTrace{{}, {}}
+	for _, trace := range traces {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetTrace(trace)
+
+		start := time.Now()
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		if elapsed := time.Since(start); trace.Duration <= 0 || trace.Duration > elapsed {
+			t.Errorf("Wanted a duration within the request:%v, got:%v", elapsed, trace.Duration)
+		}
+	}
+
+	// the second request reuses the pooled connection, so it didn't connect
+	if traces[0].ConnectStart.IsZero() {
+		t.Error("Wanted the connect time of the first request to be recorded")
+	}
+
+	if !traces[1].ConnectStart.IsZero() || traces[1].ConnectDuration != 0 {
+		t.Errorf("Wanted no connect time for the reused connection, got:%v and %v", traces[1].ConnectStart, traces[1].ConnectDuration)
+	}
+}
+
+func TestClient_DoSetContext(t *testing.T) {
+	// the server reads the request but never replies
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		_, _ = readTestICAPRequest(bufio.NewReader(conn))
+		time.Sleep(5 * time.Second)
+	})
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := req.SetContext(nil); !errors.Is(err, ErrNoContext) {
+		t.Errorf("Wanted:%v, got:%v", ErrNoContext, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := req.SetContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient(WithICAPConnectionTimeout(time.Minute))
+
+	start := time.Now()
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("Wanted an error when the deadline of the new context is exceeded")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Wanted the deadline of the new context to be honored, took:%v", elapsed)
+	}
+}
+
+func TestClient_Shutdown(t *testing.T) {
+	// the server reads the request but never replies
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		_, _ = readTestICAPRequest(bufio.NewReader(conn))
+		time.Sleep(5 * time.Second)
+	})
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient(WithICAPConnectionTimeout(time.Minute))
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Do(req)
+		errs <- err
+	}()
+
+	// give the request the time to hang on the server
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := client.Shutdown(ctx); err != nil {
+		t.Fatalf("Wanted the in-flight request to finish, got:%v", err)
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Wanted error:%v, got:%v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wanted the in-flight request to be aborted")
+	}
+
+	if _, err := client.Do(req); !errors.Is(err, ErrClientShutdown) {
+		t.Errorf("Wanted error:%v, got:%v", ErrClientShutdown, err)
+	}
+}
+
+// bearerAuthenticator sets a bearer token on every request, it fails if there's no token
+type bearerAuthenticator struct {
+	token string
+}
+
+func (a bearerAuthenticator) Apply(req *Request) error {
+	if a.token == "" {
+		return errors.New("no token")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	return nil
+}
+
+func TestClient_DoAuthenticator(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+
+	t.Run("credentials are sent", func(t *testing.T) {
+		addr, received := startReplyTestServer(t, reply)
+
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, _ := NewClient(WithAuthenticator(bearerAuthenticator{token: "secret"}))
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := <-received; !strings.Contains(msg, "\r\nAuthorization: Bearer secret\r\n") {
+			t.Errorf("Wanted the credentials on the wire, got:%s", msg)
+		}
+	})
+
+	t.Run("authenticator error", func(t *testing.T) {
+		addr, _ := startReplyTestServer(t, reply)
+
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, _ := NewClient(WithAuthenticator(bearerAuthenticator{}))
+		if _, err := client.Do(req); err == nil {
+			t.Error("Wanted the error of the authenticator")
+		}
+	})
+}
+
+func TestClient_DoHeaderFunc(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+	addr, received := startReplyTestServer(t, reply)
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	client, _ := NewClient(WithHeaderFunc(func(req *Request) {
+		calls++
+		req.Header.Set("X-Correlation-Id", "42")
+	}))
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-received; !strings.Contains(msg, "\r\nX-Correlation-Id: 42\r\n") {
+		t.Errorf("Wanted the header added by the hook on the wire, got:%s", msg)
+	}
+
+	if calls != 1 {
+		t.Errorf("Wanted the hook to be called once, got:%d", calls)
+	}
+}
+
+func TestClient_DoSequence(t *testing.T) {
+	replies := []string{
+		"ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nPreview: 4\r\nEncapsulated: null-body=0\r\n\r\n",
+		"ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n",
+	}
+
+	var connections atomic.Int32
+	received := make(chan string, len(replies))
+
+	// the server answers the requests one after another on the same connection
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		connections.Add(1)
+
+		r := bufio.NewReader(conn)
+		for _, reply := range replies {
+			msg, err := readTestICAPRequest(r)
+			if err != nil {
+				return
+			}
+			received <- msg
+
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	})
+
+	optReq, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpResp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: 11,
+		Body:          io.NopCloser(strings.NewReader("Hello World")),
+	}
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	responses, err := client.DoSequence(&optReq, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(responses) != 2 {
+		t.Fatalf("Wanted 2 responses, got:%d", len(responses))
+	}
+
+	if responses[0].StatusCode != http.StatusOK || responses[0].PreviewBytes != 4 {
+		t.Errorf("Wanted the OPTIONS response first, got:%d with preview:%d", responses[0].StatusCode, responses[0].PreviewBytes)
+	}
+
+	if responses[1].StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, responses[1].StatusCode)
+	}
+
+	if msg := <-received; !strings.HasPrefix(msg, "OPTIONS ") {
+		t.Errorf("Wanted the OPTIONS request first, got:%s", msg)
+	}
+
+	if msg := <-received; !strings.HasPrefix(msg, "RESPMOD ") || !strings.Contains(msg, "Hello World") {
+		t.Errorf("Wanted the RESPMOD request second, got:%s", msg)
+	}
+
+	if n := connections.Load(); n != 1 {
+		t.Errorf("Wanted a single connection, got:%d", n)
+	}
+}
+
+func TestClient_DoSequenceError(t *testing.T) {
+	// the server answers the first request only and closes the connection
+	addr, _ := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n")
+
+	optReq, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherReq, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	responses, err := client.DoSequence(&optReq, &otherReq)
+	if err == nil {
+		t.Error("Wanted an error for the request the server did not answer")
+	}
+
+	if len(responses) != 1 || responses[0].StatusCode != http.StatusOK {
+		t.Errorf("Wanted the response gathered before the error, got:%v", responses)
+	}
+
+	mismatchReq, _ := NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1/respmod", nil, nil)
+	if _, err := client.DoSequence(&optReq, &mismatchReq); !errors.Is(err, ErrSequenceHostMismatch) {
+		t.Errorf("Wanted error:%v, got:%v", ErrSequenceHostMismatch, err)
+	}
+}
+
+func TestClient_Stats(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+
+	// the server answers every request on a connection until the client closes it
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := readTestICAPRequest(r); err != nil {
+				return
+			}
+
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	})
+
+	client, _ := NewClient(WithMaxIdleConns(2))
+
+	for i := 0; i < 3; i++ {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := client.Stats()
+	if stats.Dials != 1 || stats.Reuses != 2 || stats.ActiveConns != 0 {
+		t.Errorf("Wanted 1 dial, 2 reuses and no active connection, got:%+v", stats)
+	}
+
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := client.Stats(); stats.IdleClosed != 1 {
+		t.Errorf("Wanted the idle connection to be closed on shutdown, got:%+v", stats)
+	}
+}
+
+// fakeClock is a clock which only moves when it's advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter is a channel of the fake clock which fires once the clock reaches the time
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+
+	return ch
+}
+
+// Advance moves the clock forward and fires the channels of the times it reaches
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	c.waiters = slices.DeleteFunc(c.waiters, func(w fakeWaiter) bool {
+		if w.at.After(c.now) {
+			return false
+		}
+
+		w.ch <- c.now
+		return true
+	})
+}
+
+func TestClient_IdleConnTimeout(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := readTestICAPRequest(r); err != nil {
+				return
+			}
+
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	})
+
+	clock := &fakeClock{now: time.Date(2000, time.January, 10, 9, 55, 21, 0, time.UTC)}
+	client, _ := NewClient(WithMaxIdleConns(1), WithIdleConnTimeout(time.Minute), func(cfg *Config) {
+		cfg.clock = clock
+	})
+
+	do := func() {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do()
+	clock.Advance(30 * time.Second)
+	do()
+
+	if stats := client.Stats(); stats.Dials != 1 || stats.Reuses != 1 {
+		t.Errorf("Wanted the idle connection to be reused, got:%+v", stats)
+	}
+
+	// the connection idled too long, so a new one is dialed
+	clock.Advance(2 * time.Minute)
+	do()
+
+	if stats := client.Stats(); stats.Dials != 2 || stats.Reuses != 1 || stats.IdleClosed != 1 {
+		t.Errorf("Wanted the expired idle connection to be closed, got:%+v", stats)
+	}
+}
+
+func TestClient_KeepaliveInterval(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+	received := make(chan string, 4)
+
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := readTestICAPRequest(r)
+			if err != nil {
+				return
+			}
+			received <- msg
+
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	})
+
+	clock := &fakeClock{now: time.Date(2000, time.January, 10, 9, 55, 21, 0, time.UTC)}
+	client, _ := NewClient(WithMaxIdleConns(1), WithKeepaliveInterval(time.Minute), func(cfg *Config) {
+		cfg.clock = clock
+	})
+	defer func() {
+		_ = client.Shutdown(context.Background())
+	}()
+
+	// waitForPings waits until the pings wait for the next interval
+	waitForPings := func() {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			clock.mu.Lock()
+			waiting := len(clock.waiters) > 0
+			clock.mu.Unlock()
+
+			if waiting {
+				return
+			}
+		}
+
+		t.Fatal("Wanted the pings to wait for the next interval")
+	}
+
+	serviceURL := fmt.Sprintf("icap://%s/respmod", addr)
+	do := func() {
+		req, err := NewRequest(context.Background(), MethodRESPMOD, serviceURL, nil, &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		<-received
+	}
+
+	do()
+	waitForPings()
+
+	// the connection idled for the interval, so it's pinged with an OPTIONS request for the service
+	clock.Advance(time.Minute)
+
+	select {
+	case msg := <-received:
+		if !strings.HasPrefix(msg, "OPTIONS "+serviceURL+" ICAP/1.0\r\n") {
+			t.Errorf("Wanted an OPTIONS ping for the service, got:%s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wanted the idle connection to be pinged")
+	}
+
+	waitForPings()
+	do()
+
+	if stats := client.Stats(); stats.Dials != 1 || stats.Reuses != 1 {
+		t.Errorf("Wanted the pinged connection to be reused, got:%+v", stats)
+	}
+}
+
+func TestClient_KeepalivePingDuringShutdown(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+	pinged := make(chan struct{})
+	release := make(chan struct{})
+	closed := make(chan struct{})
+
+	// the server holds the reply to the ping back until the client shut down, then waits for the connection to be closed
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := readTestICAPRequest(r)
+			if err != nil {
+				return
+			}
+
+			ping := strings.HasPrefix(msg, "OPTIONS ")
+			if ping {
+				close(pinged)
+				<-release
+			}
+
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+
+			if ping {
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := r.ReadByte(); err == io.EOF {
+					close(closed)
+				}
+				return
+			}
+		}
+	})
+
+	clock := &fakeClock{now: time.Date(2000, time.January, 10, 9, 55, 21, 0, time.UTC)}
+	client, _ := NewClient(WithMaxIdleConns(1), WithKeepaliveInterval(time.Minute), func(cfg *Config) {
+		cfg.clock = clock
+	})
+
+	req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keepalive waits for the interval, then pings the idle connection
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		clock.Advance(time.Minute)
+
+		select {
+		case <-pinged:
+		case <-time.After(time.Millisecond):
+			if time.Now().Before(deadline) {
+				continue
+			}
+			t.Fatal("Wanted the idle connection to be pinged")
+		}
+
+		break
+	}
+
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	// the ping finishes after the shutdown, its connection must not be put back into the pool
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("Wanted the pinged connection to be closed after the shutdown")
+	}
+}
+
+func TestClient_DoStaleIdleConn(t *testing.T) {
+	// the server closes the connection after every reply
+	addr, _ := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n")
+
+	client, _ := NewClient(WithMaxIdleConns(1))
+
+	for i := 0; i < 2; i++ {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the stale idle connection is replaced by a new one
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats := client.Stats(); stats.Dials != 2 || stats.Reuses != 1 {
+		t.Errorf("Wanted 2 dials and 1 reuse, got:%+v", stats)
+	}
+}
+
+// requestIDKey is the context key of the request id set by the caller
+type requestIDKey struct{}
+
+func TestClient_DoReconnectStaleConn(t *testing.T) {
+	closeConn := make(chan struct{})
+	received := make(chan string, 2)
+	var conns atomic.Int32
+
+	// the server keeps the first connection open after replying until it's told to close it, the others are closed right away
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		first := conns.Add(1) == 1
+
+		msg, _ := readTestICAPRequest(bufio.NewReader(conn))
+		received <- msg
+
+		_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+
+		if first {
+			<-closeConn
+		}
+	})
+
+	client, _ := NewClient(WithMaxIdleConns(1))
+
+	newRequest := func() Request {
+		httpResp := &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			ContentLength: 19,
+			Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+		}
+
+		req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return req
+	}
+
+	if _, err := client.Do(newRequest()); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	// the pooled connection is closed by the server between the requests
+	close(closeConn)
+
+	resp, err := client.Do(newRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if msg := <-received; !strings.Contains(msg, "This is a GOOD FILE") {
+		t.Errorf("Wanted the body to be sent again, got:%s", msg)
+	}
+
+	if stats := client.Stats(); stats.Dials != 2 || stats.Reuses != 1 {
+		t.Errorf("Wanted 2 dials and 1 reuse, got:%+v", stats)
+	}
+}
+
+func TestClient_DoReconnectReplaysBody(t *testing.T) {
+	// retried returns a client whose pooled connection the server closes before the request is made on it,
+	// along with the messages the server received on the new connections
+	retried := func(t *testing.T) (*Client, string, chan string) {
+		closeConn := make(chan struct{})
+		received := make(chan string, 2)
+		var conns atomic.Int32
+
+		addr := startRawTestServer(t, func(conn net.Conn) {
+			first := conns.Add(1) == 1
+
+			msg, _ := readTestICAPRequest(bufio.NewReader(conn))
+			if !first {
+				received <- msg
+			}
+
+			_, _ = conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+
+			if first {
+				<-closeConn
+			}
+		})
+
+		client, _ := NewClient(WithMaxIdleConns(1))
+
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		close(closeConn)
+
+		return &client, addr, received
+	}
+
+	t.Run("request body of GetBody", func(t *testing.T) {
+		client, addr, received := retried(t)
+
+		httpReq, _ := http.NewRequest(http.MethodPost, "http://someurl.com/upload", bytes.NewReader([]byte("This is a GOOD FILE")))
+
+		req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := <-received; !strings.Contains(msg, "This is a GOOD FILE") {
+			t.Errorf("Wanted the complete body to be sent again, got:%s", msg)
+		}
+
+		if stats := client.Stats(); stats.Dials != 2 || stats.Reuses != 1 {
+			t.Errorf("Wanted the request to be made again on a new connection, got:%+v", stats)
+		}
+
+		// the body of the caller is not consumed
+		if body, _ := io.ReadAll(httpReq.Body); string(body) != "This is a GOOD FILE" {
+			t.Errorf("Wanted the body of the http request to be kept, got:%s", string(body))
+		}
+	})
+
+	t.Run("seekable response body", func(t *testing.T) {
+		client, addr, received := retried(t)
+
+		file, err := os.CreateTemp(t.TempDir(), "body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		if _, err := file.WriteString("This is a GOOD FILE"); err != nil {
+			t.Fatal(err)
+		}
+
+		httpResp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			ContentLength: 19,
+			Body:          file,
+		}
+
+		req, err := NewRequest(context.Background(), MethodRESPMOD, fmt.Sprintf("icap://%s/respmod", addr), nil, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := <-received; !strings.Contains(msg, "This is a GOOD FILE") {
+			t.Errorf("Wanted the complete body to be sent again, got:%s", msg)
+		}
+
+		if stats := client.Stats(); stats.Dials != 2 || stats.Reuses != 1 {
+			t.Errorf("Wanted the request to be made again on a new connection, got:%+v", stats)
+		}
+
+		// the file is left open for the caller
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			t.Errorf("Wanted the body of the http response to be kept open, got:%v", err)
+		}
+	})
+}
+
+func TestClient_DoContextValues(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+	addr, _ := startReplyTestServer(t, reply)
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "42")
+
+	req, err := NewRequest(ctx, MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hook logs the request id of the caller
+	var logged any
+	client, _ := NewClient(WithHeaderFunc(func(req *Request) {
+		logged = req.Context().Value(requestIDKey{})
+	}))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if logged != "42" {
+		t.Errorf("Wanted the hook to read the context value:42, got:%v", logged)
+	}
+
+	if resp.Request == nil {
+		t.Fatal("Wanted the response to refer to the request")
+	}
+
+	if got := resp.Request.Context().Value(requestIDKey{}); got != "42" {
+		t.Errorf("Wanted the request of the response to carry the context value:42, got:%v", got)
+	}
+
+	if resp.Request.Method != MethodOPTIONS || resp.Request.URL.String() != req.URL.String() {
+		t.Errorf("Wanted the request of the response to be the sent one, got:%s %s", resp.Request.Method, resp.Request.URL)
+	}
+}
+
+func TestClient_DoCorrelationID(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+	addr, received := startReplyTestServer(t, reply)
+
+	client, _ := NewClient(WithCorrelationID("X-Correlation-ID", func(ctx context.Context) string {
+		id, _ := ctx.Value(requestIDKey{}).(string)
+		return id
+	}))
+
+	sampleTable := []struct {
+		name   string
+		ctx    context.Context
+		header string
+		wanted string
+	}{
+		{
+			name:   "id of the context",
+			ctx:    context.WithValue(context.Background(), requestIDKey{}, "42"),
+			wanted: "\r\nX-Correlation-Id: 42\r\n",
+		},
+		{
+			name:   "id of the context replaces the one of the request",
+			ctx:    context.WithValue(context.Background(), requestIDKey{}, "42"),
+			header: "7",
+			wanted: "\r\nX-Correlation-Id: 42\r\n",
+		},
+		{
+			name:   "id set by the request",
+			ctx:    context.Background(),
+			header: "7",
+			wanted: "\r\nX-Correlation-Id: 7\r\n",
+		},
+		{
+			name: "no id in the context",
+			ctx:  context.Background(),
+		},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			req, err := NewRequest(sample.ctx, MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sample.header != "" {
+				req.Header.Set("X-Correlation-ID", sample.header)
+			}
+
+			if _, err := client.Do(req); err != nil {
+				t.Fatal(err)
+			}
+
+			msg := <-received
+			if sample.wanted == "" && strings.Contains(msg, "X-Correlation-ID") {
+				t.Errorf("Wanted no correlation id, got:%s", msg)
+			}
+
+			if sample.wanted != "" && !strings.Contains(msg, sample.wanted) {
+				t.Errorf("Wanted the message to contain:%q, got:%s", sample.wanted, msg)
+			}
+		})
+	}
+
+	t.Run("request sent twice", func(t *testing.T) {
+		req, err := NewRequest(context.WithValue(context.Background(), requestIDKey{}, "first"), MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, id := range []string{"first", "second"} {
+			if err := req.SetContext(context.WithValue(context.Background(), requestIDKey{}, id)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := client.Do(req); err != nil {
+				t.Fatal(err)
+			}
+
+			if msg, wanted := <-received, "\r\nX-Correlation-Id: "+id+"\r\n"; !strings.Contains(msg, wanted) {
+				t.Errorf("Wanted the message to contain:%q, got:%s", wanted, msg)
+			}
+		}
+
+		if id := req.Header.Get("X-Correlation-ID"); id != "" {
+			t.Errorf("Wanted the header of the request to be left untouched, got:%s", id)
+		}
+	})
+}
+
+// recordingTracer records the start and the end of every span
+type recordingTracer struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingTracer) StartSpan(_ context.Context, name string) func(err error) {
+	r.record("start " + name)
+
+	return func(error) {
+		r.record("end " + name)
+	}
+}
+
+func (r *recordingTracer) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func TestClient_DoTracer(t *testing.T) {
+	addr, _ := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+	httpReq, _ := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("Hello World"))
+	req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer := &recordingTracer{}
+	client, _ := NewClient(WithTracer(tracer))
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	// the request is sent while the response is received, so the send and the receive spans overlap
+	wanted := []string{
+		"start " + SpanConnect,
+		"end " + SpanConnect,
+		"start " + SpanSend,
+		"start " + SpanReceive,
+	}
+
+	if len(tracer.events) != 6 || !reflect.DeepEqual(tracer.events[:4], wanted) {
+		t.Fatalf("Wanted the spans to start:%v, got:%v", wanted, tracer.events)
+	}
+
+	if ended := tracer.events[4:]; !slices.Contains(ended, "end "+SpanSend) || !slices.Contains(ended, "end "+SpanReceive) {
+		t.Errorf("Wanted the send and the receive spans to end, got:%v", ended)
+	}
+}
+
+func TestClient_DoMaxConcurrentRequests(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"
+
+	// the server holds the replies back until they're released
+	arrived := make(chan struct{}, 8)
+	release := make(chan struct{})
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		_, _ = readTestICAPRequest(bufio.NewReader(conn))
+		arrived <- struct{}{}
+		<-release
+		_, _ = conn.Write([]byte(reply))
+	})
+
+	newRequest := func(ctx context.Context) Request {
+		req, err := NewRequest(ctx, MethodOPTIONS, fmt.Sprintf("icap://%s/respmod", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return req
+	}
+
+	client, _ := NewClient(WithMaxConcurrentRequests(2))
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := client.Do(newRequest(context.Background()))
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		<-arrived
+	}
+
+	select {
+	case <-arrived:
+		t.Fatal("Wanted the third request to wait for a free slot")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// the waiting request gives up once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Do(newRequest(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wanted:%v, got:%v", context.DeadlineExceeded, err)
+	}
+
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClient_DoNoContentWithEncapsulatedRequest(t *testing.T) {
+	// the server bends the spec, the 204 carries the modified http request anyway
+	reply := "ICAP/1.0 204 No Content\r\n" +
+		"ISTag: ICAP-TEST\r\n" +
+		"Encapsulated: req-hdr=0, req-body=61\r\n\r\n" +
+		"POST /upload HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"X-Modified: yes\r\n\r\n" +
+		"b\r\nHello World\r\n0\r\n\r\n"
+	addr, _ := startReplyTestServer(t, reply)
+
+	httpReq, _ := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("Hello World"))
+	req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if resp.ContentRequest == nil {
+		t.Fatal("Wanted the encapsulated http request of the 204 to be parsed")
+	}
+
+	if got := resp.ContentRequest.Header.Get("X-Modified"); got != "yes" {
+		t.Errorf("Wanted the header of the encapsulated http request, got:%s", got)
+	}
+
+	if body, _ := io.ReadAll(resp.ContentRequest.Body); string(body) != "Hello World" {
+		t.Errorf("Wanted the body of the encapsulated http request, got:%s", string(body))
+	}
+
+	// the 204 semantics are kept, the content is not reported as modified
+	if modified, _ := resp.ContentModified([]byte("Hello World")); modified {
+		t.Error("Wanted the 204 to report the content as unmodified")
+	}
+}
+
+func TestClient_DoREQMODModifiedBody(t *testing.T) {
+	// the server rewrites the body of the POST request
+	httpReqStr := "POST /upload HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Content-Length: 26\r\n\r\n"
+	reply := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: ICAP-TEST\r\n" +
+		"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(len(httpReqStr)) + "\r\n\r\n" +
+		httpReqStr +
+		"10\r\nThis is the new \r\n" +
+		"a\r\nbody, bye!\r\n" +
+		"0\r\n\r\n"
+	addr, _ := startReplyTestServer(t, reply)
+
+	httpReq, _ := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("Hello World"))
+	req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ContentRequest == nil {
+		t.Fatal("Wanted the modified http request to be parsed")
+	}
+
+	if resp.ContentRequest.Method != http.MethodPost || resp.ContentRequest.ContentLength != 26 {
+		t.Errorf("Wanted the modified POST request of 26 bytes, got:%s of %d bytes", resp.ContentRequest.Method, resp.ContentRequest.ContentLength)
+	}
+
+	// the body is dechunked
+	if modified, _ := resp.ContentModified([]byte("Hello World")); !modified {
+		t.Error("Wanted the content to be reported as modified")
+	}
+
+	if body, _ := io.ReadAll(resp.ContentRequest.Body); string(body) != "This is the new body, bye!" {
+		t.Errorf("Wanted the modified body, got:%q", string(body))
+	}
+
+	// the body can be read again, for example, to forward the request
+	getBody, err := resp.ContentRequest.GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body, _ := io.ReadAll(getBody); string(body) != "This is the new body, bye!" {
+		t.Errorf("Wanted the modified body again, got:%q", string(body))
+	}
+}
+
+func TestClient_DoRewriteEncapsulatedRequest(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+	httpReq, _ := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("Hello World"))
+	req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient(WithRewriteEncapsulatedRequest(func(dumped []byte) []byte {
+		return bytes.Replace(dumped, []byte("Accept-Encoding: gzip\r\n"), nil, 1)
+	}))
+
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-received
+	if strings.Contains(msg, "Accept-Encoding") {
+		t.Errorf("Wanted the Accept-Encoding header to be stripped, got:%s", msg)
+	}
+
+	// the offsets are computed from the rewritten request
+	_, encapsulated, _ := strings.Cut(msg, doubleCRLF)
+	wanted := fmt.Sprintf("req-body=%d", strings.Index(encapsulated, doubleCRLF)+len(doubleCRLF))
+	if !strings.Contains(msg, wanted) {
+		t.Errorf("Wanted the Encapsulated header to declare %s, got:%s", wanted, msg)
+	}
+}
+
+func TestClient_DoDisableAutoAcceptEncoding(t *testing.T) {
+	sampleTable := []struct {
+		name    string
+		options []ConfigOption
+		wanted  bool
+	}{
+		{name: "enabled", wanted: true},
+		{name: "disabled", options: []ConfigOption{WithDisableAutoAcceptEncoding()}, wanted: false},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			addr, received := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+			httpReq, _ := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("Hello World"))
+			req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, _ := NewClient(sample.options...)
+			if _, err := client.Do(req); err != nil {
+				t.Fatal(err)
+			}
+
+			msg := <-received
+			if got := strings.Contains(msg, "\r\nAccept-Encoding: gzip\r\n"); got != sample.wanted {
+				t.Errorf("Wanted the Accept-Encoding header on the wire:%v, got:%s", sample.wanted, msg)
+			}
+
+			if !strings.Contains(msg, "\r\n\r\nb\r\nHello World\r\n0\r\n\r\n") {
+				t.Errorf("Wanted the body of the encapsulated request, got:%s", msg)
+			}
+		})
+	}
+
+	t.Run("header of the request", func(t *testing.T) {
+		addr, received := startReplyTestServer(t, "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")
+
+		httpReq, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		httpReq.Header.Set("Accept-Encoding", "gzip")
+		req, err := NewRequest(context.Background(), MethodREQMOD, fmt.Sprintf("icap://%s/reqmod", addr), httpReq, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, _ := NewClient(WithDisableAutoAcceptEncoding())
+		if _, err := client.Do(req); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg := <-received; !strings.Contains(msg, "\r\nAccept-Encoding: gzip\r\n") {
+			t.Errorf("Wanted the Accept-Encoding header of the request to be kept, got:%s", msg)
+		}
+	})
+}
+
+func TestClient_DoMaxHeaderLine(t *testing.T) {
+	reply := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: ICAP-TEST\r\n" +
+		"X-Oversized: " + strings.Repeat("a", 4096) + "\r\n" +
+		"Encapsulated: null-body=0\r\n\r\n"
+	addr, _ := startReplyTestServer(t, reply)
+
+	req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/options", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := NewClient(WithMaxHeaderLine(1024))
+	if _, err := client.Do(req); !errors.Is(err, ErrHeaderTooLarge) {
+		t.Errorf("Wanted error:%v, got:%v", ErrHeaderTooLarge, err)
+	}
+
+	// a server sending an endless header line is cut off while it's read, not once the entire response is buffered
+	addr = startRawTestServer(t, func(conn net.Conn) {
+		if _, err := readTestICAPRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+
+		_, _ = io.Copy(conn, io.MultiReader(strings.NewReader("ICAP/1.0 200 OK\r\nX-Oversized: "), &patternReadSeeker{size: 20 << 20}))
+	})
+
+	req, err = NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icap://%s/options", addr), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received atomic.Int64
+	client, _ = NewClient(WithMaxHeaderLine(100), WithProgress(func(_, n int64) {
+		received.Store(n)
+	}))
+
+	if _, err := client.Do(req); !errors.Is(err, ErrHeaderTooLarge) {
+		t.Errorf("Wanted error:%v, got:%v", ErrHeaderTooLarge, err)
+	}
+
+	if n := received.Load(); n > 64<<10 {
+		t.Errorf("Wanted at most %d bytes to be received, got:%d", 64<<10, n)
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for the given host name along with a pool which trusts it
+func newTestCertificate(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestClient_DoTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t, "icap.example.com")
+
+	// the server is dialed by its ip, but the certificate is issued for the host name
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if _, err := readTestICAPRequest(bufio.NewReader(tlsConn)); err != nil {
+			return
+		}
+
+		_, _ = tlsConn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	verifyErr := errors.New("peer rejected")
+
+	sampleTable := []struct {
+		name            string
+		tlsConfig       *tls.Config
+		wantErr         error
+		wantHostnameErr bool
+	}{
+		{
+			name:      "verified through sni",
+			tlsConfig: &tls.Config{RootCAs: pool, ServerName: "icap.example.com"},
+		},
+		{
+			name:            "server name defaults to the url host",
+			tlsConfig:       &tls.Config{RootCAs: pool},
+			wantHostnameErr: true,
+		},
+		{
+			name: "custom peer verification",
+			tlsConfig: &tls.Config{RootCAs: pool, ServerName: "icap.example.com", VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+				return verifyErr
+			}},
+			wantErr: verifyErr,
+		},
+	}
+
+	for _, sample := range sampleTable {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icaps://%s/options", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, _ := NewClient(WithTLSConfig(sample.tlsConfig))
+		resp, err := client.Do(req)
+
+		var hostnameErr x509.HostnameError
+		switch {
+		case sample.wantHostnameErr:
+			if !errors.As(err, &hostnameErr) {
+				t.Errorf("%s: Wanted a host name verification error, got:%v", sample.name, err)
+			}
+		case sample.wantErr != nil:
+			if !errors.Is(err, sample.wantErr) {
+				t.Errorf("%s: Wanted error:%v, got:%v", sample.name, sample.wantErr, err)
+			}
+		case err != nil:
+			t.Errorf("%s: Wanted no error, got:%v", sample.name, err)
+		case resp.StatusCode != http.StatusNoContent:
+			t.Errorf("%s: Wanted status code:%d, got:%d", sample.name, http.StatusNoContent, resp.StatusCode)
+		}
+	}
+}
+
+func TestClient_DoClientCert(t *testing.T) {
+	serverCert, serverPool := newTestCertificate(t, "icap.example.com")
+	clientCert, clientPool := newTestCertificate(t, "client.example.com")
+
+	// the server requires a client certificate issued by the authority it trusts
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		tlsConn := tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientPool,
+		})
+		if _, err := readTestICAPRequest(bufio.NewReader(tlsConn)); err != nil {
+			return
+		}
+
+		_, _ = tlsConn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"))
+	})
+
+	tlsConfig := &tls.Config{RootCAs: serverPool, ServerName: "icap.example.com"}
+
+	sampleTable := []struct {
+		name    string
+		options []ConfigOption
+		wantErr bool
+	}{
+		{
+			name:    "client certificate",
+			options: []ConfigOption{WithTLSConfig(tlsConfig), WithClientCert(clientCert)},
+		},
+		{
+			name:    "no client certificate",
+			options: []ConfigOption{WithTLSConfig(tlsConfig)},
+			wantErr: true,
+		},
+	}
+
+	for _, sample := range sampleTable {
+		req, err := NewRequest(context.Background(), MethodOPTIONS, fmt.Sprintf("icaps://%s/options", addr), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, _ := NewClient(sample.options...)
+		resp, err := client.Do(req)
+
+		switch {
+		case sample.wantErr && err == nil:
+			t.Errorf("%s: Wanted the server to reject the connection", sample.name)
+		case !sample.wantErr && err != nil:
+			t.Errorf("%s: Wanted no error, got:%v", sample.name, err)
+		case !sample.wantErr && resp.StatusCode != http.StatusNoContent:
+			t.Errorf("%s: Wanted status code:%d, got:%d", sample.name, http.StatusNoContent, resp.StatusCode)
+		}
+	}
+
+	if len(tlsConfig.Certificates) != 0 {
+		t.Error("Wanted the shared TLS configuration to be left as is")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+
+	// the services answer the OPTIONS with their preview size and the modification requests with 204
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := readTestICAPRequest(r)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			received = append(received, msg)
+			mu.Unlock()
+
+			reply := "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"
+			if strings.HasPrefix(msg, "OPTIONS ") {
+				reply = "ICAP/1.0 200 OK\r\nMethods: REQMOD, RESPMOD\r\nISTag: ICAP-TEST\r\nAllow: 204\r\n" +
+					"Preview: 4\r\nOptions-TTL: 60\r\nEncapsulated: null-body=0\r\n\r\n"
+			}
+
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	})
+
+	// requests returns the request lines the server received so far
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		lines := make([]string, 0, len(received))
+		for _, msg := range received {
+			line, _, _ := strings.Cut(msg, crlf)
+			lines = append(lines, line)
+		}
+
+		return lines
+	}
+
+	clock := &fakeClock{now: time.Date(2000, time.January, 10, 9, 55, 21, 0, time.UTC)}
+	client, _ := NewClient(func(cfg *Config) {
+		cfg.clock = clock
+	})
+
+	reqmodURL := fmt.Sprintf("icap://%s/reqmod", addr)
+	respmodURL := fmt.Sprintf("icap://%s/respmod", addr)
+	pipeline := NewPipeline(client, reqmodURL, respmodURL)
+
+	scan := func() {
+		httpReq, err := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("Hello World"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := pipeline.ScanRequest(context.Background(), httpReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Wanted status code:%d for the request, got:%d", http.StatusNoContent, resp.StatusCode)
+		}
+
+		httpResp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("Hello World")),
+		}
+
+		resp, err = pipeline.ScanResponse(context.Background(), httpReq, httpResp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Wanted status code:%d for the response, got:%d", http.StatusNoContent, resp.StatusCode)
+		}
+	}
+
+	scan()
+	scan()
+
+	want := []string{
+		"OPTIONS " + reqmodURL + " ICAP/1.0",
+		"REQMOD " + reqmodURL + " ICAP/1.0",
+		"OPTIONS " + respmodURL + " ICAP/1.0",
+		"RESPMOD " + respmodURL + " ICAP/1.0",
+		"REQMOD " + reqmodURL + " ICAP/1.0",
+		"RESPMOD " + respmodURL + " ICAP/1.0",
+	}
+	if got := requests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wanted the OPTIONS to be requested once per service:\n%v\ngot:\n%v", want, got)
+	}
+
+	// the scans are previewed as advertised by the OPTIONS
+	mu.Lock()
+	for _, msg := range received {
+		if !strings.HasPrefix(msg, "OPTIONS ") && !strings.Contains(msg, "Preview: 4\r\n") {
+			t.Errorf("Wanted the advertised preview, got:%s", msg)
+		}
+	}
+	mu.Unlock()
+
+	// the OPTIONS are requested again once their TTL expired
+	clock.Advance(time.Minute)
+	scan()
+
+	if got := requests(); len(got) != 10 || got[6] != "OPTIONS "+reqmodURL+" ICAP/1.0" || got[8] != "OPTIONS "+respmodURL+" ICAP/1.0" {
+		t.Errorf("Wanted the expired OPTIONS to be requested again, got:\n%v", got)
+	}
+}
+
+func TestPipelineOptionsExpiry(t *testing.T) {
+	sampleTable := []struct {
+		name      string
+		ttlHeader string
+		ttl       time.Duration
+	}{
+		{name: "Options-TTL of the service", ttlHeader: "Options-TTL: 30\r\n", ttl: 30 * time.Second},
+		{name: "DefaultOptionsTTL", ttl: DefaultOptionsTTL},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			var options atomic.Int32
+
+			addr := startRawTestServer(t, func(conn net.Conn) {
+				r := bufio.NewReader(conn)
+				for {
+					msg, err := readTestICAPRequest(r)
+					if err != nil {
+						return
+					}
+
+					reply := "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"
+					if strings.HasPrefix(msg, "OPTIONS ") {
+						options.Add(1)
+						reply = "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\n" + sample.ttlHeader +
+							"Encapsulated: null-body=0\r\n\r\n"
+					}
+
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			})
+
+			clock := &fakeClock{now: time.Date(2000, time.January, 10, 9, 55, 21, 0, time.UTC)}
+			client, _ := NewClient(func(cfg *Config) {
+				cfg.clock = clock
+			})
+
+			service := fmt.Sprintf("icap://%s/respmod", addr)
+			pipeline := NewPipeline(client, service, service)
+
+			scan := func() {
+				httpReq, err := http.NewRequest(http.MethodGet, "http://example.com/file.txt", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				httpResp := &http.Response{
+					StatusCode: http.StatusOK,
+					Proto:      "HTTP/1.1",
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Header:     http.Header{"Content-Type": []string{"text/plain"}},
+					Body:       io.NopCloser(strings.NewReader("Hello World")),
+				}
+
+				if _, err := pipeline.ScanResponse(context.Background(), httpReq, httpResp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			scan()
+
+			// the cached OPTIONS are used right up to the expiry
+			clock.Advance(sample.ttl - time.Second)
+			scan()
+
+			if got := options.Load(); got != 1 {
+				t.Errorf("Wanted the OPTIONS to be cached until they expire, got %d OPTIONS requests", got)
+			}
+
+			// once expired, the OPTIONS are requested again and cached anew
+			clock.Advance(time.Second)
+			scan()
+			scan()
+
+			if got := options.Load(); got != 2 {
+				t.Errorf("Wanted the expired OPTIONS to be requested once again, got %d OPTIONS requests", got)
+			}
+		})
+	}
+}
+
+func TestPipelineMethodNotSupported(t *testing.T) {
+	addr, received := startReplyTestServer(t, "ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nAllow: 204\r\n"+
+		"Encapsulated: null-body=0\r\n\r\n")
+
+	client, _ := NewClient()
+	service := fmt.Sprintf("icap://%s/respmod", addr)
+	pipeline := NewPipeline(client, service, service)
+
+	httpReq, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pipeline.ScanRequest(context.Background(), httpReq); !errors.Is(err, ErrMethodNotSupportedByService) {
+		t.Errorf("Wanted error:%v, got:%v", ErrMethodNotSupportedByService, err)
+	}
+
+	// only the OPTIONS reached the service
+	if msg := <-received; !strings.HasPrefix(msg, "OPTIONS ") {
+		t.Errorf("Wanted the OPTIONS request, got:%s", msg)
+	}
+
+	select {
+	case msg := <-received:
+		t.Errorf("Wanted no REQMOD to be sent, got:%s", msg)
+	default:
+	}
+}
+
+func TestSharedOptionsPipeline(t *testing.T) {
+	sampleTable := []struct {
+		name          string
+		reqmodMethods string
+		wantOptions   bool
+	}{
+		{name: "the OPTIONS advertise both methods", reqmodMethods: "REQMOD, RESPMOD", wantOptions: false},
+		{name: "the OPTIONS advertise REQMOD only", reqmodMethods: "REQMOD", wantOptions: true},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			received := make(chan string, 8)
+
+			// each path answers the OPTIONS with its own methods and the modification requests with 204
+			addr := startRawTestServer(t, func(conn net.Conn) {
+				r := bufio.NewReader(conn)
+				for {
+					msg, err := readTestICAPRequest(r)
+					if err != nil {
+						return
+					}
+					received <- msg
+
+					reply := "ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n"
+					if strings.HasPrefix(msg, "OPTIONS ") {
+						methods := "RESPMOD"
+						if line, _, _ := strings.Cut(msg, crlf); strings.Contains(line, "/reqmod ") {
+							methods = sample.reqmodMethods
+						}
+
+						reply = "ICAP/1.0 200 OK\r\nMethods: " + methods + "\r\nISTag: ICAP-TEST\r\nAllow: 204\r\n" +
+							"Preview: 4\r\nEncapsulated: null-body=0\r\n\r\n"
+					}
+
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			})
+
+			client, _ := NewClient()
+			reqmodURL := fmt.Sprintf("icap://%s/reqmod", addr)
+			respmodURL := fmt.Sprintf("icap://%s/respmod", addr)
+			pipeline := NewSharedOptionsPipeline(client, reqmodURL, respmodURL)
+
+			httpReq, err := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("Hello World"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := pipeline.ScanRequest(context.Background(), httpReq); err != nil {
+				t.Fatal(err)
+			}
+
+			httpResp := &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"Content-Type": []string{"text/plain"}},
+				Body:       io.NopCloser(strings.NewReader("Hello World")),
+			}
+
+			if _, err := pipeline.ScanResponse(context.Background(), httpReq, httpResp); err != nil {
+				t.Fatal(err)
+			}
+
+			want := []string{"OPTIONS " + reqmodURL, "REQMOD " + reqmodURL}
+			if sample.wantOptions {
+				want = append(want, "OPTIONS "+respmodURL)
+			}
+			want = append(want, "RESPMOD "+respmodURL)
+
+			for _, wantedLine := range want {
+				msg := <-received
+				if line, _, _ := strings.Cut(msg, crlf); line != wantedLine+" ICAP/1.0" {
+					t.Errorf("Wanted request:%s, got:%s", wantedLine, line)
+				}
+
+				// both scans are previewed as advertised by the OPTIONS they were configured with
+				if !strings.HasPrefix(msg, "OPTIONS ") && !strings.Contains(msg, "Preview: 4\r\n") {
+					t.Errorf("Wanted the advertised preview, got:%s", msg)
+				}
+			}
+
+			select {
+			case msg := <-received:
+				t.Errorf("Wanted no further request, got:%s", msg)
+			default:
+			}
+		})
+	}
+}
+
+func TestBatchScanner(t *testing.T) {
+	var connections atomic.Int32
+	received := make(chan string, 8)
+
+	// the server answers the scans one after another on the same connection
+	addr := startRawTestServer(t, func(conn net.Conn) {
+		connections.Add(1)
+
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := readTestICAPRequest(r)
+			if err != nil {
+				return
+			}
+			received <- msg
+
+			if _, err := conn.Write([]byte("ICAP/1.0 204 No Content\r\nISTag: ICAP-TEST\r\n\r\n")); err != nil {
+				return
+			}
+		}
+	})
+
+	client, _ := NewClient()
+	scanner := NewBatchScanner(client, fmt.Sprintf("icap://%s/respmod", addr))
+	defer scanner.Close()
+
+	payloads := []string{"Hello World", "This is a GOOD FILE", strings.Repeat("a", 5000)}
+	for _, payload := range payloads {
+		resp, err := scanner.Scan(context.Background(), strings.NewReader(payload), "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Wanted status code:%d, got:%d", http.StatusNoContent, resp.StatusCode)
+		}
+
+		msg := <-received
+		if !strings.HasPrefix(msg, "RESPMOD ") || !strings.Contains(msg, "Content-Type: text/plain\r\n") {
+			t.Errorf("Wanted a RESPMOD request of the content type, got:%s", msg)
+		}
+
+		if want := fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(payload), payload); !strings.HasSuffix(msg, want) {
+			t.Errorf("Wanted the payload to be framed as a single chunk:%q, got:%q", want, msg)
+		}
+	}
+
+	if n := connections.Load(); n != 1 {
+		t.Errorf("Wanted a single connection, got:%d", n)
+	}
+
+	if stats := client.Stats(); stats.Dials != 1 {
+		t.Errorf("Wanted a single dial, got:%d", stats.Dials)
+	}
+}
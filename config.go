@@ -1,20 +1,128 @@
 package icapclient
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
 	"time"
 )
 
 // Config is the shared configuration for the icap client library
 type Config struct {
 	ICAPConn ICAPConnConfig
+	// FollowNextServices forwards the content to the services listed by the X-Next-Services header of the response
+	FollowNextServices bool
+	// ReturnErrorOnICAPFailure makes the client return an error for ICAP responses with a failure status code
+	ReturnErrorOnICAPFailure bool
+	// MaxPreviewBytes caps the preview size of the requests, no cap applies if not set
+	MaxPreviewBytes int
+	// PathRewrite remaps the path of the service url in the ICAP request line
+	PathRewrite func(path string) string
+	// NextServicesHosts are the hosts besides the one of the request the client is allowed to forward the content to
+	NextServicesHosts []string
+	// Authenticator applies the credentials to the requests, no credentials are sent if not set
+	Authenticator Authenticator
+	// ModifyHeader adjusts the ICAP headers of the requests right before they're sent
+	ModifyHeader func(req *Request)
+	// MaxConcurrentRequests limits the requests the client makes at the same time, no limit applies if not set
+	MaxConcurrentRequests int
+	// RewriteEncapsulatedRequest rewrites the dumped http request before it's framed, it's used as is if not set
+	RewriteEncapsulatedRequest func(dumped []byte) []byte
+	// DisableAutoAcceptEncoding strips the Accept-Encoding header the http stack adds to the encapsulated requests
+	DisableAutoAcceptEncoding bool
+	// MaxHeaderBytes caps the bytes of all header lines of a response, including the encapsulated http headers and the trailers
+	MaxHeaderBytes int
+	// MaxHeaderLine caps the bytes of a single line of a response header, no cap applies if not set
+	MaxHeaderLine int
+	// MaxIdleConns is the amount of idle connections kept for reuse per host, no connection is reused if not set
+	MaxIdleConns int
+	// IdleConnTimeout is the maximum amount of time an idle connection is kept, there's no limit if not set
+	IdleConnTimeout time.Duration
+	// DefaultAllow are the codes the Allow header of the requests lists if they don't set one, no Allow header is sent if empty
+	DefaultAllow []int
+	// ForceCompleteTypes are the content types whose bodies are always sent complete, without the preview set for them,
+	// a type which ends with a slash matches all of its subtypes, for example, video/
+	ForceCompleteTypes []string
+	// AddressResolver translates the logical host of the service url into the address the client dials, for example,
+	// by service discovery. The host is dialed as is if not set
+	AddressResolver func(ctx context.Context, host string) (string, error)
+	// ClientCert is the certificate the client authenticates itself with to icaps:// servers which require mutual TLS,
+	// it's added to the certificates of the TLS configuration, none is sent if not set
+	ClientCert tls.Certificate
+	// Allow204MaxBodyBytes is the size of the body beyond which a request without preview doesn't allow a 204,
+	// as the server can't buffer it, 204 is allowed regardless of the size if not set
+	Allow204MaxBodyBytes int64
+	// Warn is called with the deviations from the protocol the client tolerates, they're not reported if not set
+	Warn func(err error)
+	// EncapsulatedBodyFraming determines how the bodies of the encapsulated http messages are delimited, they're chunked by default
+	EncapsulatedBodyFraming BodyFraming
+	// OnContinue is called with the 100 Continue response to a preview before the rest of the body is sent,
+	// an error aborts the request and is returned by the client
+	OnContinue func(res *Response) error
+	// CorrelationIDHeader is the ICAP header the correlation id of a request is sent in, along with CorrelationIDFromContext
+	CorrelationIDHeader string
+	// CorrelationIDFromContext returns the correlation id of a request from its context, for example, as set by a proxy chain,
+	// no header is sent if it returns an empty id
+	CorrelationIDFromContext func(ctx context.Context) string
+	// ServicePreviews are the preview sizes per service url and content type prefix, as ContentTypePreviews lists them,
+	// the requests to a listed service which neither set nor advertise a preview are previewed by the size of their content type
+	ServicePreviews map[string]map[string]int
+	// BodyTerminator are the extra bytes sent after the last chunk of a complete body, for servers which expect a specific marker,
+	// the body ends with the last chunk as RFC 3507 defines it if not set
+	BodyTerminator []byte
+	// KeepaliveInterval is the interval the idle connections of the pool are pinged with OPTIONS requests at,
+	// so the servers don't close them for idling, they're not pinged if not set
+	KeepaliveInterval time.Duration
+	// StrictMode rejects the requests which don't comply with RFC 3507 before they're sent, for conformance testing,
+	// the client sends them as they're built if not set
+	StrictMode bool
+	// HalfCloseAfterPreview shuts down the writing side of the connection after a preview which holds the entire body,
+	// for servers which only process the input once it ends. The connections are not kept for reuse then
+	HalfCloseAfterPreview bool
+	// clock tells the time to the time-based behavior of the client, for example, the idle timeout, the real time is used if not set
+	clock clock
 }
 
+// clock tells the time, it's replaced by a fake one in the tests, so the time-based behavior can be tested deterministically
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock of the real time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// BodyFraming is the way the body of an encapsulated http message is delimited
+type BodyFraming int
+
+const (
+	// BodyFramingChunked sends the bodies chunk-framed as RFC 3507 requires
+	BodyFramingChunked BodyFraming = iota
+	// BodyFramingContentLength sends the bodies as they are, delimited by the Content-Length header of the http message,
+	// for legacy servers which don't expect chunked bodies. The requests are sent without a preview then, as it relies on chunking
+	BodyFramingContentLength
+)
+
 // DefaultConfig returns the default configuration for the icap client library
 func DefaultConfig() Config {
 	return Config{
 		ICAPConn: ICAPConnConfig{
 			Timeout: 15 * time.Second,
 		},
+		MaxHeaderBytes: http.DefaultMaxHeaderBytes,
+		DefaultAllow:   []int{http.StatusNoContent},
 	}
 }
 
@@ -31,3 +139,340 @@ func WithICAPConnectionTimeout(timeout time.Duration) ConfigOption {
 		cfg.ICAPConn.Timeout = timeout
 	}
 }
+
+// WithFollowNextServices makes the client forward the content to the services
+// the server lists in the X-Next-Services header of the response.
+// Only services on the host of the request or on one of the given hosts are followed
+func WithFollowNextServices(hosts ...string) ConfigOption {
+	return func(cfg *Config) {
+		cfg.FollowNextServices = true
+		cfg.NextServicesHosts = append(cfg.NextServicesHosts, hosts...)
+	}
+}
+
+// WithPathRewrite sets the function which remaps the service path in the ICAP request line,
+// for example, when the path seen by the client differs from the one of the server behind a reverse proxy.
+// A raw url set by Request.SetRawURL is sent verbatim and not rewritten
+func WithPathRewrite(rewrite func(path string) string) ConfigOption {
+	return func(cfg *Config) {
+		cfg.PathRewrite = rewrite
+	}
+}
+
+// WithReturnErrorOnICAPFailure makes the client return an error for ICAP responses
+// with a failure status code, i.e., 400 and above
+func WithReturnErrorOnICAPFailure() ConfigOption {
+	return func(cfg *Config) {
+		cfg.ReturnErrorOnICAPFailure = true
+	}
+}
+
+// WithProgress sets the function which is called with the bytes sent to and received from the icap server as they move,
+// it blocks the transfer, so no slow work must be done in it
+func WithProgress(onProgress func(sent, received int64)) ConfigOption {
+	return func(cfg *Config) {
+		cfg.ICAPConn.OnProgress = onProgress
+	}
+}
+
+// WithMaxPreviewBytes caps the preview size of the requests, regardless of the preview the server advertised
+func WithMaxPreviewBytes(maxBytes int) ConfigOption {
+	return func(cfg *Config) {
+		if maxBytes <= 0 {
+			return
+		}
+
+		cfg.MaxPreviewBytes = maxBytes
+	}
+}
+
+// WithAuthenticator sets the authenticator which applies the credentials to the requests, for example, an Authorization header
+func WithAuthenticator(authenticator Authenticator) ConfigOption {
+	return func(cfg *Config) {
+		cfg.Authenticator = authenticator
+	}
+}
+
+// WithHeaderFunc sets the function which adjusts the final ICAP headers of every request right before it's sent,
+// for example, to add a correlation id
+func WithHeaderFunc(modify func(req *Request)) ConfigOption {
+	return func(cfg *Config) {
+		cfg.ModifyHeader = modify
+	}
+}
+
+// WithCorrelationID sends the correlation id the function returns from the context of every request in the given ICAP header,
+// for tracing a request across a proxy chain. A header the request sets itself is only kept if the context holds no id
+func WithCorrelationID(header string, fromContext func(ctx context.Context) string) ConfigOption {
+	return func(cfg *Config) {
+		if !isHeaderName(header) || fromContext == nil {
+			return
+		}
+
+		cfg.CorrelationIDHeader = header
+		cfg.CorrelationIDFromContext = fromContext
+	}
+}
+
+// WithMaxConcurrentRequests limits the requests the client makes at the same time across all hosts,
+// further requests wait for a free slot until their context is done
+func WithMaxConcurrentRequests(n int) ConfigOption {
+	return func(cfg *Config) {
+		if n <= 0 {
+			return
+		}
+
+		cfg.MaxConcurrentRequests = n
+	}
+}
+
+// WithRewriteEncapsulatedRequest sets the function which rewrites the dumped http request of the requests before it's framed,
+// for example, to strip a header added by the http stack. The offsets of the Encapsulated header are computed from the rewritten one
+func WithRewriteEncapsulatedRequest(rewrite func(dumped []byte) []byte) ConfigOption {
+	return func(cfg *Config) {
+		cfg.RewriteEncapsulatedRequest = rewrite
+	}
+}
+
+// WithDisableAutoAcceptEncoding strips the Accept-Encoding: gzip header the http stack adds to the encapsulated requests,
+// so they're forwarded faithfully. An Accept-Encoding header of the request itself is kept
+func WithDisableAutoAcceptEncoding() ConfigOption {
+	return func(cfg *Config) {
+		cfg.DisableAutoAcceptEncoding = true
+	}
+}
+
+// WithMaxHeaderBytes caps the bytes of all header lines of a response, the ICAP headers, the encapsulated http headers
+// and the trailers, a response exceeding it fails with ErrHeaderTooLarge. It defaults to http.DefaultMaxHeaderBytes
+func WithMaxHeaderBytes(maxBytes int) ConfigOption {
+	return func(cfg *Config) {
+		if maxBytes <= 0 {
+			return
+		}
+
+		cfg.MaxHeaderBytes = maxBytes
+	}
+}
+
+// WithMaxHeaderLine caps the bytes of a single header line of a response, a response exceeding it fails with ErrHeaderTooLarge
+func WithMaxHeaderLine(maxBytes int) ConfigOption {
+	return func(cfg *Config) {
+		if maxBytes <= 0 {
+			return
+		}
+
+		cfg.MaxHeaderLine = maxBytes
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the connections to icaps:// urls, for example, the root certificates
+// or a custom VerifyPeerCertificate. The ServerName defaults to the host of the url if not set
+func WithTLSConfig(cfg *tls.Config) ConfigOption {
+	return func(c *Config) {
+		c.ICAPConn.TLSConfig = cfg
+	}
+}
+
+// WithForceCompleteTypes sends the bodies of the given content types complete, for example, application/x-msdownload,
+// regardless of the preview set for the request or advertised by the server
+func WithForceCompleteTypes(types ...string) ConfigOption {
+	return func(cfg *Config) {
+		cfg.ForceCompleteTypes = append(cfg.ForceCompleteTypes, types...)
+	}
+}
+
+// WithServicePreviews sets the preview sizes of the service by content type prefix, the longest prefix wins as it does
+// for ContentTypePreviews, for example, text/ and application/zip. The requests to the service which neither set
+// nor advertise a preview themselves are previewed by the size of their content type, the service is identified by its url without the query
+func WithServicePreviews(serviceURL string, previews map[string]int) ConfigOption {
+	return func(cfg *Config) {
+		u, err := url.Parse(serviceURL)
+		if err != nil || len(previews) == 0 {
+			return
+		}
+
+		if cfg.ServicePreviews == nil {
+			cfg.ServicePreviews = make(map[string]map[string]int)
+		}
+
+		cfg.ServicePreviews[serviceKey(u)] = maps.Clone(previews)
+	}
+}
+
+// serviceKey identifies the service of the url by its scheme, host and path
+func serviceKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// WithBodyTerminator sends the extra bytes after the last chunk of every complete body, for example, an extra CRLF,
+// for interoperability with servers which expect a specific terminator. A preview which doesn't hold the whole body is not followed by it
+func WithBodyTerminator(terminator []byte) ConfigOption {
+	return func(cfg *Config) {
+		cfg.BodyTerminator = bytes.Clone(terminator)
+	}
+}
+
+// WithKeepaliveInterval pings the idle connections of the pool with an OPTIONS request for the service they were last used for,
+// once they idled for the interval, so the servers don't close them for idling. A connection is never pinged while it's in use,
+// one the ping fails on is closed. It applies only if the idle connections are kept, see WithMaxIdleConns
+func WithKeepaliveInterval(interval time.Duration) ConfigOption {
+	return func(cfg *Config) {
+		if interval <= 0 {
+			return
+		}
+
+		cfg.KeepaliveInterval = interval
+	}
+}
+
+// WithStrictMode makes the client reject the requests which don't comply with RFC 3507 before they're sent,
+// for example, without a Host header or with a malformed Preview header. The headers are checked after ModifyHeader adjusted them
+func WithStrictMode() ConfigOption {
+	return func(cfg *Config) {
+		cfg.StrictMode = true
+	}
+}
+
+// WithHalfCloseAfterPreview shuts down the writing side of the connection once a preview which holds the entire body is sent,
+// for servers which only begin processing when the input ends. Nothing can be sent on such a connection anymore, so:
+// it applies to the requests made by Do only, not to DoSequence and BatchScanner, the connections are closed instead of pooled,
+// which defeats MaxIdleConns for the previewed requests, and a preview which doesn't hold the entire body is sent as usual,
+// as the rest of the body must follow it
+func WithHalfCloseAfterPreview() ConfigOption {
+	return func(cfg *Config) {
+		cfg.HalfCloseAfterPreview = true
+	}
+}
+
+// WithAddressResolver sets the function which translates the logical host of the service url into the address to dial,
+// for example, my-icap-service into 10.0.0.7:1344. The TLS server name remains the logical host
+func WithAddressResolver(resolver func(ctx context.Context, host string) (string, error)) ConfigOption {
+	return func(cfg *Config) {
+		cfg.AddressResolver = resolver
+	}
+}
+
+// WithClientCert sets the certificate the client authenticates itself with to icaps:// servers which require mutual TLS
+func WithClientCert(cert tls.Certificate) ConfigOption {
+	return func(cfg *Config) {
+		cfg.ClientCert = cert
+	}
+}
+
+// WithResolver sets the resolver of the host names of the icap servers, for example, for split-horizon DNS
+func WithResolver(resolver *net.Resolver) ConfigOption {
+	return func(cfg *Config) {
+		cfg.ICAPConn.Resolver = resolver
+	}
+}
+
+// WithTracer sets the tracer which starts the spans around connecting to the icap server, sending the requests and receiving the responses
+func WithTracer(tracer Tracer) ConfigOption {
+	return func(cfg *Config) {
+		cfg.ICAPConn.Tracer = tracer
+	}
+}
+
+// WithMaxIdleConns makes the client keep up to the given amount of idle connections per host for reuse,
+// instead of connecting anew for every request. A connection is not kept if the server asks to close it
+func WithMaxIdleConns(n int) ConfigOption {
+	return func(cfg *Config) {
+		if n <= 0 {
+			return
+		}
+
+		cfg.MaxIdleConns = n
+	}
+}
+
+// WithIdleConnTimeout sets the maximum amount of time an idle connection is kept for reuse
+func WithIdleConnTimeout(timeout time.Duration) ConfigOption {
+	return func(cfg *Config) {
+		if timeout <= 0 {
+			return
+		}
+
+		cfg.IdleConnTimeout = timeout
+	}
+}
+
+// WithEncapsulatedBodyFraming sets how the bodies of the encapsulated http messages are delimited,
+// bodies the origin already chunked and the raw bodies are sent chunked regardless
+func WithEncapsulatedBodyFraming(framing BodyFraming) ConfigOption {
+	return func(cfg *Config) {
+		cfg.EncapsulatedBodyFraming = framing
+	}
+}
+
+// WithDefaultAllow sets the codes the Allow header of the requests lists if they don't set one, 204 by default.
+// No Allow header is sent by default if no code is given, for example, for servers which can't handle 204
+func WithDefaultAllow(codes ...int) ConfigOption {
+	return func(cfg *Config) {
+		cfg.DefaultAllow = append([]int{}, codes...)
+	}
+}
+
+// WithAllow204MaxBodyBytes removes 204 from the Allow header of the requests without preview whose body is larger than maxBytes
+// or of unknown size, as RFC 3507 demands for large bodies the server can't buffer
+func WithAllow204MaxBodyBytes(maxBytes int64) ConfigOption {
+	return func(cfg *Config) {
+		if maxBytes <= 0 {
+			return
+		}
+
+		cfg.Allow204MaxBodyBytes = maxBytes
+	}
+}
+
+// WithOnContinue sets the function which observes the 100 Continue response to a preview, for example,
+// to abort the request before the rest of the body is uploaded by returning an error
+func WithOnContinue(onContinue func(res *Response) error) ConfigOption {
+	return func(cfg *Config) {
+		cfg.OnContinue = onContinue
+	}
+}
+
+// WithTLSHandshakeTimeout bounds the TLS handshake with icaps:// servers separately from connecting,
+// a server which accepts the connection but stalls the handshake fails the request with ErrTLSHandshakeTimeout
+func WithTLSHandshakeTimeout(timeout time.Duration) ConfigOption {
+	return func(cfg *Config) {
+		if timeout <= 0 {
+			return
+		}
+
+		cfg.ICAPConn.TLSHandshakeTimeout = timeout
+	}
+}
+
+// WithMaxChunks caps the amount of chunks of an encapsulated body of a response, a response exceeding it fails with ErrTooManyChunks,
+// so a malicious server can't keep the client busy by trickling an endless body of tiny chunks
+func WithMaxChunks(maxChunks int) ConfigOption {
+	return func(cfg *Config) {
+		if maxChunks <= 0 {
+			return
+		}
+
+		cfg.ICAPConn.MaxChunks = maxChunks
+	}
+}
+
+// WithLenientEncapsulation accepts 200 responses to modification requests which miss the Encapsulated header,
+// for non-compliant servers. The encapsulated http message is framed by its request or status line and its headers then,
+// each such response is reported to the warn function if it's set, as WithWarn sets it
+func WithLenientEncapsulation(warn func(err error)) ConfigOption {
+	return func(cfg *Config) {
+		cfg.ICAPConn.LenientEncapsulation = true
+
+		if warn != nil {
+			WithWarn(warn)(cfg)
+		}
+	}
+}
+
+// WithWarn sets the function the deviations from the protocol the client tolerates are reported to,
+// for example, ErrUnexpectedContinue, regardless of whether lenient parsing is enabled
+func WithWarn(warn func(err error)) ConfigOption {
+	return func(cfg *Config) {
+		cfg.Warn = warn
+	}
+}
@@ -1,64 +1,288 @@
 package icapclient
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 // ICAPConnConfig is the configuration for the icap connection
 type ICAPConnConfig struct {
-	// Timeout is the maximum amount of time a connection will be kept open
+	// Timeout is the maximum amount of time a connection will be kept open, it bounds dialing the server
+	// as well as reading and writing the messages. The deadline of the request context applies as well, whichever is earlier
 	Timeout time.Duration
+	// ReadBufferBytes is the size of the socket receive buffer, the operating system default is used if not set
+	ReadBufferBytes int
+	// WriteBufferBytes is the size of the socket send buffer, the operating system default is used if not set
+	WriteBufferBytes int
+	// OnProgress is called with the bytes sent to and received from the server since connecting as they move,
+	// the calls never overlap, but they block the transfer, so no slow work must be done in it
+	OnProgress func(sent, received int64)
+	// TLSConfig makes the connection use TLS, the ServerName defaults to the host of the dialed address if not set,
+	// so the certificate is verified against it. It's used by the client for icaps:// urls, the defaults apply if not set
+	TLSConfig *tls.Config
+	// Resolver resolves the host names of the icap servers, the default resolver is used if not set
+	Resolver *net.Resolver
+	// Tracer starts the spans around connecting, sending and receiving, no spans are started if not set
+	Tracer Tracer
+	// LenientEncapsulation reads the encapsulated http message of a 200 response which misses the Encapsulated header,
+	// the message is framed by its request or status line and its headers then. Such a response ends after its headers otherwise
+	LenientEncapsulation bool
+	// MaxChunks caps the amount of chunks of an encapsulated body, a response exceeding it fails with ErrTooManyChunks,
+	// so a server can't keep the client reading by trickling tiny chunks. No cap applies if not set
+	MaxChunks int
+	// MaxHeaderBytes and MaxHeaderLine cap the header lines of a response while it's read as the client's options of the same name do,
+	// a response exceeding them fails with ErrHeaderTooLarge before it's buffered in full. The client sets them from its options
+	MaxHeaderBytes int
+	MaxHeaderLine  int
+	// TLSHandshakeTimeout is the maximum amount of time the TLS handshake may take once the tcp connection is established,
+	// a handshake exceeding it fails with ErrTLSHandshakeTimeout. Only the Timeout bounds it if not set
+	TLSHandshakeTimeout time.Duration
 }
 
+// progressChunkSize is the amount of bytes written at once when the progress is reported
+const progressChunkSize = 32 << 10
+
 // ICAPConn is the one responsible for driving the transport layer operations. We have to explicitly deal with the connection because the ICAP protocol is aware of keep alive and reconnects.
 type ICAPConn struct {
-	tcp     net.Conn
-	mu      sync.Mutex
-	timeout time.Duration
+	tcp              net.Conn
+	reader           *bufio.Reader
+	mu               sync.Mutex
+	timeout          time.Duration
+	readBufferBytes  int
+	writeBufferBytes int
+	ctxDeadline      time.Time
+	onProgress       func(sent, received int64)
+	tlsConfig        *tls.Config
+	resolver         *net.Resolver
+	tracer           Tracer
+	lenient          bool
+	limits           headerLimits
+	handshakeTimeout time.Duration
+	ctx              context.Context
+	closed           atomic.Bool
+	writeClosed      atomic.Bool
+	progressMu       sync.Mutex
+	sent             int64
+	received         int64
+}
+
+// socketBufferSetter is implemented by connections which allow tuning the socket buffers, for example, *net.TCPConn
+type socketBufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
 }
 
 // NewICAPConn creates a new connection to the icap server
 func NewICAPConn(conf ICAPConnConfig) (*ICAPConn, error) {
 	return &ICAPConn{
-		timeout: conf.Timeout,
+		timeout:          conf.Timeout,
+		readBufferBytes:  conf.ReadBufferBytes,
+		writeBufferBytes: conf.WriteBufferBytes,
+		onProgress:       conf.OnProgress,
+		tlsConfig:        conf.TLSConfig,
+		resolver:         conf.Resolver,
+		tracer:           conf.Tracer,
+		lenient:          conf.LenientEncapsulation,
+		limits:           headerLimits{maxBytes: conf.MaxHeaderBytes, maxLine: conf.MaxHeaderLine, maxChunks: conf.MaxChunks},
+		handshakeTimeout: conf.TLSHandshakeTimeout,
 	}, nil
 }
 
 // Connect connects to the icap server
-func (c *ICAPConn) Connect(ctx context.Context, address string) error {
-	dialer := net.Dialer{Timeout: c.timeout}
+func (c *ICAPConn) Connect(ctx context.Context, address string) (err error) {
+	end := c.startSpan(ctx, SpanConnect)
+	defer func() {
+		end(err)
+	}()
+
+	dialer := net.Dialer{Timeout: c.timeout, Resolver: c.resolver}
 	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return err
 	}
 
+	if err := setSocketBuffers(conn, c.readBufferBytes, c.writeBufferBytes); err != nil {
+		return errors.Join(err, conn.Close())
+	}
+
+	if c.tlsConfig != nil {
+		conn, err = c.handshake(ctx, conn, address)
+		if err != nil {
+			return err
+		}
+	}
+
 	c.tcp = conn
+	c.reader = bufio.NewReader(progressReader{c})
+	c.ctx = ctx
+	c.closed.Store(false)
+	c.ctxDeadline, _ = ctx.Deadline()
+	c.sent, c.received = 0, 0
 
-	if dialer.Timeout == 0 {
-		return nil
+	return c.refreshDeadline()
+}
+
+// bind binds the established connection to the context of the next request made on it, its deadline applies from now on
+func (c *ICAPConn) bind(ctx context.Context) {
+	c.ctx = ctx
+	c.ctxDeadline, _ = ctx.Deadline()
+}
+
+// handshake wraps the connection into a TLS client connection and performs the handshake,
+// the certificate is verified against the host of the address unless the config names the server.
+// The handshake is bounded by the timeout of the connection and the one of the handshake, whichever is earlier
+func (c *ICAPConn) handshake(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	cfg := c.tlsConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	hsCtx := ctx
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		hsCtx, cancel = context.WithTimeout(hsCtx, c.timeout)
+		defer cancel()
+	}
+
+	if c.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		hsCtx, cancel = context.WithTimeout(hsCtx, c.handshakeTimeout)
+		defer cancel()
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		// the handshake timed out, not the request
+		if errors.Is(hsCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			err = fmt.Errorf("%w: %w", ErrTLSHandshakeTimeout, err)
+		}
+
+		return nil, errors.Join(err, conn.Close())
+	}
+
+	return tlsConn, nil
+}
+
+// startSpan starts a span of the phase if there is a tracer, the returned function ends it
+func (c *ICAPConn) startSpan(ctx context.Context, name string) func(err error) {
+	if c.tracer == nil {
+		return func(error) {}
+	}
+
+	return c.tracer.StartSpan(ctx, name)
+}
+
+// refreshDeadline sets the read and write deadlines of the connection from now on,
+// the earlier of the context deadline and the timeout is the effective one
+func (c *ICAPConn) refreshDeadline() error {
+	deadline := c.ctxDeadline
+
+	if c.timeout > 0 && (deadline.IsZero() || time.Now().Add(c.timeout).Before(deadline)) {
+		deadline = time.Now().UTC().Add(c.timeout)
 	}
 
-	deadline := time.Now().UTC().Add(dialer.Timeout)
+	if deadline.IsZero() {
+		return nil
+	}
 
 	if err := c.tcp.SetReadDeadline(deadline); err != nil {
 		return err
 	}
 
-	if err := c.tcp.SetWriteDeadline(deadline); err != nil {
-		return err
+	return c.tcp.SetWriteDeadline(deadline)
+}
+
+// setSocketBuffers sets the sizes of the socket buffers of the connection, sizes of 0 or less are left untouched
+func setSocketBuffers(conn net.Conn, readBufferBytes, writeBufferBytes int) error {
+	setter, ok := conn.(socketBufferSetter)
+	if !ok {
+		return nil
+	}
+
+	if readBufferBytes > 0 {
+		if err := setter.SetReadBuffer(readBufferBytes); err != nil {
+			return err
+		}
+	}
+
+	if writeBufferBytes > 0 {
+		if err := setter.SetWriteBuffer(writeBufferBytes); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// Send sends a request to the icap server
+// Send sends a request to the icap server and reads its entire response, as bounded by the Encapsulated header of it
 func (c *ICAPConn) Send(in []byte) ([]byte, error) {
+	return c.roundTrip(func() error {
+		return c.write(in)
+	}, c.lenientFor(in))
+}
+
+// sendAndCloseWrite sends the request like Send, but shuts down the writing side of the connection once it's written,
+// which tells servers waiting for the end of the input to process it. Nothing can be sent on the connection afterwards
+func (c *ICAPConn) sendAndCloseWrite(in []byte) ([]byte, error) {
+	return c.roundTrip(func() error {
+		if err := c.write(in); err != nil {
+			return err
+		}
+
+		return c.closeWrite()
+	}, c.lenientFor(in))
+}
+
+// sendChunked sends the head followed by the body read from the reader as the chunks of an ICAP message, then the last chunk
+// and the trailer, and reads the response. Only a buffer of a chunk is held in memory, the body is not read anymore once the response
+// is received. Nothing can be sent on the connection afterwards if the server answered before the entire body was sent
+func (c *ICAPConn) sendChunked(head []byte, body io.Reader, trailer []byte) ([]byte, error) {
+	r := &detachableReader{r: body}
+
+	data, err := c.roundTrip(func() error {
+		if len(head) > 0 {
+			if err := c.write(head); err != nil {
+				return err
+			}
+		}
+
+		return c.writeChunked(r, trailer)
+	}, c.lenientFor(head))
+
+	if !r.detach() {
+		c.writeClosed.Store(true)
+	}
+
+	return data, err
+}
+
+// lenientFor determines if the response to the request is read leniently, a response to an OPTIONS request carries no encapsulated http message
+func (c *ICAPConn) lenientFor(in []byte) bool {
+	return c.lenient && !bytes.HasPrefix(in, []byte(MethodOPTIONS+" "))
+}
+
+// roundTrip writes the request by the write function and reads the response meanwhile, the response is read leniently if set
+func (c *ICAPConn) roundTrip(write func() error, lenient bool) ([]byte, error) {
 	if !c.ok() {
 		return nil, syscall.EINVAL
 	}
@@ -66,75 +290,478 @@ func (c *ICAPConn) Send(in []byte) ([]byte, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	errChan := make(chan error)
-	resChan := make(chan []byte)
+	// the deadlines set by an earlier use of the connection must not cut this one short
+	if err := c.refreshDeadline(); err != nil {
+		return nil, err
+	}
+
+	// the write error channel is buffered, so the routine never blocks if the response was read with an error
+	writeErrChan := make(chan error, 1)
+
+	// the response is received while the request is sent
+	endSend := c.startSpan(c.ctx, SpanSend)
+	endReceive := c.startSpan(c.ctx, SpanReceive)
 
 	go func() {
 		// send the message to the server
-		_, err := c.tcp.Write(in)
+		err := write()
+		endSend(err)
+		writeErrChan <- err
+	}()
+
+	data, err := readMessage(c.reader, lenient, c.limits)
+
+	// the server might end the message by closing the connection, but it must send one
+	switch {
+	case (err == io.EOF || err == io.ErrUnexpectedEOF) && len(data) > 0:
+		err = nil
+	case (err == io.EOF || errors.Is(err, syscall.ECONNRESET)) && len(data) == 0:
+		err = fmt.Errorf("%w: %w", ErrEmptyResponse, err)
+	}
+	endReceive(err)
+
+	// something went wrong while reading from the server,
+	// return the error along with the one of the write if there is any
+	if err != nil {
+		select {
+		case writeErr := <-writeErrChan:
+			return nil, errors.Join(err, writeErr)
+		default:
+			return nil, err
+		}
+	}
+
+	// the rest of the request follows a 100 Continue, so the preview must be written entirely before
+	if continued(data) {
+		if err := <-writeErrChan; err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	}
+
+	// the server might answer before the entire message was written, for example, with an early 204.
+	// The write is cut short then, the connection can't be used again once a message was written on it partly
+	select {
+	case writeErr := <-writeErrChan:
+		if writeErr != nil {
+			c.writeClosed.Store(true)
+		}
+	default:
+		_ = c.tcp.SetWriteDeadline(time.Now())
+
+		if writeErr := <-writeErrChan; writeErr != nil {
+			c.writeClosed.Store(true)
+		} else {
+			// the write finished right before it was cut short, the deadline is set again by the next use of the connection
+			_ = c.tcp.SetWriteDeadline(time.Time{})
+		}
+	}
+
+	return data, nil
+}
+
+// continued reports whether the message is the 100 Continue a server asks for the rest of a preview with
+func continued(data []byte) bool {
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := bytes.Fields(line)
+
+	return len(fields) > 1 && string(fields[1]) == "100"
+}
+
+// readMessage reads one entire ICAP message from the reader and returns it as it was received:
+// the status line and the headers up to the empty line, then exactly the encapsulated sections the Encapsulated header declares,
+// a chunked body up to and including its last chunk and the ICAP trailers if the Trailer header announces them.
+// The message read so far is returned along with the error if the connection ends prematurely.
+// If lenient, the encapsulated http message of a 200 response without the Encapsulated header is read as well.
+// The header lines and the chunks are bounded by the limits while they're read, as toClientResponse bounds them
+func readMessage(b *bufio.Reader, lenient bool, limits headerLimits) ([]byte, error) {
+	data := getBuffer()
+	defer putBuffer(data)
+
+	err := readMessageInto(b, data, lenient, &limits)
+
+	return bytes.Clone(data.Bytes()), err
+}
+
+// readMessageInto reads one entire ICAP message from the reader into the buffer as readMessage describes it
+func readMessageInto(b *bufio.Reader, data *bytes.Buffer, lenient bool, limits *headerLimits) error {
+
+	statusCode, hdr, err := readRawHeader(b, data, limits)
+	if err != nil {
+		return err
+	}
+
+	// an interim response, the rest of the preview is sent only after it
+	if statusCode == http.StatusContinue {
+		return nil
+	}
+
+	if lenient && statusCode == http.StatusOK && hdr.Get(encapsulatedHeader) == "" {
+		return readUndeclaredMessage(b, data, limits)
+	}
+
+	entities, offsets := encapsulatedOffsets(hdr.Get(encapsulatedHeader))
+	if len(entities) == 0 {
+		return nil
+	}
+
+	// the sections follow each other, so a server declaring decreasing offsets sent a broken message
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] < offsets[i-1] {
+			return fmt.Errorf("%w: decreasing Encapsulated offsets: %s", ErrInvalidTCPMsg, hdr.Get(encapsulatedHeader))
+		}
+	}
+
+	// the encapsulated http headers precede the entity which is declared last, they count towards the header bytes
+	last := len(entities) - 1
+	if limits.maxBytes > 0 && int64(limits.read)+offsets[last] > int64(limits.maxBytes) {
+		return fmt.Errorf("%w: headers exceed %d bytes", ErrHeaderTooLarge, limits.maxBytes)
+	}
+
+	if err := readRawSections(b, data, offsets[last], limits); err != nil {
+		return err
+	}
+	limits.read += int(offsets[last])
+
+	if entities[last] == "null-body" {
+		return nil
+	}
+
+	// the header block of the message the body belongs to starts where the entity before the body starts
+	httpMsg := ""
+	if last > 0 && entities[last] != "opt-body" {
+		msg := data.Bytes()
+		httpMsg = string(msg[len(msg)-int(offsets[last]-offsets[last-1]):])
+	}
+
+	if contentLength, ok := encapsulatedContentLength(httpMsg); ok && !bodyIsChunkFramed(b, contentLength) {
+		if _, err := io.CopyN(data, b, contentLength); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	trailersRead, err := readRawChunkedBody(b, data, limits)
+	if err != nil {
+		return err
+	}
+
+	if trailersRead || hdr.Get("Trailer") == "" {
+		return nil
+	}
+
+	// the ICAP trailers follow the last chunk up to an empty line
+	_, err = readRawLines(b, data, limits, true)
+
+	return err
+}
+
+// readUndeclaredMessage reads the encapsulated http message of a response which misses the Encapsulated header into the buffer,
+// the header block up to the empty line and the body as its headers frame it. A response always has a body unless its length is 0,
+// a request only if its headers declare it
+func readUndeclaredMessage(b *bufio.Reader, data *bytes.Buffer, limits *headerLimits) error {
+	start := data.Len()
+	if _, err := readRawLines(b, data, limits, true); err != nil {
+		return err
+	}
+
+	httpMsg := string(data.Bytes()[start:])
+	hdr, _ := encapsulatedMIMEHeader(httpMsg)
+	contentLength, ok := encapsulatedContentLength(httpMsg)
+
+	switch {
+	case ok && contentLength == 0:
+		return nil
+	case ok && !bodyIsChunkFramed(b, contentLength):
+		_, err := io.CopyN(data, b, contentLength)
+		return err
+	case !ok && !strings.HasPrefix(httpMsg, "HTTP/") && !encapsulatedIsChunked(hdr):
+		return nil
+	}
+
+	_, err := readRawChunkedBody(b, data, limits)
+
+	return err
+}
+
+// readRawSections reads the size bytes of the encapsulated header sections into the buffer, line by line if the line length is capped
+func readRawSections(b *bufio.Reader, data *bytes.Buffer, size int64, limits *headerLimits) error {
+	if limits.maxLine <= 0 {
+		_, err := io.CopyN(data, b, size)
+		return err
+	}
+
+	// the sections are read through a reader which ends with them, so not a byte of what follows is consumed
+	sections := bufio.NewReader(io.LimitReader(b, size))
+	for read := int64(0); read < size; {
+		line, err := limits.readLine(sections, false)
+		data.WriteString(line)
+		read += int64(len(line))
+
+		switch {
+		case err == io.EOF && read < size:
+			return io.ErrUnexpectedEOF
+		case err != nil && err != io.EOF:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readRawHeader reads the status line and the headers of an ICAP message up to the empty line into the buffer
+func readRawHeader(b *bufio.Reader, data *bytes.Buffer, limits *headerLimits) (int, textproto.MIMEHeader, error) {
+	statusLine, err := limits.readHeaderLine(b)
+	data.WriteString(statusLine)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// the status line must contain the code, for example, "ICAP/1.0 200 OK"
+	statusCode := 0
+	if fields := strings.Fields(statusLine); len(fields) > 1 {
+		statusCode, _ = strconv.Atoi(fields[1])
+	}
+
+	start := data.Len()
+	if _, err := readRawLines(b, data, limits, true); err != nil {
+		return statusCode, nil, err
+	}
+
+	hdr, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data.Bytes()[start:]))).ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return statusCode, textproto.MIMEHeader{}, nil
+	}
+
+	return statusCode, hdr, nil
+}
+
+// readRawLines reads lines into the buffer up to and including the empty line, it returns the amount of non-empty lines read.
+// The lines count towards the header bytes of the limits if counted
+func readRawLines(b *bufio.Reader, data *bytes.Buffer, limits *headerLimits, counted bool) (int, error) {
+	for lines := 0; ; lines++ {
+		line, err := limits.readLine(b, counted)
+		if counted {
+			limits.read += len(line)
+		}
+		data.WriteString(line)
 		if err != nil {
-			errChan <- err
+			return lines, err
 		}
-	}()
 
-	go func() {
-		data := make([]byte, 0)
+		if line == crlf || line == lf {
+			return lines, nil
+		}
+	}
+}
 
-		for {
-			tmp := make([]byte, 1096)
+// readRawChunkedBody reads a chunked body into the buffer as it is, chunk by chunk according to the chunk sizes,
+// up to and including the empty line which follows the last chunk. It returns if trailers were read along with the last chunk.
+// More than maxChunks chunks of the limits before the last one fail with ErrTooManyChunks, if maxChunks is set
+func readRawChunkedBody(b *bufio.Reader, data *bytes.Buffer, limits *headerLimits) (bool, error) {
+	for chunks := 1; ; chunks++ {
+		sizeLine, err := limits.readLine(b, false)
+		data.WriteString(sizeLine)
+		if err != nil {
+			return false, err
+		}
 
-			// read the response from the server
-			n, err := c.tcp.Read(tmp)
+		// the chunk extensions, for example, ieof, are not relevant for the size
+		chunkSize, _, _ := strings.Cut(strings.TrimSpace(sizeLine), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(chunkSize), 16, 64)
+		if err != nil || size < 0 {
+			return false, fmt.Errorf("%w: invalid chunk size: %s", ErrInvalidTCPMsg, sizeLine)
+		}
 
-			// something went wrong while reading from the server,
-			// send the error and exit the routine to prevent
-			// sending the response to resChan
-			if err != nil && err != io.EOF {
-				errChan <- err
-				return
-			}
+		if size == 0 {
+			lines, err := readRawLines(b, data, limits, false)
+			return lines > 0, err
+		}
 
-			// EOF detected, an entire message is received
-			if err == io.EOF || n == 0 {
-				break
-			}
+		if limits.maxChunks > 0 && chunks > limits.maxChunks {
+			return false, fmt.Errorf("%w: more than %d chunks", ErrTooManyChunks, limits.maxChunks)
+		}
 
-			data = append(data, tmp[:n]...)
+		// the chunk is followed by a crlf
+		if _, err := io.CopyN(data, b, size); err != nil {
+			return false, err
+		}
 
-			// explicitly breaking because the Read blocks for 100 continue message
-			if bytes.Equal(data, []byte(icap100ContinueMsg)) {
-				break
-			}
+		line, err := limits.readLine(b, false)
+		data.WriteString(line)
+		if err != nil {
+			return false, err
+		}
+	}
+}
 
-			// EOF detected, double crlf indicates the end of the message
-			if bytes.HasSuffix(data, []byte(doubleCRLF)) {
-				break
-			}
+// encapsulatedOffsets returns the entities of the Encapsulated header value along with their offsets, in the declared order
+func encapsulatedOffsets(encVal string) ([]string, []int64) {
+	var entities []string
+	var offsets []int64
 
-			// EOF detected, 204 no modifications and Double crlf indicate the end of the message
-			if bytes.Contains(data, []byte(icap204NoModsMsg)) {
-				break
+	for _, entry := range strings.Split(encVal, ",") {
+		name, offset, _ := strings.Cut(strings.TrimSpace(entry), "=")
+
+		n, err := strconv.ParseInt(strings.TrimSpace(offset), 10, 64)
+		if name == "" || err != nil || n < 0 {
+			continue
+		}
+
+		entities = append(entities, name)
+		offsets = append(offsets, n)
+	}
+
+	return entities, offsets
+}
+
+// write writes the message to the server, piece by piece if the progress is reported
+func (c *ICAPConn) write(in []byte) error {
+	if c.onProgress == nil {
+		_, err := c.tcp.Write(in)
+		return err
+	}
+
+	for len(in) > 0 {
+		piece := in[:min(len(in), progressChunkSize)]
+
+		n, err := c.tcp.Write(piece)
+		c.reportProgress(n, 0)
+		if err != nil {
+			return err
+		}
+
+		in = in[n:]
+	}
+
+	return nil
+}
+
+// writeChunked writes the body read from the reader as chunks of at most progressChunkSize bytes,
+// followed by the last chunk and the trailer
+func (c *ICAPConn) writeChunked(body io.Reader, trailer []byte) error {
+	buf := make([]byte, progressChunkSize)
+	chunk := make([]byte, 0, progressChunkSize+32)
+
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			// the chunk is framed in a buffer which is reused, so sending the body allocates nothing further
+			chunk = strconv.AppendInt(chunk[:0], int64(n), 16)
+			chunk = append(chunk, crlf...)
+			chunk = append(chunk, buf[:n]...)
+			chunk = append(chunk, crlf...)
+
+			if err := c.write(chunk); err != nil {
+				return err
 			}
 		}
 
-		resChan <- data
-	}()
+		if err == io.EOF {
+			return c.write(append([]byte("0"+doubleCRLF), trailer...))
+		}
 
-	select {
-	case err := <-errChan:
-		return nil, err
-	case res := <-resChan:
-		return res, nil
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// detachableReader reads from the reader until it's detached, so the reader is not read anymore by a write outliving the request
+type detachableReader struct {
+	mu       sync.Mutex
+	r        io.Reader
+	detached bool
+	eof      bool
+}
+
+func (d *detachableReader) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.detached {
+		return 0, errBodyDetached
+	}
+
+	n, err := d.r.Read(p)
+	if err == io.EOF {
+		d.eof = true
+	}
+
+	return n, err
+}
+
+// detach stops reading from the reader, it waits for a read in progress and reports whether the reader was read entirely
+func (d *detachableReader) detach() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.detached = true
+
+	return d.eof
+}
+
+// progressReader reads from the connection and reports the received bytes
+type progressReader struct {
+	c *ICAPConn
+}
+
+func (r progressReader) Read(p []byte) (int, error) {
+	n, err := r.c.tcp.Read(p)
+	if n > 0 {
+		r.c.reportProgress(0, n)
+	}
+
+	return n, err
+}
+
+// reportProgress adds the transferred bytes to the totals and reports them, if there is someone to report to
+func (c *ICAPConn) reportProgress(sent, received int) {
+	c.progressMu.Lock()
+	defer c.progressMu.Unlock()
+
+	c.sent += int64(sent)
+	c.received += int64(received)
+
+	if c.onProgress != nil {
+		c.onProgress(c.sent, c.received)
 	}
 }
 
-// Close closes the tcp connection
+// receivedBytes returns the amount of bytes received from the server since connecting
+func (c *ICAPConn) receivedBytes() int64 {
+	c.progressMu.Lock()
+	defer c.progressMu.Unlock()
+
+	return c.received
+}
+
+// Close closes the tcp connection, closing it again is a no-op.
+// It returns ErrNotConnected if the connection was never established
 func (c *ICAPConn) Close() error {
 	if !c.ok() {
-		return syscall.EINVAL
+		return ErrNotConnected
+	}
+
+	if c.closed.Swap(true) {
+		return nil
 	}
 
 	return c.tcp.Close()
 }
 
+// closeWrite shuts down the writing side of the connection, if the connection supports it, for example, *net.TCPConn and *tls.Conn
+func (c *ICAPConn) closeWrite() error {
+	cw, ok := c.tcp.(interface{ CloseWrite() error })
+	if !ok {
+		return nil
+	}
+
+	c.writeClosed.Store(true)
+
+	return cw.CloseWrite()
+}
+
 func (c *ICAPConn) ok() bool { return c != nil && c.tcp != nil }
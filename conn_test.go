@@ -2,8 +2,14 @@ package icapclient_test
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -61,8 +67,31 @@ func TestICAPConn_Send(t *testing.T) {
 			},
 			{
 				name:     "icap204NoModsMsg",
-				messages: []string{"prefix" + icapclient.ICAP204NoModsMsg + "suffix"},
-				want:     "prefix" + icapclient.ICAP204NoModsMsg + "suffix",
+				messages: []string{"ICAP/1.0 204 No Modifications\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n"},
+				want:     "ICAP/1.0 204 No Modifications\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n",
+			},
+			{
+				name:     "null-body after the http headers",
+				messages: []string{"ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=19\r\n\r\n", "HTTP/1.1 200 OK\r\n\r\n"},
+				want:     "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=19\r\n\r\nHTTP/1.1 200 OK\r\n\r\n",
+			},
+			{
+				name:     "large chunked 200",
+				messages: largeChunkedMessage(),
+				want:     strings.Join(largeChunkedMessage(), ""),
+			},
+			{
+				name: "chunked 200 with trailers",
+				messages: []string{
+					"ICAP/1.0 200 OK\r\nTrailer: X-Infection-Found\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\n",
+					"HTTP/1.1 200 OK\r\n\r\n",
+					"b\r\nHello World\r\n0\r\n\r\n",
+					"X-Infection-Found: Type=0; Resolution=2; Threat=EICAR;\r\n\r\n",
+				},
+				want: "ICAP/1.0 200 OK\r\nTrailer: X-Infection-Found\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\n\r\n" +
+					"b\r\nHello World\r\n0\r\n\r\n" +
+					"X-Infection-Found: Type=0; Resolution=2; Threat=EICAR;\r\n\r\n",
 			},
 		}
 
@@ -87,3 +116,337 @@ func TestICAPConn_Send(t *testing.T) {
 		}
 	}
 }
+
+// largeChunkedMessage returns a 200 response with a large chunked body, split into the pieces the server writes one after another,
+// the body contains double crlfs, so the message can't be told complete by its suffix
+func largeChunkedMessage() []string {
+	httpResp := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	messages := []string{
+		"ICAP/1.0 200 OK\r\nISTag: ICAP-TEST\r\nEncapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpResp)) + "\r\n\r\n",
+		httpResp,
+	}
+
+	chunk := strings.Repeat("Hello World\r\n\r\n", 1024)
+	for i := 0; i < 4; i++ {
+		messages = append(messages, fmt.Sprintf("%x\r\n%s\r\n", len(chunk), chunk))
+	}
+
+	return append(messages, "0\r\n\r\n")
+}
+
+type bufferConn struct {
+	net.Conn
+	readBuffer  int
+	writeBuffer int
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error {
+	c.readBuffer = bytes
+	return nil
+}
+
+func (c *bufferConn) SetWriteBuffer(bytes int) error {
+	c.writeBuffer = bytes
+	return nil
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	tests := []struct {
+		name             string
+		readBufferBytes  int
+		writeBufferBytes int
+	}{
+		{
+			name:             "both buffers",
+			readBufferBytes:  1 << 20,
+			writeBufferBytes: 2 << 20,
+		},
+		{
+			name:             "default buffers",
+			readBufferBytes:  0,
+			writeBufferBytes: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &bufferConn{}
+
+			if err := icapclient.SetSocketBuffers(conn, tc.readBufferBytes, tc.writeBufferBytes); err != nil {
+				t.Fatal(err)
+			}
+
+			if conn.readBuffer != tc.readBufferBytes {
+				t.Errorf("SetReadBuffer() = %v, want %v", conn.readBuffer, tc.readBufferBytes)
+			}
+
+			if conn.writeBuffer != tc.writeBufferBytes {
+				t.Errorf("SetWriteBuffer() = %v, want %v", conn.writeBuffer, tc.writeBufferBytes)
+			}
+		})
+	}
+}
+
+func TestICAPConn_ConnectSocketBuffers(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	clientConn, err := icapclient.NewICAPConn(icapclient.ICAPConnConfig{
+		Timeout:          5 * time.Second,
+		ReadBufferBytes:  1 << 20,
+		WriteBufferBytes: 1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clientConn.Connect(context.Background(), tcp.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clientConn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestICAPConn_SendRefreshesDeadline(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	clientConn, err := icapclient.NewICAPConn(icapclient.ICAPConnConfig{Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clientConn.Connect(context.Background(), tcp.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	tcpConn, err := tcp.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	// the connection is reused after the deadline set when connecting has passed
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := tcpConn.Write([]byte(icapclient.ICAP100ContinueMsg)); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := clientConn.Send(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(res); got != icapclient.ICAP100ContinueMsg {
+		t.Errorf("ICAPConn.Send() = %v, want %v", got, icapclient.ICAP100ContinueMsg)
+	}
+}
+
+func TestICAPConn_Close(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	clientConn, err := icapclient.NewICAPConn(icapclient.ICAPConnConfig{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clientConn.Close(); !errors.Is(err, icapclient.ErrNotConnected) {
+		t.Errorf("ICAPConn.Close() before connect = %v, want %v", err, icapclient.ErrNotConnected)
+	}
+
+	if err := clientConn.Connect(context.Background(), tcp.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clientConn.Close(); err != nil {
+		t.Errorf("ICAPConn.Close() = %v, want nil", err)
+	}
+
+	if err := clientConn.Close(); err != nil {
+		t.Errorf("ICAPConn.Close() twice = %v, want nil", err)
+	}
+}
+
+// startTestDNSServer starts a dns server over tcp which resolves every name to 127.0.0.1,
+// it returns a resolver which asks the server only
+func startTestDNSServer(t *testing.T) *net.Resolver {
+	t.Helper()
+
+	lstnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lstnr.Close() })
+
+	go func() {
+		for {
+			conn, err := lstnr.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveTestDNS(conn)
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp", lstnr.Addr().String())
+		},
+	}
+}
+
+// serveTestDNS answers the A queries of the connection with 127.0.0.1 and every other query without an answer
+func serveTestDNS(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var size uint16
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+
+		query := make([]byte, size)
+		if _, err := io.ReadFull(conn, query); err != nil || len(query) < 12 {
+			return
+		}
+
+		// the question follows the header, its name is a sequence of labels ended by the root label
+		end := 12
+		for end < len(query) && query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		end += 5
+		if end > len(query) {
+			return
+		}
+
+		question := query[12:end]
+		qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+
+		answers := uint16(0)
+		if qtype == 1 {
+			answers = 1
+		}
+
+		msg := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query[:2]))
+		msg = append(msg, 0x81, 0x80, 0, 1)
+		msg = binary.BigEndian.AppendUint16(msg, answers)
+		msg = append(msg, 0, 0, 0, 0)
+		msg = append(msg, question...)
+
+		if answers > 0 {
+			// a pointer to the question name, type A, class IN, a ttl of 60 seconds and the address
+			msg = append(msg, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+		}
+
+		if err := binary.Write(conn, binary.BigEndian, uint16(len(msg))); err != nil {
+			return
+		}
+
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func TestICAPConn_ConnectResolver(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	_, port, _ := net.SplitHostPort(tcp.Addr().String())
+
+	clientConn, err := icapclient.NewICAPConn(icapclient.ICAPConnConfig{
+		Timeout:  5 * time.Second,
+		Resolver: startTestDNSServer(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the name is known to the custom resolver only
+	if err := clientConn.Connect(context.Background(), net.JoinHostPort("icap-server.test", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clientConn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestICAPConn_ConnectTLSHandshakeTimeout(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	// the server accepts the connection, but never answers the TLS handshake
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	clientConn, err := icapclient.NewICAPConn(icapclient.ICAPConnConfig{
+		Timeout:             5 * time.Second,
+		TLSConfig:           &tls.Config{},
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = clientConn.Connect(context.Background(), tcp.Addr().String())
+	if !errors.Is(err, icapclient.ErrTLSHandshakeTimeout) {
+		t.Errorf("Wanted error:%v, got:%v", icapclient.ErrTLSHandshakeTimeout, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Wanted the handshake to time out after 50ms, it took:%v", elapsed)
+	}
+
+	// a canceled request is not reported as a handshake timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	clientConn, err = icapclient.NewICAPConn(icapclient.ICAPConnConfig{
+		TLSConfig:           &tls.Config{},
+		TLSHandshakeTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clientConn.Connect(ctx, tcp.Addr().String()); err == nil || errors.Is(err, icapclient.ErrTLSHandshakeTimeout) {
+		t.Errorf("Wanted the handshake to fail with the request, not as timed out, got:%v", err)
+	}
+}
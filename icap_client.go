@@ -2,15 +2,19 @@ package icapclient
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // the icap request methods
@@ -25,8 +29,8 @@ var (
 	// ErrNoContext is used when no context is provided
 	ErrNoContext = errors.New("no context provided")
 
-	// ErrInvalidScheme is used when the url scheme is not icap://
-	ErrInvalidScheme = errors.New("the url scheme must be icap://")
+	// ErrInvalidScheme is used when the url scheme is neither icap:// nor icaps://
+	ErrInvalidScheme = errors.New("the url scheme must be icap:// or icaps://")
 
 	// ErrMethodNotAllowed is used when the method is not allowed
 	ErrMethodNotAllowed = errors.New("the requested method is not registered")
@@ -45,28 +49,110 @@ var (
 
 	// ErrRESPMODWithoutResp is used when the response is nil for RESPMOD method
 	ErrRESPMODWithoutResp = errors.New("http response cannot be nil for method RESPMOD")
+
+	// ErrInvalidEncapsulatedKind is used when the kind of a raw encapsulated body is not req-body, res-body or opt-body,
+	// or doesn't fit the method of the request
+	ErrInvalidEncapsulatedKind = errors.New("the encapsulated body kind must be one of req-body, res-body or opt-body")
+
+	// ErrICAPFailure is used when the server responds with a failure status code
+	ErrICAPFailure = errors.New("the icap server responded with a failure")
+
+	// ErrServerRequestTimeout is used when the server timed out waiting for the request, for example, for the rest of a preview
+	ErrServerRequestTimeout = errors.New("the icap server timed out waiting for the request")
+
+	// ErrNoContentResponse is used when there is no http response to serve
+	ErrNoContentResponse = errors.New("there is no http response to serve")
+
+	// ErrNoContentRequest is used when there is no modified http request to apply
+	ErrNoContentRequest = errors.New("there is no modified http request to apply")
+
+	// ErrNextServiceNotAllowed is used when the server directs the client to a service on a host which is not allowed
+	ErrNextServiceNotAllowed = errors.New("the next service is not on an allowed host")
+
+	// ErrHeaderTooLarge is used when the headers of the server response exceed the configured limits
+	ErrHeaderTooLarge = errors.New("the icap server response headers are too large")
+
+	// ErrNotConnected is used when the connection to the icap server was never established
+	ErrNotConnected = errors.New("the connection to the icap server is not established")
+
+	// ErrClientShutdown is used when a request is made with a client which is shut down
+	ErrClientShutdown = errors.New("the icap client is shut down")
+
+	// ErrInvalidHeaderName is used when a header name contains characters which are not allowed in it
+	ErrInvalidHeaderName = errors.New("invalid header name")
+
+	// ErrInvalidAuthenticatedUser is used when the X-Authenticated-User header is not the base64 encoded scheme://user
+	ErrInvalidAuthenticatedUser = errors.New("invalid X-Authenticated-User, must be the base64 encoded scheme://user")
+
+	// ErrSequenceHostMismatch is used when the requests of a sequence do not go to the same server
+	ErrSequenceHostMismatch = errors.New("the requests of a sequence must go to the same server")
+
+	// ErrEmptyResponse is used when the icap server closes the connection without sending a response
+	ErrEmptyResponse = errors.New("the icap server closed the connection without a response")
+
+	// ErrNoDate is used when the icap server response has no Date header
+	ErrNoDate = errors.New("the icap server response has no Date header")
+
+	// ErrMissingEncapsulated is used when a 200 response to a modification request misses the Encapsulated header
+	ErrMissingEncapsulated = errors.New("the icap server response misses the Encapsulated header")
+
+	// errConnClosing is used when the server announces to close the connection after its response
+	errConnClosing = errors.New("the icap server closes the connection")
+
+	// errBodyDetached is used when the body is read after the response to the request was received
+	errBodyDetached = errors.New("the body is not read anymore, the response was received")
+
+	// ErrTooManyChunks is used when an encapsulated body of the icap server response consists of more chunks than allowed
+	ErrTooManyChunks = errors.New("the icap server response body has too many chunks")
+
+	// ErrTLSHandshakeTimeout is used when the TLS handshake with the icap server takes longer than allowed
+	ErrTLSHandshakeTimeout = errors.New("the TLS handshake with the icap server timed out")
+
+	// ErrUnexpectedContinue is reported as a warning when the icap server answers with 100 Continue although the entire body was sent,
+	// the final response which follows it is returned
+	ErrUnexpectedContinue = errors.New("the icap server asked to continue although the entire body was sent")
+
+	// ErrMethodNotSupportedByService is used when the OPTIONS of the service don't list the method of the request
+	ErrMethodNotSupportedByService = errors.New("the method is not supported by the icap service")
+
+	// ErrMissingHostHeader is used in strict mode when the request has no Host header with a single value
+	ErrMissingHostHeader = errors.New("the request must have a single Host header")
+
+	// ErrInvalidPreviewSize is used when the preview size of the request is negative
+	ErrInvalidPreviewSize = errors.New("the preview size must not be negative")
+
+	// ErrInvalidPreviewHeader is used in strict mode when the Preview header of the request is malformed
+	ErrInvalidPreviewHeader = errors.New("invalid Preview header")
+
+	// ErrInvalidEncapsulatedHeader is used in strict mode when the request sets the Encapsulated header itself,
+	// the header is computed while the request is built
+	ErrInvalidEncapsulatedHeader = errors.New("the Encapsulated header must not be set on the request")
 )
 
 // general constants required for the package
 const (
 	schemeICAP                      = "icap"
+	schemeICAPS                     = "icaps"
 	icapVersion                     = "ICAP/1.0"
 	httpVersion                     = "HTTP/1.1"
 	schemeHTTPReq                   = "http_request"
 	schemeHTTPResp                  = "http_response"
+	schemeICAPTrailer               = "icap_trailer"
 	crlf                            = "\r\n"
 	doubleCRLF                      = crlf + crlf
 	lf                              = "\n"
 	bodyEndIndicator                = crlf + "0" + crlf
 	fullBodyEndIndicatorPreviewMode = "; ieof" + doubleCRLF
 	icap100ContinueMsg              = "ICAP/1.0 100 Continue" + doubleCRLF
-	icap204NoModsMsg                = "ICAP/1.0 204 Unmodified"
 )
 
 // Common ICAP headers
 const (
 	previewHeader      = "Preview"
 	encapsulatedHeader = "Encapsulated"
+	nextServicesHeader = "X-Next-Services"
+	allowOutHeader     = "X-Allow-Out"
+	authUserHeader     = "X-Authenticated-User"
 )
 
 // Conn represents the connection to the icap server
@@ -76,14 +162,355 @@ type Conn interface {
 	Send(in []byte) ([]byte, error)
 }
 
+// Authenticator applies the credentials to the request before it's sent to the icap server,
+// it's called for every request made by the client, so the credentials might be refreshed in it
+type Authenticator interface {
+	Apply(req *Request) error
+}
+
+// Tracer starts the spans around the phases of the requests: connecting to the icap server, sending the request and receiving the response,
+// so the icap calls appear in distributed traces. The returned function ends the span with the error of the phase, if any.
+// It's satisfied by a thin adapter to the tracing library of choice, for example, OpenTelemetry
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) func(err error)
+}
+
+// the names of the spans started by the connection
+const (
+	SpanConnect = "icap.connect"
+	SpanSend    = "icap.send"
+	SpanReceive = "icap.receive"
+)
+
+// HeaderField is a single ICAP header as it was transmitted by the server
+type HeaderField struct {
+	Key   string
+	Value string
+}
+
+// EncapEntry is a single entity of the Encapsulated header, for example, res-body along with its offset
+type EncapEntry struct {
+	Name   string
+	Offset int64
+}
+
 // Response represents the icap server response data
 type Response struct {
 	StatusCode      int
 	Status          string
 	PreviewBytes    int
 	Header          http.Header
+	RawHeaders      []HeaderField
+	Trailer         http.Header
+	OptBody         []byte
 	ContentRequest  *http.Request
 	ContentResponse *http.Response
+	// PreviewDecisionTime is the time the server took to answer the preview, from sending it until the 100 Continue
+	// or the final response was received, it's 0 if the request had no preview
+	PreviewDecisionTime time.Duration
+	// ContentLength is the length of the body of the content modified by the server, as Body returns it once dechunked,
+	// it's -1 if the server returned no content, for example, for 204 No Content
+	ContentLength int64
+	// Request is the request the response answers, as it was sent by the client
+	Request *Request
+}
+
+// NextServices returns the services the server directs the client to chain to, as advertised by the X-Next-Services header
+func (r *Response) NextServices() []string {
+	return headerList(r.Header, nextServicesHeader)
+}
+
+// EncapsulatedEntities returns the entities of the Encapsulated header in the declared order, as the encapsulated sections
+// were read by, the malformed entries are left out
+func (r *Response) EncapsulatedEntities() []EncapEntry {
+	var entries []EncapEntry
+
+	names, offsets := encapsulatedOffsets(r.Header.Get(encapsulatedHeader))
+	for i, name := range names {
+		entries = append(entries, EncapEntry{Name: name, Offset: offsets[i]})
+	}
+
+	return entries
+}
+
+// headerList returns the elements of the comma separated list of the header values, for example, Allow: 204, 206
+func headerList(hdr http.Header, key string) []string {
+	var elements []string
+
+	for _, value := range hdr.Values(key) {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+
+	return elements
+}
+
+// Reason returns a human-readable reason of the response as reported by the server in one of the known vendor headers,
+// for example, X-Response-Desc or the threat of X-Infection-Found, the ICAP status text otherwise
+func (r *Response) Reason() string {
+	for _, header := range []string{"X-Response-Desc", "X-Response-Info", "X-Virus-ID", "X-Block-Reason"} {
+		if reason := strings.TrimSpace(r.Header.Get(header)); reason != "" {
+			return reason
+		}
+	}
+
+	// for example, X-Infection-Found: Type=0; Resolution=2; Threat=EICAR;
+	for _, param := range strings.Split(r.Header.Get("X-Infection-Found"), ";") {
+		if key, val, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(key, "Threat") && val != "" {
+			return strings.TrimSpace(val)
+		}
+	}
+
+	return r.Status
+}
+
+// Date returns the time of the Date header of the response, the runs of spaces some servers put into it are tolerated,
+// for example, Mon, 10 Jan 2000  09:55:21 GMT
+func (r *Response) Date() (time.Time, error) {
+	date := strings.Join(strings.Fields(r.Header.Get("Date")), " ")
+	if date == "" {
+		return time.Time{}, ErrNoDate
+	}
+
+	return http.ParseTime(date)
+}
+
+// Server returns the Server header of the response, which names the software of the icap server
+func (r *Response) Server() string {
+	return strings.TrimSpace(r.Header.Get("Server"))
+}
+
+// DefaultOptionsTTL is the time the OPTIONS of a service are valid for if it doesn't tell by the Options-TTL header.
+// RFC 3507 considers them valid forever then, the default bounds it, so the changes of a service are noticed eventually
+var DefaultOptionsTTL = time.Hour
+
+// ServiceOptions are the capabilities of a service as its OPTIONS response advertises them
+type ServiceOptions struct {
+	// Methods are the methods the service supports, as listed by the Methods header
+	Methods []string
+	// Service is the description of the service
+	Service string
+	// ISTag is the tag of the current state of the service
+	ISTag string
+	// Allow are the status codes the service may answer with besides the standard ones, for example, 204
+	Allow []string
+	// Preview is the amount of body bytes the service wants to preview, it's -1 if the service doesn't support previews
+	Preview int
+	// TransferPreview, TransferComplete and TransferIgnore are the file extensions the service wants previewed,
+	// sent complete or not sent at all, * stands for all the other extensions
+	TransferPreview  []string
+	TransferComplete []string
+	TransferIgnore   []string
+	// MaxConnections is the amount of connections the service accepts at the same time, it's 0 if it's unlimited,
+	// as it is if the service doesn't tell
+	MaxConnections int
+	// OptionsTTL is the time the options are valid for, it's DefaultOptionsTTL if the service doesn't tell
+	OptionsTTL time.Duration
+}
+
+// Options returns the capabilities of the service as advertised by the headers of the OPTIONS response,
+// the malformed Preview, Max-Connections and Options-TTL headers are treated as absent
+func (r *Response) Options() ServiceOptions {
+	opts := ServiceOptions{
+		Methods:          headerList(r.Header, "Methods"),
+		Service:          strings.TrimSpace(r.Header.Get("Service")),
+		ISTag:            strings.Trim(strings.TrimSpace(r.Header.Get("ISTag")), `"`),
+		Allow:            headerList(r.Header, "Allow"),
+		Preview:          -1,
+		TransferPreview:  headerList(r.Header, "Transfer-Preview"),
+		TransferComplete: headerList(r.Header, "Transfer-Complete"),
+		TransferIgnore:   headerList(r.Header, "Transfer-Ignore"),
+		OptionsTTL:       DefaultOptionsTTL,
+	}
+
+	if preview, err := strconv.Atoi(strings.TrimSpace(r.Header.Get(previewHeader))); err == nil && preview >= 0 {
+		opts.Preview = preview
+	}
+
+	if maxConns, err := strconv.Atoi(strings.TrimSpace(r.Header.Get("Max-Connections"))); err == nil && maxConns > 0 {
+		opts.MaxConnections = maxConns
+	}
+
+	if ttl, err := strconv.Atoi(strings.TrimSpace(r.Header.Get("Options-TTL"))); err == nil && ttl > 0 {
+		opts.OptionsTTL = time.Duration(ttl) * time.Second
+	}
+
+	return opts
+}
+
+// ContentModified determines if the content returned by the server differs from the original body sent to it,
+// the body of the returned http message can still be read afterwards
+func (r *Response) ContentModified(original []byte) (modified bool, err error) {
+	var body *io.ReadCloser
+
+	switch {
+	case r.StatusCode == http.StatusNoContent:
+		// the server might encapsulate a http message in the 204 anyway, it's not a modification
+		return false, nil
+	case r.ContentResponse != nil:
+		body = &r.ContentResponse.Body
+	case r.ContentRequest != nil:
+		body = &r.ContentRequest.Body
+	default:
+		// no content returned, the server did not modify it
+		return false, nil
+	}
+
+	if *body == nil {
+		return len(original) > 0, nil
+	}
+
+	b, err := io.ReadAll(*body)
+	if err != nil {
+		return false, err
+	}
+
+	defer func(rc io.ReadCloser) {
+		err = errors.Join(err, rc.Close())
+	}(*body)
+
+	*body = io.NopCloser(bytes.NewReader(b))
+
+	return !bytes.Equal(b, original), nil
+}
+
+// Body returns the body of the content modified by the server, of the http response if there is one,
+// of the http request otherwise. The body is empty for 204 No Content, as the server did not modify anything
+func (r *Response) Body() io.ReadCloser {
+	var body io.ReadCloser
+
+	switch {
+	case r.StatusCode == http.StatusNoContent:
+	case r.ContentResponse != nil:
+		body = r.ContentResponse.Body
+	case r.ContentRequest != nil:
+		body = r.ContentRequest.Body
+	}
+
+	if body == nil {
+		return http.NoBody
+	}
+
+	return body
+}
+
+// ServeHTTP writes the content to the http response writer, the modified http response if the server modified it
+// or the original one if the server responded with 204 No Content
+func (r *Response) ServeHTTP(w http.ResponseWriter, original *http.Response) error {
+	switch {
+	case r.StatusCode == http.StatusNoContent:
+		if original == nil {
+			return ErrNoContentResponse
+		}
+
+		return writeHTTPResponse(w, original)
+	case r.ContentResponse != nil:
+		return writeHTTPResponse(w, r.ContentResponse)
+	default:
+		return ErrNoContentResponse
+	}
+}
+
+// ApplyToResponse applies the http response modified by the server to the given one in place, its status, headers and body,
+// the body it had is closed. Nothing is applied for 204 No Content, as the server did not modify anything
+func (r *Response) ApplyToResponse(resp *http.Response) error {
+	switch {
+	case r.StatusCode == http.StatusNoContent:
+		return nil
+	case r.ContentResponse == nil:
+		return ErrNoContentResponse
+	}
+
+	var err error
+	if resp.Body != nil {
+		err = resp.Body.Close()
+	}
+
+	modified := r.ContentResponse
+	resp.Status = modified.Status
+	resp.StatusCode = modified.StatusCode
+	resp.Header = modified.Header.Clone()
+	resp.Trailer = modified.Trailer.Clone()
+	resp.Body = r.Body()
+	resp.TransferEncoding = nil
+	resp.ContentLength = max(r.ContentLength, 0)
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+
+	// the modified response came without a body
+	if resp.ContentLength == 0 {
+		resp.Body = http.NoBody
+	}
+
+	return err
+}
+
+// ApplyToRequest applies the http request modified by the server to the given one in place, its method, url, headers and body,
+// the body it had is closed. Nothing is applied for 204 No Content, as the server did not modify anything
+func (r *Response) ApplyToRequest(req *http.Request) error {
+	switch {
+	case r.StatusCode == http.StatusNoContent:
+		return nil
+	case r.ContentRequest == nil:
+		return ErrNoContentRequest
+	}
+
+	var err error
+	if req.Body != nil {
+		err = req.Body.Close()
+	}
+
+	modified := r.ContentRequest
+	req.Method = modified.Method
+	req.URL = modified.URL
+	req.Host = modified.Host
+	req.Header = modified.Header.Clone()
+	req.Body = modified.Body
+	req.GetBody = modified.GetBody
+	req.TransferEncoding = nil
+	req.ContentLength = 0
+
+	// the encapsulated body is kept in memory, so its length is known
+	if modified.GetBody != nil {
+		body, err := modified.GetBody()
+		if err != nil {
+			return err
+		}
+
+		req.ContentLength, _ = io.Copy(io.Discard, body)
+		req.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+
+	return err
+}
+
+// writeHTTPResponse writes the status, the headers and the body of the http response to the writer
+func writeHTTPResponse(w http.ResponseWriter, resp *http.Response) (err error) {
+	for header, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(header, value)
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	if resp.Body == nil {
+		return nil
+	}
+
+	defer func() {
+		err = errors.Join(err, resp.Body.Close())
+	}()
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
 }
 
 // getStatusWithCode prepares the status code and status text from two given strings
@@ -148,10 +575,11 @@ func setEncapsulatedHeaderValue(icapReqStr string, httpReqStr, httpRespStr strin
 			reqEndsAt = reqIndices[0][1]
 
 			switch {
-			// indicating there is a body present for the request block, as length would have been 1 for a single match of \r\n\r\n
-			case len(reqIndices) > 1:
+			// indicating there is a body present for the request block, as something follows the first match of \r\n\r\n,
+			// a body delimited by its length doesn't end with one
+			case reqEndsAt < len(httpReqStr):
 				encVal += fmt.Sprintf(", req-body=%d", reqIndices[0][1]) // assigning the starting point of the body
-				reqEndsAt = reqIndices[1][1]
+				reqEndsAt = len(httpReqStr)
 			case httpRespStr == "":
 				encVal += fmt.Sprintf(", null-body=%d", reqIndices[0][1])
 			}
@@ -167,7 +595,7 @@ func setEncapsulatedHeaderValue(icapReqStr string, httpReqStr, httpRespStr strin
 			encVal += fmt.Sprintf("res-hdr=%d", reqEndsAt)
 
 			switch {
-			case len(respIndices) > 1:
+			case respIndices[0][1] < len(httpRespStr):
 				encVal += fmt.Sprintf(", res-body=%d", reqEndsAt+respIndices[0][1])
 			default:
 				encVal += fmt.Sprintf(", null-body=%d", reqEndsAt+respIndices[0][1])
@@ -180,7 +608,7 @@ func setEncapsulatedHeaderValue(icapReqStr string, httpReqStr, httpRespStr strin
 	return fmt.Sprintf(icapReqStr, encVal)
 }
 
-// replaceRequestURIWithActualURL replaces just the escaped portion of the url with the entire URL in the dumped request message
+// replaceRequestURIWithActualURL replaces just the request uri, the escaped path and the query, with the entire URL in the dumped request message
 func replaceRequestURIWithActualURL(str string, uri, url string) string {
 	if uri == "" {
 		uri = "/"
@@ -219,6 +647,17 @@ func bodyIsChunked(str string) bool {
 	return regexp.MustCompile(`\r\n0(\r\n)+$`).MatchString(bodyStr)
 }
 
+// responseBodyIsChunked determines if the dumped http response body is already chunked,
+// a response of unknown length without transfer encoding is dumped as is up to the end of its body,
+// so it's never chunked even if the body happens to end like the last chunk
+func responseBodyIsChunked(resp *http.Response, str string) bool {
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		return false
+	}
+
+	return bodyIsChunked(str)
+}
+
 // parsePreviewBodyBytes parses the preview portion of the body and only keeps that in the message
 func parsePreviewBodyBytes(str string, pb int) string {
 	headerStr, bodyStr, ok := splitBodyAndHeader(str)
@@ -226,6 +665,9 @@ func parsePreviewBodyBytes(str string, pb int) string {
 		return str
 	}
 
+	// the preview can't be longer than the body itself
+	pb = min(max(pb, 0), len(bodyStr))
+
 	return headerStr + doubleCRLF + bodyStr[:pb]
 }
 
@@ -234,7 +676,12 @@ func parsePreviewBodyBytes(str string, pb int) string {
 // b
 // Hello World
 // 0
+// and an empty body becomes the last chunk only
 func addHexBodyByteNotations(str string) string {
+	if str == "" {
+		return "0" + doubleCRLF
+	}
+
 	return fmt.Sprintf("%x%s%s%s", len([]byte(str)), crlf, str, bodyEndIndicator)
 }
 
@@ -243,14 +690,122 @@ func addHeaderAndBody(headerStr, bodyStr string) string {
 	return headerStr + doubleCRLF + bodyStr
 }
 
+// frameBody frames the body of the dumped http message as the framing determines, it's either chunked
+// or sent as is with the Content-Length header set to its length. It reports if the body is delimited by its length,
+// so the message must not be padded after it
+func frameBody(str string, framing BodyFraming) (string, bool) {
+	headerStr, bodyStr, ok := splitBodyAndHeader(str)
+	if !ok {
+		return str, false
+	}
+
+	if framing == BodyFramingContentLength {
+		return addHeaderAndBody(setContentLength(headerStr, len(bodyStr)), bodyStr), true
+	}
+
+	return addHeaderAndBody(headerStr, addHexBodyByteNotations(bodyStr)), false
+}
+
+// setContentLength replaces the Content-Length header in the header block of the dumped http message
+func setContentLength(headerStr string, length int) string {
+	lines := strings.Split(headerStr, crlf)
+	lines = slices.DeleteFunc(lines, func(line string) bool {
+		name, _, found := strings.Cut(line, ":")
+		return found && strings.EqualFold(strings.TrimSpace(name), "Content-Length")
+	})
+
+	return strings.Join(append(lines, fmt.Sprintf("Content-Length: %d", length)), crlf)
+}
+
+// stripEmptyBody removes the body of the dumped http message if it's empty, a chunked one then consists of the last chunk only,
+// so the message is encapsulated with a null-body instead of a body chunk
+func stripEmptyBody(str string) string {
+	headerStr, bodyStr, found := strings.Cut(str, doubleCRLF)
+	if !found || (bodyStr != "" && bodyStr != "0"+doubleCRLF) {
+		return str
+	}
+
+	return headerStr + doubleCRLF
+}
+
+// trimHeaderOnlyMessage removes the blank lines which trail the header block of a http message declaring no body,
+// they would be taken for a body otherwise and shift the offsets of the Encapsulated header
+func trimHeaderOnlyMessage(str string) string {
+	headerStr, bodyStr, found := strings.Cut(str, doubleCRLF)
+	if !found || bodyStr == "" || strings.Trim(bodyStr, crlf) != "" {
+		return str
+	}
+
+	hdr, ok := encapsulatedMIMEHeader(headerStr + doubleCRLF)
+	if !ok || encapsulatedIsChunked(hdr) {
+		return str
+	}
+
+	if contentLength, ok := encapsulatedContentLength(headerStr + doubleCRLF); ok && contentLength > 0 {
+		return str
+	}
+
+	return headerStr + doubleCRLF
+}
+
+// stripAutoAcceptEncoding removes the Accept-Encoding: gzip header the http stack adds from the header block of the dumped request
+func stripAutoAcceptEncoding(str string) string {
+	headerStr, bodyStr, found := strings.Cut(str, doubleCRLF)
+	headerStr = strings.Replace(headerStr+crlf, crlf+"Accept-Encoding: gzip"+crlf, crlf, 1)
+
+	if !found {
+		return headerStr
+	}
+
+	return headerStr + crlf + bodyStr
+}
+
+// stripHeaders removes the lines of the named headers from the header block of the dumped http message,
+// the names are matched case-insensitively
+func stripHeaders(str string, names []string) string {
+	if len(names) == 0 {
+		return str
+	}
+
+	headerStr, bodyStr, found := strings.Cut(str, doubleCRLF)
+	lines := strings.Split(headerStr, crlf)
+	kept := lines[:1]
+
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		if !slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, strings.TrimSpace(name)) }) {
+			kept = append(kept, line)
+		}
+	}
+
+	headerStr = strings.Join(kept, crlf)
+	if !found {
+		return headerStr
+	}
+
+	return headerStr + doubleCRLF + bodyStr
+}
+
+// escapePercentSigns escapes the percent signs of the string, so it can be used safely as part of a format string
+func escapePercentSigns(str string) string {
+	return strings.ReplaceAll(str, "%", "%%")
+}
+
 // toICAPRequest returns the given request in its ICAP/1.x wire
 func toICAPRequest(req Request) ([]byte, error) {
+	// the raw url is used as is, if provided by the user
+	reqURL := req.URL.String()
+	if req.rawURL != "" {
+		reqURL = req.rawURL
+	}
+
 	// Making the ICAP message block
-	reqStr := fmt.Sprintf("%s %s %s%s", req.Method, req.URL.String(), icapVersion, crlf)
+	// the message block is used as a format string later on, so the percent signs must be escaped
+	reqStr := fmt.Sprintf("%s %s %s%s", req.Method, escapePercentSigns(reqURL), icapVersion, crlf)
 
 	for headerName, values := range req.Header {
 		for _, value := range values {
-			reqStr += fmt.Sprintf("%s: %s%s", headerName, value, crlf)
+			reqStr += fmt.Sprintf("%s: %s%s", escapePercentSigns(headerName), escapePercentSigns(value), crlf)
 		}
 	}
 
@@ -258,17 +813,62 @@ func toICAPRequest(req Request) ([]byte, error) {
 	reqStr += "Encapsulated: %s" + crlf
 	reqStr += crlf
 
+	// the raw encapsulated body is sent without any http message wrapping it
+	if req.rawBodyKind != "" {
+		if len(req.rawBody) == 0 {
+			return []byte(fmt.Sprintf(reqStr, " null-body=0")), nil
+		}
+
+		body := addHexBodyByteNotations(string(req.rawBody)) + crlf + string(req.bodyTerminator)
+
+		return []byte(fmt.Sprintf(reqStr, fmt.Sprintf(" %s=0", req.rawBodyKind)) + body), nil
+	}
+
 	// build the HTTP Request message block
 	httpReqStr := ""
+	reqLengthFramed := false
 	if req.HTTPRequest != nil {
-		b, err := httputil.DumpRequestOut(req.HTTPRequest, true)
+		// the Expect header is meant for the origin server, it's meaningless to the ICAP server, so it's stripped
+		httpReq := *req.HTTPRequest
+		httpReq.Header = req.HTTPRequest.Header.Clone()
+		httpReq.Header.Del("Expect")
+
+		// a body which can be replayed is sent from its start, so every attempt of the request sends the complete body
+		if req.HTTPRequest.GetBody != nil {
+			body, err := req.HTTPRequest.GetBody()
+			if err != nil {
+				return nil, err
+			}
+
+			httpReq.Body = body
+		}
+
+		b, err := httputil.DumpRequestOut(&httpReq, true)
+
+		// dumping restores the body it consumed on the copy only, a replayable body is left untouched
+		if req.HTTPRequest.GetBody == nil {
+			req.HTTPRequest.Body = httpReq.Body
+		}
 
 		if err != nil {
 			return nil, err
 		}
 
-		httpReqStr += string(b)
-		httpReqStr = replaceRequestURIWithActualURL(httpReqStr, req.HTTPRequest.URL.EscapedPath(), req.HTTPRequest.URL.String())
+		httpReqStr += stripEmptyBody(string(b))
+		httpReqStr = replaceRequestURIWithActualURL(httpReqStr, req.HTTPRequest.URL.RequestURI(), req.HTTPRequest.URL.String())
+
+		// the http stack adds the header only if the request has none
+		if req.noAutoAcceptEncoding && req.HTTPRequest.Header.Get("Accept-Encoding") == "" {
+			httpReqStr = stripAutoAcceptEncoding(httpReqStr)
+		}
+
+		httpReqStr = stripHeaders(httpReqStr, req.removedHTTPHeaders)
+
+		if req.rewriteHTTPRequest != nil {
+			httpReqStr = string(req.rewriteHTTPRequest([]byte(httpReqStr)))
+		}
+
+		httpReqStr = trimHeaderOnlyMessage(httpReqStr)
 
 		if req.Method == MethodREQMOD {
 			if req.previewSet {
@@ -276,18 +876,14 @@ func toICAPRequest(req Request) ([]byte, error) {
 			}
 
 			if !bodyIsChunked(httpReqStr) {
-				headerStr, bodyStr, ok := splitBodyAndHeader(httpReqStr)
-				if ok {
-					bodyStr = addHexBodyByteNotations(bodyStr)
-					httpReqStr = addHeaderAndBody(headerStr, bodyStr)
-				}
+				httpReqStr, reqLengthFramed = frameBody(httpReqStr, req.bodyFraming)
 			}
 
 		}
 
 		// if the HTTP Request message block doesn't end with a \r\n\r\n,
 		// then going to add one by force for better calculation of byte offsets
-		if httpReqStr != "" {
+		if httpReqStr != "" && !reqLengthFramed {
 			for !strings.HasSuffix(httpReqStr, doubleCRLF) {
 				httpReqStr += crlf
 			}
@@ -297,28 +893,68 @@ func toICAPRequest(req Request) ([]byte, error) {
 
 	// build the HTTP Response message block
 	httpRespStr := ""
+	respLengthFramed := false
+	streamed := req.streamedBody()
 	if req.HTTPResponse != nil {
-		b, err := httputil.DumpResponse(req.HTTPResponse, true)
+		httpResp := req.HTTPResponse
+
+		var b []byte
+		var err error
+
+		switch seeker, ok := httpResp.Body.(io.Seeker); {
+		case req.previewSeeker != nil:
+			// only the preview of a body which can seek is held in memory, it's sent with its size as the Content-Length
+			respCopy := *httpResp
+			respCopy.ContentLength = req.seekableSize
+			b, err = httputil.DumpResponse(&respCopy, false)
+			b = append(b, req.previewHead...)
+		case streamed != nil:
+			// a body which can seek and isn't previewed is streamed from its start after the message, it's sent with its size as the Content-Length
+			size, err := streamed.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := streamed.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+
+			respCopy := *httpResp
+			respCopy.ContentLength = size
+			b, err = httputil.DumpResponse(&respCopy, false)
+			if err != nil {
+				return nil, err
+			}
+		case ok:
+			// a body which can seek, like a file, is sent from its start, so every attempt of the request sends the complete body
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+
+			// dumping replaces and closes the body it consumed, the seekable one is kept open for the next attempt
+			respCopy := *httpResp
+			respCopy.Body = io.NopCloser(httpResp.Body)
+			b, err = httputil.DumpResponse(&respCopy, true)
+		default:
+			b, err = httputil.DumpResponse(httpResp, true)
+		}
 
 		if err != nil {
 			return nil, err
 		}
 
-		httpRespStr += string(b)
+		httpRespStr += stripEmptyBody(string(b))
+		httpRespStr = stripHeaders(httpRespStr, req.removedHTTPHeaders)
 
 		if req.previewSet {
 			httpRespStr = parsePreviewBodyBytes(httpRespStr, req.PreviewBytes)
 		}
 
-		if !bodyIsChunked(httpRespStr) {
-			headerStr, bodyStr, ok := splitBodyAndHeader(httpRespStr)
-			if ok {
-				bodyStr = addHexBodyByteNotations(bodyStr)
-				httpRespStr = addHeaderAndBody(headerStr, bodyStr)
-			}
+		if streamed == nil && !responseBodyIsChunked(req.HTTPResponse, httpRespStr) {
+			httpRespStr, respLengthFramed = frameBody(httpRespStr, req.bodyFraming)
 		}
 
-		if httpRespStr != "" && !strings.HasSuffix(httpRespStr, doubleCRLF) { // if the HTTP Response message block doesn't end with a \r\n\r\n, then going to add one by force for better calculation of byte offsets
+		if httpRespStr != "" && !respLengthFramed && !strings.HasSuffix(httpRespStr, doubleCRLF) { // if the HTTP Response message block doesn't end with a \r\n\r\n, then going to add one by force for better calculation of byte offsets
 			httpRespStr += crlf
 		}
 
@@ -326,6 +962,9 @@ func toICAPRequest(req Request) ([]byte, error) {
 
 	if encVal := req.Header.Get(encapsulatedHeader); encVal != "" {
 		reqStr = fmt.Sprintf(reqStr, encVal)
+	} else if streamed != nil {
+		// the streamed body follows the headers of the response, only its offset matters for the Encapsulated header
+		reqStr = setEncapsulatedHeaderValue(reqStr, httpReqStr, httpRespStr+"0"+doubleCRLF)
 	} else {
 		//populating the Encapsulated header of the ICAP message portion
 		reqStr = setEncapsulatedHeaderValue(reqStr, httpReqStr, httpRespStr)
@@ -342,25 +981,425 @@ func toICAPRequest(req Request) ([]byte, error) {
 
 	data := []byte(reqStr + httpReqStr + httpRespStr)
 
+	// the terminator follows the complete body, a preview which doesn't hold the whole body is continued later on,
+	// as is a streamed body
+	if encapsulatesBody(reqStr) && streamed == nil && (!req.previewSet || req.bodyFittedInPreview) {
+		data = append(data, req.bodyTerminator...)
+	}
+
 	return data, nil
 }
 
-// toClientResponse reads an ICAP message and returns a Response
-func toClientResponse(b *bufio.Reader) (Response, error) {
+// encapsulatesBody determines if the Encapsulated header of the ICAP message block declares a body
+func encapsulatesBody(icapReqStr string) bool {
+	hdr, ok := encapsulatedMIMEHeader(icapReqStr)
+	if !ok {
+		return false
+	}
+
+	entities, _ := encapsulatedOffsets(hdr.Get(encapsulatedHeader))
+
+	return slices.ContainsFunc(entities, func(entity string) bool {
+		return entity != "null-body" && strings.HasSuffix(entity, "-body")
+	})
+}
+
+// headerLimits bounds the header lines of a response, so a malicious server can't exhaust the memory with them,
+// a limit of 0 or less means no limit
+type headerLimits struct {
+	// maxBytes caps the bytes of all header lines of the response, including the encapsulated http headers and the trailers
+	maxBytes int
+	// maxLine caps the bytes of a single line, the chunk size lines included
+	maxLine int
+	// maxChunks caps the amount of chunks of a chunked body
+	maxChunks int
+	// read is the amount of header bytes read so far
+	read int
+}
+
+// readHeaderLine reads a header line, which counts towards the limit of all header bytes as well
+func (l *headerLimits) readHeaderLine(b *bufio.Reader) (string, error) {
+	line, err := l.readLine(b, true)
+	l.read += len(line)
+
+	return line, err
+}
+
+// readLine reads a line up to and including the line feed, without ever buffering more than the limits allow
+func (l *headerLimits) readLine(b *bufio.Reader, counted bool) (string, error) {
+	var line []byte
+
+	for {
+		fragment, err := b.ReadSlice('\n')
+		line = append(line, fragment...)
+
+		if l.maxLine > 0 && len(line) > l.maxLine {
+			return "", fmt.Errorf("%w: line exceeds %d bytes", ErrHeaderTooLarge, l.maxLine)
+		}
+
+		if counted && l.maxBytes > 0 && l.read+len(line) > l.maxBytes {
+			return "", fmt.Errorf("%w: headers exceed %d bytes", ErrHeaderTooLarge, l.maxBytes)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		return string(line), err
+	}
+}
+
+// readHTTPHeaders reads the header block of an encapsulated http message, starting with the already read first line,
+// up to and including the crlf which terminates it
+func readHTTPHeaders(firstLine string, b *bufio.Reader, limits *headerLimits) (string, error) {
+	httpMsg := strings.TrimSpace(firstLine) + crlf
+
+	for {
+		currentMsg, err := limits.readHeaderLine(b)
+		if errors.Is(err, ErrHeaderTooLarge) {
+			return "", err
+		}
+
+		if currentMsg == "" && err != nil {
+			// the buffer ended with one last message instead of a crlf
+			return httpMsg + crlf, nil
+		}
+
+		httpMsg += strings.TrimRight(currentMsg, crlf) + crlf
+
+		if currentMsg == crlf || currentMsg == lf {
+			return httpMsg, nil
+		}
+	}
+}
+
+// readChunkedBody reads and decodes a chunked encapsulated body, chunk by chunk according to the chunk sizes,
+// including the last chunk, the trailer fields which follow it and the crlf which terminates the body.
+// The trailer is nil if the body has no trailer fields
+func readChunkedBody(b *bufio.Reader, limits *headerLimits) ([]byte, http.Header, error) {
+	body := getBuffer()
+	defer putBuffer(body)
+
+	for chunks := 1; ; chunks++ {
+		sizeLine, err := limits.readLine(b, false)
+		if errors.Is(err, ErrHeaderTooLarge) {
+			return nil, nil, err
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: unterminated chunked body", ErrInvalidTCPMsg)
+		}
+
+		// the chunk extensions, for example, ieof, are not relevant for the size
+		chunkSize, _, _ := strings.Cut(strings.TrimSpace(sizeLine), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(chunkSize), 16, 64)
+		if err != nil || size < 0 {
+			return nil, nil, fmt.Errorf("%w: invalid chunk size: %s", ErrInvalidTCPMsg, sizeLine)
+		}
+
+		// the last chunk, the trailer fields of the encapsulated http message follow it up to the crlf which ends the chunked body
+		if size == 0 {
+			var trailer http.Header
+
+			for {
+				currentMsg, err := limits.readLine(b, false)
+				if errors.Is(err, ErrHeaderTooLarge) {
+					return nil, nil, err
+				}
+
+				if currentMsg == crlf || currentMsg == lf || err != nil {
+					return append([]byte{}, body.Bytes()...), trailer, nil
+				}
+
+				if name, value, found := strings.Cut(currentMsg, ":"); found && isHeaderName(strings.TrimSpace(name)) {
+					if trailer == nil {
+						trailer = make(http.Header)
+					}
+
+					trailer.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+				}
+			}
+		}
+
+		if limits.maxChunks > 0 && chunks > limits.maxChunks {
+			return nil, nil, fmt.Errorf("%w: more than %d chunks", ErrTooManyChunks, limits.maxChunks)
+		}
+
+		// the chunk is copied as it's read, a bogus size must not allocate the memory up front
+		if _, err := io.CopyN(body, b, size); err != nil {
+			return nil, nil, fmt.Errorf("%w: chunk shorter than its size", ErrInvalidTCPMsg)
+		}
+
+		// every chunk is followed by a crlf
+		if currentMsg, _ := b.ReadString('\n'); strings.TrimSpace(currentMsg) != "" {
+			return nil, nil, fmt.Errorf("%w: chunk longer than its size", ErrInvalidTCPMsg)
+		}
+	}
+}
+
+// readEncapsulatedBody reads the body of the encapsulated http message with the given header block along with its trailer,
+// some servers don't chunk it but frame it by the Content-Length of the http message, so exactly as many bytes are read then
+func readEncapsulatedBody(httpMsg string, b *bufio.Reader, limits *headerLimits) ([]byte, http.Header, error) {
+	contentLength, ok := encapsulatedContentLength(httpMsg)
+	if !ok || bodyIsChunkFramed(b, contentLength) {
+		return readChunkedBody(b, limits)
+	}
+
+	// the body is copied as it's read, a bogus length must not allocate the memory up front
+	body := getBuffer()
+	defer putBuffer(body)
+
+	if _, err := io.CopyN(body, b, contentLength); err != nil {
+		return nil, nil, fmt.Errorf("%w: body shorter than its Content-Length", ErrInvalidTCPMsg)
+	}
+
+	return bytes.Clone(body.Bytes()), nil, nil
+}
+
+// mergeTrailer fills the trailer the http message declared with the trailer fields received after its body
+func mergeTrailer(declared, received http.Header) http.Header {
+	if len(received) == 0 {
+		return declared
+	}
+
+	if declared == nil {
+		return received
+	}
+
+	for key, values := range received {
+		declared[key] = values
+	}
+
+	return declared
+}
+
+// encapsulatedContentLength returns the Content-Length of the header block of an encapsulated http message,
+// a chunked transfer encoding makes the length irrelevant
+func encapsulatedContentLength(httpMsg string) (int64, bool) {
+	hdr, ok := encapsulatedMIMEHeader(httpMsg)
+	if !ok {
+		return 0, false
+	}
+
+	if encapsulatedIsChunked(hdr) {
+		return 0, false
+	}
+
+	contentLength, err := strconv.ParseInt(strings.TrimSpace(hdr.Get("Content-Length")), 10, 64)
+	if err != nil || contentLength < 0 {
+		return 0, false
+	}
+
+	return contentLength, true
+}
+
+// encapsulatedMIMEHeader returns the headers of the header block of an encapsulated http message, without its first line
+func encapsulatedMIMEHeader(httpMsg string) (textproto.MIMEHeader, bool) {
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(httpMsg)))
+	if _, err := r.ReadLine(); err != nil {
+		return nil, false
+	}
+
+	hdr, err := r.ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return nil, false
+	}
+
+	return hdr, true
+}
+
+// encapsulatedIsChunked determines if the headers of an encapsulated http message declare a chunked transfer encoding
+func encapsulatedIsChunked(hdr textproto.MIMEHeader) bool {
+	return strings.Contains(strings.ToLower(hdr.Get("Transfer-Encoding")), "chunked")
+}
+
+// bodyIsChunkFramed determines if the body which follows is chunked even though its http message declares a length,
+// which is the case if it starts with a chunk size line that fits the declared length
+func bodyIsChunkFramed(b *bufio.Reader, contentLength int64) bool {
+	// the size line of the first chunk is short, even with chunk extensions like ieof.
+	// Only as many bytes as the length declares are sure to follow, more are only looked at if they're already buffered
+	peekLen := int(min(contentLength, 256))
+	_, _ = b.Peek(peekLen)
+	peeked, _ := b.Peek(max(peekLen, min(b.Buffered(), 256)))
+
+	sizeLine, _, found := bytes.Cut(peeked, []byte(lf))
+	if !found {
+		return false
+	}
+
+	chunkSize, _, _ := strings.Cut(strings.TrimSpace(string(sizeLine)), ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(chunkSize), 16, 64)
+
+	return err == nil && size >= 0 && size <= contentLength
+}
+
+// readEncapsulatedSections reads the encapsulated sections of the response in the declared order, exactly as the offsets
+// of the Encapsulated header delimit them: a header section spans up to the offset of the entity which follows it,
+// a body section belongs to the header section right before it and is framed by its chunks or the Content-Length of its message
+func readEncapsulatedSections(b *bufio.Reader, entities []string, offsets []int64, resp *Response, limits *headerLimits) error {
+	// the position is known up to the first body, the size of a chunked body is not declared
+	pos := int64(0)
+	httpMsg := ""
+	var reqBody, respBody []byte
+
+	for i, entity := range entities {
+		if pos >= 0 {
+			if offsets[i] < pos {
+				return fmt.Errorf("%w: %s at %d overlaps the section before it", ErrInvalidTCPMsg, entity, offsets[i])
+			}
+
+			// the gap between the sections is part of none of them
+			if _, err := io.CopyN(io.Discard, b, offsets[i]-pos); err != nil {
+				return fmt.Errorf("%w: %s at %d beyond the end of the message", ErrInvalidTCPMsg, entity, offsets[i])
+			}
+
+			pos = offsets[i]
+		}
+
+		var err error
+		switch entity {
+		case "req-hdr", "res-hdr":
+			if i+1 == len(entities) {
+				return fmt.Errorf("%w: %s is not followed by another entity", ErrInvalidTCPMsg, entity)
+			}
+
+			httpMsg, err = readHeaderSection(b, offsets[i+1]-offsets[i], limits)
+			if err != nil {
+				return err
+			}
+
+			if pos >= 0 {
+				pos = offsets[i+1]
+			}
+
+			// some servers terminate the lines of the http message with a bare LF, the http stack expects CRLF
+			normalized := normalizeLineEndings(httpMsg)
+			if entity == "req-hdr" {
+				resp.ContentRequest, err = http.ReadRequest(bufio.NewReader(strings.NewReader(normalized)))
+			} else {
+				resp.ContentResponse, err = http.ReadResponse(bufio.NewReader(strings.NewReader(normalized)), resp.ContentRequest)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		case "req-body", "res-body":
+			// a body without its header section is read as a chunked one
+			hdr := strings.Replace(entity, "-body", "-hdr", 1)
+			if i == 0 || entities[i-1] != hdr {
+				httpMsg = ""
+			}
+
+			body, trailer, err := readEncapsulatedBody(httpMsg, b, limits)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case httpMsg != "" && entity == "req-body":
+				reqBody = body
+				resp.ContentRequest.Body = io.NopCloser(bytes.NewReader(body))
+				resp.ContentRequest.GetBody = func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(body)), nil
+				}
+				resp.ContentRequest.Trailer = mergeTrailer(resp.ContentRequest.Trailer, trailer)
+			case httpMsg != "":
+				respBody = body
+				resp.ContentResponse.Body = io.NopCloser(bytes.NewReader(body))
+				resp.ContentResponse.Trailer = mergeTrailer(resp.ContentResponse.Trailer, trailer)
+			}
+
+			pos = -1
+		case "opt-body":
+			resp.OptBody, _, err = readChunkedBody(b, limits)
+			if err != nil {
+				return err
+			}
+
+			pos = -1
+		}
+
+		httpMsg = ""
+	}
+
+	// the response might have been declared before the request
+	if resp.ContentResponse != nil && resp.ContentRequest != nil {
+		resp.ContentResponse.Request = resp.ContentRequest
+	}
+
+	switch {
+	case resp.ContentResponse != nil:
+		resp.ContentLength = int64(len(respBody))
+	case resp.ContentRequest != nil:
+		resp.ContentLength = int64(len(reqBody))
+	}
+
+	return nil
+}
+
+// normalizeLineEndings terminates every line of the header block with a CRLF, the bare LFs included
+func normalizeLineEndings(httpMsg string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(httpMsg, crlf, lf), lf, crlf)
+}
+
+// readHeaderSection reads the header section of an encapsulated http message which spans exactly the given amount of bytes,
+// the section must end with the empty line which terminates the header block
+func readHeaderSection(b *bufio.Reader, size int64, limits *headerLimits) (string, error) {
+	var section strings.Builder
+
+	for int64(section.Len()) < size {
+		line, err := limits.readHeaderLine(b)
+		if errors.Is(err, ErrHeaderTooLarge) {
+			return "", err
+		}
+
+		section.WriteString(line)
+
+		if err != nil {
+			return "", fmt.Errorf("%w: header section shorter than its declared %d bytes", ErrInvalidTCPMsg, size)
+		}
+
+		if line == crlf || line == lf {
+			break
+		}
+	}
+
+	if str := section.String(); int64(len(str)) != size || !(strings.HasSuffix(str, lf+lf) || strings.HasSuffix(str, lf+crlf)) {
+		return "", fmt.Errorf("%w: header section doesn't end at its declared %d bytes", ErrInvalidTCPMsg, size)
+	}
+
+	return section.String(), nil
+}
+
+// toClientResponse reads an ICAP message and returns a Response, the header lines of the message are bounded by the limits
+func toClientResponse(b *bufio.Reader, limits headerLimits) (Response, error) {
 	resp := Response{
-		Header: make(map[string][]string),
+		Header:        make(map[string][]string),
+		Trailer:       make(map[string][]string),
+		ContentLength: -1,
 	}
 
 	scheme := ""
-	httpMsg := ""
-	for currentMsg, err := b.ReadString('\n'); err == nil || currentMsg != ""; currentMsg, err = b.ReadString('\n') { // keep reading the buffer message which is the http response message
+	for { // keep reading the buffer message which is the http response message
+		currentMsg, err := limits.readHeaderLine(b)
+		if errors.Is(err, ErrHeaderTooLarge) {
+			return Response{}, err
+		}
+
+		if err != nil && currentMsg == "" {
+			break
+		}
 
-		// if the current message line if the first line of the message portion(request line)
-		if isRequestLine(currentMsg) {
-			ss := strings.Split(currentMsg, " ")
+		// if the current message line if the first line of the message portion(request line),
+		// the ICAP trailers follow the encapsulated body which is always the last portion of the message
+		if scheme != schemeICAPTrailer && isRequestLine(currentMsg) {
+			ss := strings.Split(strings.TrimRight(currentMsg, crlf), " ")
 
-			// must contain 3 words, for example, "ICAP/1.0 200 OK" or "GET /something HTTP/1.1"
-			if len(ss) < 3 {
+			// must contain 3 words, for example, "ICAP/1.0 200 OK" or "GET /something HTTP/1.1",
+			// the reason phrase of a status line might be empty though, for example, "HTTP/1.1 204"
+			if statusLine := ss[0] == icapVersion || ss[0] == httpVersion; len(ss) < 3 && !(statusLine && len(ss) == 2) {
 				return Response{}, fmt.Errorf("%w: %s", ErrInvalidTCPMsg, currentMsg)
 			}
 
@@ -378,64 +1417,121 @@ func toClientResponse(b *bufio.Reader) (Response, error) {
 
 			if ss[0] == httpVersion {
 				scheme = schemeHTTPResp
-				httpMsg = ""
 			}
 
 			// http request message scheme version should always be at the end,
 			// for example, GET /something HTTP/1.1
-			if strings.TrimSpace(ss[2]) == httpVersion {
+			if len(ss) > 2 && strings.TrimSpace(ss[2]) == httpVersion {
 				scheme = schemeHTTPReq
-				httpMsg = ""
 			}
 		}
 
-		// preparing the header for ICAP & contents for the HTTP messages below
-		if scheme == schemeICAP {
+		// preparing the header for ICAP & the trailers which follow the encapsulated message
+		if scheme == schemeICAP || scheme == schemeICAPTrailer {
+			// the end of the ICAP headers, the encapsulated sections follow at the offsets the Encapsulated header declares,
+			// everything after them are the ICAP trailers
+			if scheme == schemeICAP && (currentMsg == lf || currentMsg == crlf) {
+				if entities, offsets := encapsulatedOffsets(resp.Header.Get(encapsulatedHeader)); len(entities) > 0 {
+					if err := readEncapsulatedSections(b, entities, offsets, &resp, &limits); err != nil {
+						return Response{}, err
+					}
+
+					scheme = schemeICAPTrailer
+					continue
+				}
+			}
+
 			// ignore the CRLF and the LF, shouldn't be counted
 			if currentMsg == lf || currentMsg == crlf {
 				continue
 			}
 
 			header, val := getHeaderValue(currentMsg)
+			if scheme == schemeICAPTrailer {
+				resp.Trailer.Add(header, val)
+			}
+
 			if header == previewHeader {
 				pb, _ := strconv.Atoi(val)
 				resp.PreviewBytes = pb
 			}
 
 			resp.Header.Add(header, val)
+			resp.RawHeaders = append(resp.RawHeaders, HeaderField{Key: header, Value: val})
+		}
+
+		if scheme != schemeHTTPReq && scheme != schemeHTTPResp {
+			continue
+		}
+
+		// preparing the contents for the HTTP messages below
+		httpMsg, err := readHTTPHeaders(currentMsg, b, &limits)
+		if err != nil {
+			return Response{}, err
+		}
+
+		// without the Encapsulated header, whatever follows the header block of the http message is its body
+		var body []byte
+		var trailer http.Header
+		_, err = b.Peek(1)
+		bodyFollows := err == nil
+
+		if bodyFollows {
+			body, trailer, err = readEncapsulatedBody(httpMsg, b, &limits)
+			if err != nil {
+				return Response{}, err
+			}
 		}
 
 		if scheme == schemeHTTPReq {
-			httpMsg += strings.TrimSpace(currentMsg) + crlf
-			bufferEmpty := b.Buffered() == 0
+			request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(httpMsg)))
+			if err != nil {
+				return Response{}, err
+			}
 
-			// a crlf indicates the end of the HTTP message and the buffer check is just in case the buffer ended with one last message instead of a crlf
-			if currentMsg == crlf || bufferEmpty {
-				request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(httpMsg)))
-				if err != nil {
-					return Response{}, err
+			if bodyFollows {
+				request.Body = io.NopCloser(bytes.NewReader(body))
+				request.GetBody = func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(body)), nil
 				}
-				resp.ContentRequest = request
+				request.Trailer = mergeTrailer(request.Trailer, trailer)
+			}
 
-				continue
+			resp.ContentRequest = request
+
+			// the response might have been declared before the request
+			if resp.ContentResponse != nil {
+				resp.ContentResponse.Request = request
+			} else {
+				resp.ContentLength = int64(len(body))
 			}
 		}
 
 		if scheme == schemeHTTPResp {
-			httpMsg += strings.TrimSpace(currentMsg) + crlf
-			bufferEmpty := b.Buffered() == 0
-
-			if currentMsg == crlf || bufferEmpty {
-				response, err := http.ReadResponse(bufio.NewReader(strings.NewReader(httpMsg)), resp.ContentRequest)
-				if err != nil {
-					return Response{}, err
-				}
-				resp.ContentResponse = response
+			response, err := http.ReadResponse(bufio.NewReader(strings.NewReader(httpMsg)), resp.ContentRequest)
+			if err != nil {
+				return Response{}, err
+			}
 
-				continue
+			if bodyFollows {
+				response.Body = io.NopCloser(bytes.NewReader(body))
+				response.Trailer = mergeTrailer(response.Trailer, trailer)
 			}
+
+			resp.ContentResponse = response
+			resp.ContentLength = int64(len(body))
+		}
+
+		// everything after the body are the ICAP trailers
+		if bodyFollows {
+			scheme = schemeICAPTrailer
 		}
 	}
 
+	// the server didn't modify anything, even if it returned the content along with the 204
+	if resp.StatusCode == http.StatusNoContent {
+		resp.ContentLength = -1
+	}
+
 	return resp, nil
 }
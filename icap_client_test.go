@@ -4,20 +4,41 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // export private members for testing
 const (
 	ICAP100ContinueMsg = icap100ContinueMsg
 	DoubleCRLF         = doubleCRLF
-	ICAP204NoModsMsg   = icap204NoModsMsg
 )
 
+var SetSocketBuffers = setSocketBuffers
+
+// withoutRequestBody returns a copy of the http request without the body, the bodies are compared separately
+func withoutRequestBody(req *http.Request) http.Request {
+	r := *req
+	r.Body, r.GetBody = nil, nil
+	return r
+}
+
+// withoutResponseBody returns a copy of the http response without the body, the bodies are compared separately
+func withoutResponseBody(resp *http.Response) http.Response {
+	r := *resp
+	r.Body = nil
+	return r
+}
+
 func TestSetEncapsulatedHeaderValue(t *testing.T) {
 	type testSample struct {
 		icapReqStr  string
@@ -147,6 +168,10 @@ func TestAddHexaBodyByteNotations(t *testing.T) {
 			msg:    "This is another message. Alright bye!",
 			result: "25\r\nThis is another message. Alright bye!\r\n0\r\n",
 		},
+		{
+			msg:    "",
+			result: "0\r\n\r\n",
+		},
 	}
 
 	for _, sample := range sampleTable {
@@ -198,6 +223,15 @@ func TestParsePreviewBodyBytes(t *testing.T) {
 				"Pragma: no-cache\r\n\r\n" +
 				"I am posti",
 		},
+		{
+			previewBytes: 100,
+			httpMsg: "HTTP/1.1 200 OK\r\n" +
+				"Content-Length: 11\r\n\r\n" +
+				"Hello World",
+			result: "HTTP/1.1 200 OK\r\n" +
+				"Content-Length: 11\r\n\r\n" +
+				"Hello World",
+		},
 	}
 
 	for _, sample := range sampleTable {
@@ -232,6 +266,79 @@ func TestToICAPMessage(t *testing.T) {
 
 	})
 
+	t.Run("MethodOPTIONS with raw URL", func(t *testing.T) {
+		rawURL := "icap://localhost:1344/scan|av"
+
+		req, _ := NewRequest(context.Background(), MethodOPTIONS, rawURL, nil, nil)
+
+		icapRequest, err := toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if wanted, got := "OPTIONS icap://localhost:1344/scan%7Cav ICAP/1.0\r\n", string(icapRequest); !strings.HasPrefix(got, wanted) {
+			t.Logf("wanted prefix: %s, got: %s\n", wanted, got)
+			t.Fail()
+		}
+
+		if err := req.SetRawURL(rawURL); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		icapRequest, err = toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		wanted := "OPTIONS icap://localhost:1344/scan|av ICAP/1.0\r\n" +
+			"Encapsulated:  null-body=0\r\n\r\n"
+
+		if got := string(icapRequest); wanted != got {
+			t.Logf("wanted: %s, got: %s\n", wanted, got)
+			t.Fail()
+		}
+	})
+
+	t.Run("MethodOPTIONS with raw opt-body", func(t *testing.T) {
+		req, _ := NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1344/something", nil, nil)
+
+		if err := req.SetRawEncapsulatedBody("opt-body", []byte("<policy/>")); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		icapRequest, err := toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		wanted := "OPTIONS icap://localhost:1344/something ICAP/1.0\r\n" +
+			"Encapsulated:  opt-body=0\r\n\r\n" +
+			"9\r\n" +
+			"<policy/>\r\n" +
+			"0\r\n\r\n"
+
+		if got := string(icapRequest); wanted != got {
+			t.Logf("wanted: %s, got: %s\n", wanted, got)
+			t.Fail()
+		}
+
+		if err := req.SetRawEncapsulatedBody("http-body", nil); !errors.Is(err, ErrInvalidEncapsulatedKind) {
+			t.Logf("Wanted error: %v, got: %v", ErrInvalidEncapsulatedKind, err)
+			t.Fail()
+		}
+
+		// the kind must fit the method
+		for _, kind := range []string{"req-body", "res-body"} {
+			if err := req.SetRawEncapsulatedBody(kind, nil); !errors.Is(err, ErrInvalidEncapsulatedKind) {
+				t.Errorf("Wanted error: %v for %s, got: %v", ErrInvalidEncapsulatedKind, kind, err)
+			}
+		}
+
+		if err := req.SetMethod(MethodREQMOD); err == nil || !errors.Is(err, ErrInvalidEncapsulatedKind) {
+			t.Errorf("Wanted error: %v when the method doesn't fit the raw body, got: %v", ErrInvalidEncapsulatedKind, err)
+		}
+	})
+
 	t.Run("MethodREQMOD", func(t *testing.T) { // FIXME: add proper wanted string and complete this unit test
 		httpReq, _ := http.NewRequest(http.MethodGet, "http://someurl.com", nil)
 
@@ -329,6 +436,291 @@ func TestToICAPMessage(t *testing.T) {
 			t.Fail()
 		}
 	})
+
+	t.Run("MethodREQMOD with Expect header", func(t *testing.T) {
+		httpReq, _ := http.NewRequest(http.MethodPost, "http://someurl.com", strings.NewReader("Hello World"))
+		httpReq.Header.Set("Expect", "100-continue")
+
+		req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+
+		icapRequest, err := toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if got := string(icapRequest); strings.Contains(got, "Expect:") || !strings.Contains(got, "Hello World") {
+			t.Errorf("Wanted the Expect header to be stripped from the encapsulated request, got: \n%s", got)
+		}
+
+		// the source request is left untouched
+		if httpReq.Header.Get("Expect") != "100-continue" {
+			t.Error("Wanted the Expect header of the source request to be kept")
+		}
+
+		if body, _ := io.ReadAll(httpReq.Body); string(body) != "Hello World" {
+			t.Errorf("Wanted the body of the source request to be kept, got: %s", string(body))
+		}
+	})
+
+	t.Run("header-only request with trailing CRLFs", func(t *testing.T) {
+		httpReq, _ := http.NewRequest(http.MethodGet, "http://someurl.com/", nil)
+
+		req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+		req.rewriteHTTPRequest = func(dumped []byte) []byte {
+			return append(dumped, "\r\n\r\n\r\n"...)
+		}
+
+		icapRequest, err := toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		httpReqStr := "GET http://someurl.com/ HTTP/1.1\r\n" +
+			"Host: someurl.com\r\n" +
+			"User-Agent: Go-http-client/1.1\r\n" +
+			"Accept-Encoding: gzip\r\n\r\n"
+
+		wanted := "REQMOD icap://localhost:1344/something ICAP/1.0\r\n" +
+			"Encapsulated:  req-hdr=0, null-body=" + strconv.Itoa(len(httpReqStr)) + "\r\n\r\n" +
+			httpReqStr
+
+		if got := string(icapRequest); wanted != got {
+			t.Errorf("wanted: \n%q\ngot: \n%q\n", wanted, got)
+		}
+	})
+
+	t.Run("request body of CRLFs", func(t *testing.T) {
+		httpReq, _ := http.NewRequest(http.MethodPost, "http://someurl.com/", strings.NewReader("\r\n\r\n"))
+
+		req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+
+		icapRequest, err := toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if got := string(icapRequest); !strings.Contains(got, ", req-body=") || !strings.HasSuffix(got, "4\r\n\r\n\r\n\r\n0\r\n\r\n") {
+			t.Errorf("Wanted the body of CRLFs to be kept, got: \n%q", got)
+		}
+	})
+
+	t.Run("removed http headers", func(t *testing.T) {
+		httpReq, _ := http.NewRequest(http.MethodGet, "http://someurl.com", nil)
+		httpReq.Header.Set("Authorization", "Bearer secret")
+		httpReq.Header.Set("Accept", "text/html")
+
+		httpResp := &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Set-Cookie":   []string{"session=secret"},
+				"Content-Type": []string{"text/plain"},
+			},
+			ContentLength: 11,
+			Body:          io.NopCloser(strings.NewReader("Hello World")),
+		}
+
+		req, _ := NewRequest(context.Background(), MethodRESPMOD, "icap://localhost:1344/something", httpReq, httpResp)
+		req.RemoveHTTPHeader("authorization")
+		req.RemoveHTTPHeader("Set-Cookie")
+		req.RemoveHTTPHeader("User-Agent")
+
+		icapRequest, err := toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		got := string(icapRequest)
+		for _, removed := range []string{"Authorization:", "Set-Cookie:", "User-Agent:"} {
+			if strings.Contains(got, removed) {
+				t.Errorf("Wanted the %s header to be absent from the wire, got: \n%s", removed, got)
+			}
+		}
+
+		if !strings.Contains(got, "\r\nAccept: text/html\r\n") || !strings.Contains(got, "\r\nContent-Type: text/plain\r\n") ||
+			!strings.Contains(got, "Hello World") {
+			t.Errorf("Wanted the other headers and the body to be kept, got: \n%s", got)
+		}
+
+		// the offsets are calculated on the stripped messages
+		_, encapsulated, _ := strings.Cut(got, doubleCRLF)
+		if !strings.Contains(got, "res-hdr="+strconv.Itoa(strings.Index(encapsulated, "HTTP/1.1 200 OK"))+",") {
+			t.Errorf("Wanted the encapsulated offsets to match the stripped messages, got: \n%s", got)
+		}
+
+		// the source messages are left untouched
+		if httpReq.Header.Get("Authorization") == "" || httpResp.Header.Get("Set-Cookie") == "" {
+			t.Error("Wanted the headers of the source messages to be kept")
+		}
+	})
+
+	t.Run("MethodRESPMOD with unknown content length", func(t *testing.T) {
+		// the body ends like the last chunk, but it's delimited by the end of the pipe only
+		pr, pw := io.Pipe()
+		go func() {
+			_, _ = pw.Write([]byte("Hello World\r\n"))
+			_, _ = pw.Write([]byte("0\r\n"))
+			_ = pw.Close()
+		}()
+
+		httpResp := &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Content-Type": []string{"text/plain"},
+			},
+			ContentLength: -1,
+			Body:          pr,
+		}
+
+		req, _ := NewRequest(context.Background(), MethodRESPMOD, "icap://localhost:1344/something", nil, httpResp)
+
+		icapRequest, err := toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		wanted := "RESPMOD icap://localhost:1344/something ICAP/1.0\r\n" +
+			"Encapsulated:  res-hdr=0, res-body=64\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\n" +
+			"Connection: close\r\n" +
+			"Content-Type: text/plain\r\n\r\n" +
+			"10\r\n" +
+			"Hello World\r\n0\r\n\r\n" +
+			"0\r\n\r\n"
+
+		got := string(icapRequest)
+
+		if wanted != got {
+			t.Logf("wanted: \n%q\ngot: \n%q\n", wanted, got)
+			t.Fail()
+		}
+	})
+
+	t.Run("Content-Length framing", func(t *testing.T) {
+		httpReq, _ := http.NewRequest(http.MethodPost, "http://someurl.com/upload", strings.NewReader("Hello World"))
+		httpReq.Header.Set("Content-Type", "text/plain")
+
+		httpResp := &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			ContentLength: -1,
+			Body:          io.NopCloser(strings.NewReader("Hello World")),
+		}
+
+		sampleTable := []struct {
+			name   string
+			req    Request
+			wanted string
+		}{
+			{
+				name: "REQMOD",
+				req: func() Request {
+					req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+					return req
+				}(),
+				wanted: "REQMOD icap://localhost:1344/something ICAP/1.0\r\n" +
+					"Encapsulated:  req-hdr=0, req-body=163\r\n\r\n" +
+					"POST http://someurl.com/upload HTTP/1.1\r\n" +
+					"Host: someurl.com\r\n" +
+					"User-Agent: Go-http-client/1.1\r\n" +
+					"Content-Type: text/plain\r\n" +
+					"Accept-Encoding: gzip\r\n" +
+					"Content-Length: 11\r\n\r\n" +
+					"Hello World",
+			},
+			{
+				// the length of the body is set, even though the origin didn't tell it
+				name: "RESPMOD",
+				req: func() Request {
+					req, _ := NewRequest(context.Background(), MethodRESPMOD, "icap://localhost:1344/something", nil, httpResp)
+					return req
+				}(),
+				wanted: "RESPMOD icap://localhost:1344/something ICAP/1.0\r\n" +
+					"Encapsulated:  res-hdr=0, res-body=84\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\n" +
+					"Connection: close\r\n" +
+					"Content-Type: text/plain\r\n" +
+					"Content-Length: 11\r\n\r\n" +
+					"Hello World",
+			},
+		}
+
+		for _, sample := range sampleTable {
+			sample.req.bodyFraming = BodyFramingContentLength
+
+			icapRequest, err := toICAPRequest(sample.req)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if got := string(icapRequest); got != sample.wanted {
+				t.Errorf("%s: wanted: \n%q\ngot: \n%q\n", sample.name, sample.wanted, got)
+			}
+		}
+	})
+
+	t.Run("MethodRESPMOD with empty body", func(t *testing.T) {
+		sampleTable := []struct {
+			name             string
+			contentLength    int64
+			transferEncoding []string
+			wanted           string
+		}{
+			{
+				name:          "content length",
+				contentLength: 0,
+				wanted: "RESPMOD icap://localhost:1344/something ICAP/1.0\r\n" +
+					"Encapsulated:  res-hdr=0, null-body=38\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\n" +
+					"Content-Length: 0\r\n\r\n",
+			},
+			{
+				name:             "chunked",
+				contentLength:    -1,
+				transferEncoding: []string{"chunked"},
+				wanted: "RESPMOD icap://localhost:1344/something ICAP/1.0\r\n" +
+					"Encapsulated:  res-hdr=0, null-body=47\r\n\r\n" +
+					"HTTP/1.1 200 OK\r\n" +
+					"Transfer-Encoding: chunked\r\n\r\n",
+			},
+		}
+
+		for _, sample := range sampleTable {
+			httpResp := &http.Response{
+				Status:           "200 OK",
+				StatusCode:       http.StatusOK,
+				Proto:            "HTTP/1.1",
+				ProtoMajor:       1,
+				ProtoMinor:       1,
+				Header:           http.Header{},
+				ContentLength:    sample.contentLength,
+				TransferEncoding: sample.transferEncoding,
+				Body:             io.NopCloser(strings.NewReader("")),
+			}
+
+			req, _ := NewRequest(context.Background(), MethodRESPMOD, "icap://localhost:1344/something", nil, httpResp)
+
+			icapRequest, err := toICAPRequest(req)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if got := string(icapRequest); got != sample.wanted {
+				t.Errorf("%s: wanted: \n%q\ngot: \n%q\n", sample.name, sample.wanted, got)
+			}
+		}
+	})
 }
 
 func TestToClientResponse(t *testing.T) {
@@ -341,6 +733,7 @@ func TestToClientResponse(t *testing.T) {
 			previewBytes int
 			respStr      string
 			httpReqStr   string
+			body         string
 		}
 
 		sampleTable := []testSample{
@@ -366,6 +759,7 @@ func TestToClientResponse(t *testing.T) {
 					"Accept: text/html, text/plain, image/gif\r\n" +
 					"Accept-Encoding: gzip, compress\r\n" +
 					"If-None-Match: \"xyzzy\", \"r2d2xxxx\"\r\n\r\n",
+				body: "",
 			},
 			{
 				headers: http.Header{
@@ -393,11 +787,12 @@ func TestToClientResponse(t *testing.T) {
 					"2d\r\n" +
 					"I am posting this information.  ICAP powered!\r\n" +
 					"0\r\n\r\n",
+				body: "I am posting this information.  ICAP powered!",
 			},
 		}
 
 		for _, sample := range sampleTable {
-			resp, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr + sample.httpReqStr)))
+			resp, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr+sample.httpReqStr)), headerLimits{})
 			if err != nil {
 				t.Fatal(err.Error())
 			}
@@ -432,7 +827,12 @@ func TestToClientResponse(t *testing.T) {
 				t.Fatal(err.Error())
 			}
 
-			if !reflect.DeepEqual(resp.ContentRequest, wantedHTTPReq) {
+			if body, _ := io.ReadAll(resp.ContentRequest.Body); string(body) != sample.body {
+				t.Logf("Wanted http request body: %s, got: %s", sample.body, string(body))
+				t.Fail()
+			}
+
+			if !reflect.DeepEqual(withoutRequestBody(resp.ContentRequest), withoutRequestBody(wantedHTTPReq)) {
 				t.Logf("Wanted http request: %v, got: %v", wantedHTTPReq, resp.ContentRequest)
 				t.Fail()
 			}
@@ -449,6 +849,7 @@ func TestToClientResponse(t *testing.T) {
 			previewBytes int
 			respStr      string
 			httpRespStr  string
+			body         string
 		}
 
 		sampleTable := []testSample{
@@ -457,7 +858,7 @@ func TestToClientResponse(t *testing.T) {
 					"Date":         []string{"Mon, 10 Jan 2000  09:55:21 GMT"},
 					"Server":       []string{"ICAP-Server-Software/1.0"},
 					"Istag":        []string{"\"W3E4R7U9-L2E4-2\""},
-					"Encapsulated": []string{"req-hdr=0, res-body=222"},
+					"Encapsulated": []string{"res-hdr=0, res-body=223"},
 				},
 				status:       "OK",
 				statusCode:   200,
@@ -467,22 +868,23 @@ func TestToClientResponse(t *testing.T) {
 					"Server: ICAP-Server-Software/1.0\r\n" +
 					"Connection: close\r\n" +
 					"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
-					"Encapsulated: req-hdr=0, res-body=222\r\n\r\n",
+					"Encapsulated: res-hdr=0, res-body=223\r\n\r\n",
 				httpRespStr: "HTTP/1.1 200 OK\r\n" +
 					"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
 					"Via: 1.0 icap.example.org (ICAP Example RespMod Service 1.1)\r\n" +
 					"Server: Apache/1.3.6 (Unix)\r\n" +
 					"ETag: \"63840-1ab7-378d415b\"\r\n" +
 					"Content-Type: text/plain\r\n" +
-					"Content-Length: 92\r\n\r\n" +
-					"5c\r\n" +
+					"Content-Length: 91\r\n\r\n" +
+					"5b\r\n" +
 					"This is data that was returned by an origin server, but with value added by an ICAP server.\r\n" +
 					"0\r\n\r\n",
+				body: "This is data that was returned by an origin server, but with value added by an ICAP server.",
 			},
 		}
 
 		for _, sample := range sampleTable {
-			resp, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr + sample.httpRespStr)))
+			resp, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr+sample.httpRespStr)), headerLimits{})
 			if err != nil {
 				t.Fatal(err.Error())
 			}
@@ -517,10 +919,1347 @@ func TestToClientResponse(t *testing.T) {
 				t.Fatal(err.Error())
 			}
 
-			if !reflect.DeepEqual(resp.ContentResponse, wantedHTTPResp) {
+			if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != sample.body {
+				t.Logf("Wanted http response body: %s, got: %s", sample.body, string(body))
+				t.Fail()
+			}
+
+			if !reflect.DeepEqual(withoutResponseBody(resp.ContentResponse), withoutResponseBody(wantedHTTPResp)) {
 				t.Logf("Wanted http response: %v, got: %v", wantedHTTPResp, resp.ContentResponse)
 				t.Fail()
 			}
 		}
 	})
 }
+
+func TestToClientResponseTrailer(t *testing.T) {
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+		"Server: ICAP-Server-Software/1.0\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"Encapsulated: res-hdr=0, res-body=132\r\n\r\n"
+	httpRespStr := "HTTP/1.1 200 OK\r\n" +
+		"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+		"Server: Apache/1.3.6 (Unix)\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Length: 12\r\n\r\n" +
+		"c\r\n" +
+		"Hello World!\r\n" +
+		"0\r\n\r\n"
+	trailerStr := "X-Infection-Found: Type=0; Resolution=2; Threat=EICAR;\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr+httpRespStr+trailerStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	wantedTrailer := []string{"Type=0; Resolution=2; Threat=EICAR;"}
+
+	if val, exists := resp.Trailer["X-Infection-Found"]; !exists || !reflect.DeepEqual(val, wantedTrailer) {
+		t.Logf("Wanted Trailer: %s with value: %v, got: %v", "X-Infection-Found", wantedTrailer, val)
+		t.Fail()
+	}
+
+	if val, exists := resp.Header["X-Infection-Found"]; !exists || !reflect.DeepEqual(val, wantedTrailer) {
+		t.Logf("Wanted Header: %s with value: %v, got: %v", "X-Infection-Found", wantedTrailer, val)
+		t.Fail()
+	}
+
+	wantedHTTPResp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(httpRespStr)), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != "Hello World!" {
+		t.Logf("Wanted http response body: %s, got: %s", "Hello World!", string(body))
+		t.Fail()
+	}
+
+	if !reflect.DeepEqual(withoutResponseBody(resp.ContentResponse), withoutResponseBody(wantedHTTPResp)) {
+		t.Logf("Wanted http response: %v, got: %v", wantedHTTPResp, resp.ContentResponse)
+		t.Fail()
+	}
+}
+
+func TestToClientResponseHTTPTrailer(t *testing.T) {
+	httpHdrStr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Trailer: X-Checksum\r\n\r\n"
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdrStr)) + "\r\n\r\n" +
+		httpHdrStr +
+		"b\r\n" +
+		"Hello World\r\n" +
+		"0\r\n" +
+		"X-Checksum: abc\r\n" +
+		"X-Scanned-By: test\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != "Hello World" {
+		t.Errorf("Wanted http response body: %s, got: %s", "Hello World", string(body))
+	}
+
+	wantedTrailer := http.Header{"X-Checksum": {"abc"}, "X-Scanned-By": {"test"}}
+	if !reflect.DeepEqual(resp.ContentResponse.Trailer, wantedTrailer) {
+		t.Errorf("Wanted http response trailer: %v, got: %v", wantedTrailer, resp.ContentResponse.Trailer)
+	}
+
+	if len(resp.Trailer) != 0 {
+		t.Errorf("Wanted no ICAP trailer, got: %v", resp.Trailer)
+	}
+
+	// without a trailer the declared one is kept as is
+	respStr = "ICAP/1.0 200 OK\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdrStr)) + "\r\n\r\n" +
+		httpHdrStr +
+		"b\r\n" +
+		"Hello World\r\n" +
+		"0\r\n\r\n"
+
+	resp, err = toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if val := resp.ContentResponse.Trailer.Get("X-Checksum"); val != "" {
+		t.Errorf("Wanted no value for the declared trailer, got: %s", val)
+	}
+}
+
+func TestToClientResponseEncapsulatedOrder(t *testing.T) {
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"Encapsulated: res-hdr=0, res-body=65, req-hdr=86, null-body=148\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Length: 11\r\n\r\n" +
+		"b\r\n" +
+		"Hello World\r\n" +
+		"0\r\n\r\n" +
+		"GET /origin-resource HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if resp.ContentResponse == nil {
+		t.Fatal("Wanted the http response declared first")
+	}
+
+	if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != "Hello World" {
+		t.Errorf("Wanted http response body: %s, got: %s", "Hello World", string(body))
+	}
+
+	if resp.ContentRequest == nil {
+		t.Fatal("Wanted the http request declared after the response body")
+	}
+
+	if resp.ContentRequest.Method != http.MethodGet || resp.ContentRequest.Host != "www.origin-server.com" {
+		t.Errorf("Wanted http request: GET www.origin-server.com, got: %s %s", resp.ContentRequest.Method, resp.ContentRequest.Host)
+	}
+
+	if resp.ContentResponse.Request != resp.ContentRequest {
+		t.Error("Wanted the http response to refer to the http request")
+	}
+
+	if len(resp.Trailer) != 0 {
+		t.Errorf("Wanted no ICAP trailers, got: %v", resp.Trailer)
+	}
+}
+
+func TestToClientResponseEncapsulatedLayouts(t *testing.T) {
+	httpReqStr := "POST /origin-resource/form.pl HTTP/1.1\r\n" +
+		"Host: www.origin-server.com\r\n" +
+		"Content-Length: 11\r\n\r\n"
+	httpRespStr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Length: 11\r\n\r\n"
+	chunkedBody := "b\r\nHello World\r\n0\r\n\r\n"
+	reqLen, respLen := strconv.Itoa(len(httpReqStr)), strconv.Itoa(len(httpRespStr))
+
+	sampleTable := []struct {
+		name         string
+		encapsulated string
+		sections     string
+		reqBody      string
+		respBody     string
+		optBody      string
+		wantedReq    bool
+		wantedResp   bool
+		wantedErr    error
+	}{
+		{
+			name:         "req-hdr, null-body",
+			encapsulated: "req-hdr=0, null-body=" + reqLen,
+			sections:     httpReqStr,
+			wantedReq:    true,
+		},
+		{
+			name:         "req-hdr, req-body",
+			encapsulated: "req-hdr=0, req-body=" + reqLen,
+			sections:     httpReqStr + chunkedBody,
+			reqBody:      "Hello World",
+			wantedReq:    true,
+		},
+		{
+			name:         "res-hdr, null-body",
+			encapsulated: "res-hdr=0, null-body=" + respLen,
+			sections:     httpRespStr,
+			wantedResp:   true,
+		},
+		{
+			name:         "res-hdr, res-body",
+			encapsulated: "res-hdr=0, res-body=" + respLen,
+			sections:     httpRespStr + chunkedBody,
+			respBody:     "Hello World",
+			wantedResp:   true,
+		},
+		{
+			name:         "req-hdr, res-hdr, res-body",
+			encapsulated: "req-hdr=0, res-hdr=" + reqLen + ", res-body=" + strconv.Itoa(len(httpReqStr+httpRespStr)),
+			sections:     httpReqStr + httpRespStr + chunkedBody,
+			respBody:     "Hello World",
+			wantedReq:    true,
+			wantedResp:   true,
+		},
+		{
+			name:         "opt-body",
+			encapsulated: "opt-body=0",
+			sections:     chunkedBody,
+			optBody:      "Hello World",
+		},
+		{
+			name:         "null-body",
+			encapsulated: "null-body=0",
+		},
+		{
+			name:         "header section ending before its offset",
+			encapsulated: "res-hdr=0, res-body=" + strconv.Itoa(len(httpRespStr)+2),
+			sections:     httpRespStr + chunkedBody,
+			wantedErr:    ErrInvalidTCPMsg,
+		},
+		{
+			name:         "header section ending after its offset",
+			encapsulated: "res-hdr=0, res-body=" + strconv.Itoa(len(httpRespStr)-2),
+			sections:     httpRespStr + chunkedBody,
+			wantedErr:    ErrInvalidTCPMsg,
+		},
+		{
+			name:         "header section declared last",
+			encapsulated: "res-hdr=0",
+			sections:     httpRespStr,
+			wantedErr:    ErrInvalidTCPMsg,
+		},
+		{
+			name:         "offsets out of order",
+			encapsulated: "res-hdr=" + respLen + ", req-hdr=0, null-body=" + strconv.Itoa(len(httpReqStr+httpRespStr)),
+			sections:     httpReqStr + httpRespStr,
+			wantedErr:    ErrInvalidTCPMsg,
+		},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			respStr := "ICAP/1.0 200 OK\r\n" +
+				"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+				"Encapsulated: " + sample.encapsulated + "\r\n\r\n" +
+				sample.sections
+
+			resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+			if sample.wantedErr != nil || err != nil {
+				if !errors.Is(err, sample.wantedErr) {
+					t.Fatalf("Wanted error: %v, got: %v", sample.wantedErr, err)
+				}
+
+				return
+			}
+
+			if (resp.ContentRequest != nil) != sample.wantedReq || (resp.ContentResponse != nil) != sample.wantedResp {
+				t.Fatalf("Wanted http request: %v and http response: %v, got: %v and %v",
+					sample.wantedReq, sample.wantedResp, resp.ContentRequest, resp.ContentResponse)
+			}
+
+			if resp.ContentRequest != nil {
+				if resp.ContentRequest.URL.Path != "/origin-resource/form.pl" {
+					t.Errorf("Wanted the http request of the req-hdr section, got: %v", resp.ContentRequest.URL)
+				}
+
+				if body, _ := io.ReadAll(resp.ContentRequest.Body); string(body) != sample.reqBody {
+					t.Errorf("Wanted http request body: %q, got: %q", sample.reqBody, string(body))
+				}
+			}
+
+			if resp.ContentResponse != nil {
+				if resp.ContentResponse.Header.Get("Content-Type") != "text/plain" {
+					t.Errorf("Wanted the http response of the res-hdr section, got: %v", resp.ContentResponse.Header)
+				}
+
+				if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != sample.respBody {
+					t.Errorf("Wanted http response body: %q, got: %q", sample.respBody, string(body))
+				}
+
+				if resp.ContentRequest != nil && resp.ContentResponse.Request != resp.ContentRequest {
+					t.Error("Wanted the http response to refer to the http request")
+				}
+			}
+
+			if string(resp.OptBody) != sample.optBody {
+				t.Errorf("Wanted options body: %q, got: %q", sample.optBody, string(resp.OptBody))
+			}
+
+			if len(resp.Trailer) != 0 {
+				t.Errorf("Wanted no ICAP trailers, got: %v", resp.Trailer)
+			}
+		})
+	}
+}
+
+func TestToClientResponseLFOnlyHTTPMessage(t *testing.T) {
+	httpReqStr := "GET /origin-resource HTTP/1.1\n" +
+		"Host: www.origin-server.com\n\n"
+	httpRespStr := "HTTP/1.1 200 OK\n" +
+		"Content-Type: text/plain\n" +
+		"Content-Length: 11\n\n"
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"Encapsulated: req-hdr=0, res-hdr=" + strconv.Itoa(len(httpReqStr)) + ", res-body=" + strconv.Itoa(len(httpReqStr+httpRespStr)) + "\r\n\r\n" +
+		httpReqStr + httpRespStr +
+		"b\r\nHello World\r\n0\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if resp.ContentRequest == nil || resp.ContentRequest.Host != "www.origin-server.com" {
+		t.Errorf("Wanted the LF-only http request to be parsed, got: %v", resp.ContentRequest)
+	}
+
+	if resp.ContentResponse == nil {
+		t.Fatal("Wanted the LF-only http response to be parsed")
+	}
+
+	if ct := resp.ContentResponse.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Wanted Content-Type: text/plain, got: %q", ct)
+	}
+
+	if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != "Hello World" {
+		t.Errorf("Wanted http response body: Hello World, got: %s", string(body))
+	}
+}
+
+func TestToClientResponseHTTPReasonPhrase(t *testing.T) {
+	sampleTable := []struct {
+		name       string
+		statusLine string
+	}{
+		{name: "multi-word reason", statusLine: "HTTP/1.1 451 Unavailable For Legal Reasons"},
+		{name: "non-standard reason", statusLine: "HTTP/1.1 200 Fine  & Dandy"},
+		{name: "no reason", statusLine: "HTTP/1.1 204"},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			httpRespStr := sample.statusLine + "\r\n" +
+				"Content-Type: text/plain\r\n\r\n"
+			wanted := strings.TrimPrefix(sample.statusLine, "HTTP/1.1 ")
+
+			// the message is read by the Encapsulated offsets as well as without the header
+			for _, encapsulated := range []string{"Encapsulated: res-hdr=0, null-body=" + strconv.Itoa(len(httpRespStr)) + "\r\n", ""} {
+				respStr := "ICAP/1.0 200 OK\r\n" +
+					"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+					encapsulated + "\r\n" +
+					httpRespStr
+
+				resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				if resp.ContentResponse == nil {
+					t.Fatalf("Wanted the http response, encapsulated: %q", encapsulated)
+				}
+
+				if resp.ContentResponse.Status != wanted {
+					t.Errorf("Wanted http status: %q, got: %q, encapsulated: %q", wanted, resp.ContentResponse.Status, encapsulated)
+				}
+			}
+		})
+	}
+}
+
+func TestToClientResponseMaxChunks(t *testing.T) {
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"Encapsulated: res-hdr=0, res-body=47\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n" +
+		"1\r\na\r\n1\r\nb\r\n1\r\nc\r\n" +
+		"0\r\n\r\n"
+
+	if _, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{maxChunks: 3}); err != nil {
+		t.Errorf("Wanted the body of as many chunks as allowed to be read, got: %v", err)
+	}
+
+	if _, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{maxChunks: 2}); !errors.Is(err, ErrTooManyChunks) {
+		t.Errorf("Wanted error: %v, got: %v", ErrTooManyChunks, err)
+	}
+}
+
+func TestToClientResponseContentLengthBody(t *testing.T) {
+	sampleTable := []struct {
+		name    string
+		content string
+		body    string
+	}{
+		{
+			name:    "not chunked",
+			content: "This is a modified body",
+			body:    "This is a modified body",
+		},
+		{
+			name:    "not chunked, starting like a chunk size",
+			content: "add\r\nmore",
+			body:    "add\r\nmore",
+		},
+		{
+			name:    "chunked",
+			content: "17\r\nThis is a modified body\r\n0\r\n\r\n",
+			body:    "This is a modified body",
+		},
+	}
+
+	for _, sample := range sampleTable {
+		httpRespStr := "HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Content-Length: " + strconv.Itoa(len(sample.body)) + "\r\n\r\n"
+		respStr := "ICAP/1.0 200 OK\r\n" +
+			"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpRespStr)) + "\r\n\r\n"
+
+		resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr+httpRespStr+sample.content)), headerLimits{})
+		if err != nil {
+			t.Fatalf("%s: %s", sample.name, err.Error())
+		}
+
+		if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != sample.body {
+			t.Errorf("%s: Wanted body:%q, got:%q", sample.name, sample.body, string(body))
+		}
+	}
+}
+
+func TestResponseNextServices(t *testing.T) {
+	resp := Response{
+		Header: http.Header{
+			"X-Next-Services": []string{"icap://localhost:1344/av, icap://localhost:1344/dlp", "icap://localhost:1345/archive"},
+		},
+	}
+
+	wanted := []string{"icap://localhost:1344/av", "icap://localhost:1344/dlp", "icap://localhost:1345/archive"}
+
+	if got := resp.NextServices(); !reflect.DeepEqual(got, wanted) {
+		t.Logf("Wanted next services: %v, got: %v", wanted, got)
+		t.Fail()
+	}
+}
+
+func TestResponseEncapsulatedEntities(t *testing.T) {
+	resp := Response{
+		Header: http.Header{
+			"Encapsulated": []string{"req-hdr=0, res-hdr=137, res-body=296"},
+		},
+	}
+
+	wanted := []EncapEntry{
+		{Name: "req-hdr", Offset: 0},
+		{Name: "res-hdr", Offset: 137},
+		{Name: "res-body", Offset: 296},
+	}
+
+	if got := resp.EncapsulatedEntities(); !reflect.DeepEqual(got, wanted) {
+		t.Errorf("Wanted encapsulated entities: %v, got: %v", wanted, got)
+	}
+
+	if got := (&Response{Header: http.Header{}}).EncapsulatedEntities(); len(got) != 0 {
+		t.Errorf("Wanted no encapsulated entities without the header, got: %v", got)
+	}
+}
+
+func TestResponseOptions(t *testing.T) {
+	t.Run("present", func(t *testing.T) {
+		respStr := "ICAP/1.0 200 OK\r\n" +
+			"Methods: RESPMOD, REQMOD\r\n" +
+			"Service: FOO Tech Server 1.0\r\n" +
+			"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+			"Allow: 204\r\n" +
+			"Preview: 2048\r\n" +
+			"Transfer-Preview: *\r\n" +
+			"Transfer-Ignore: jpg,jpeg,gif\r\n" +
+			"Transfer-Complete: asp, bat, exe, com\r\n" +
+			"Max-Connections: 1000\r\n" +
+			"Options-TTL: 7200\r\n" +
+			"Encapsulated: null-body=0\r\n\r\n"
+
+		resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		wanted := ServiceOptions{
+			Methods:          []string{"RESPMOD", "REQMOD"},
+			Service:          "FOO Tech Server 1.0",
+			ISTag:            "W3E4R7U9-L2E4-2",
+			Allow:            []string{"204"},
+			Preview:          2048,
+			TransferPreview:  []string{"*"},
+			TransferComplete: []string{"asp", "bat", "exe", "com"},
+			TransferIgnore:   []string{"jpg", "jpeg", "gif"},
+			MaxConnections:   1000,
+			OptionsTTL:       2 * time.Hour,
+		}
+
+		if got := resp.Options(); !reflect.DeepEqual(got, wanted) {
+			t.Errorf("Wanted options:%+v, got:%+v", wanted, got)
+		}
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		resp := Response{Header: http.Header{"Methods": []string{"RESPMOD"}}}
+
+		opts := resp.Options()
+		if opts.Preview != -1 {
+			t.Errorf("Wanted no preview support, got:%d", opts.Preview)
+		}
+
+		if opts.MaxConnections != 0 {
+			t.Errorf("Wanted unlimited connections, got:%d", opts.MaxConnections)
+		}
+
+		if opts.OptionsTTL != DefaultOptionsTTL {
+			t.Errorf("Wanted the default options ttl:%v, got:%v", DefaultOptionsTTL, opts.OptionsTTL)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		resp := Response{Header: http.Header{
+			"Preview":         []string{"-1"},
+			"Max-Connections": []string{"many"},
+			"Options-TTL":     []string{"0"},
+		}}
+
+		opts := resp.Options()
+		if opts.Preview != -1 || opts.MaxConnections != 0 || opts.OptionsTTL != DefaultOptionsTTL {
+			t.Errorf("Wanted the malformed headers to be treated as absent, got:%+v", opts)
+		}
+	})
+
+	t.Run("configured default options ttl", func(t *testing.T) {
+		defaultTTL := DefaultOptionsTTL
+		t.Cleanup(func() { DefaultOptionsTTL = defaultTTL })
+		DefaultOptionsTTL = 5 * time.Minute
+
+		if got := (&Response{Header: http.Header{}}).Options().OptionsTTL; got != 5*time.Minute {
+			t.Errorf("Wanted the configured default options ttl:%v, got:%v", 5*time.Minute, got)
+		}
+	})
+}
+
+func TestResponseDateAndServer(t *testing.T) {
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+		"Server: ICAP-Server-Software/1.0\r\n" +
+		"Encapsulated: null-body=0\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	date, err := resp.Date()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if wanted := time.Date(2000, time.January, 10, 9, 55, 21, 0, time.UTC); !date.Equal(wanted) {
+		t.Errorf("Wanted date:%v, got:%v", wanted, date)
+	}
+
+	if wanted := "ICAP-Server-Software/1.0"; resp.Server() != wanted {
+		t.Errorf("Wanted server:%s, got:%s", wanted, resp.Server())
+	}
+
+	resp, err = toClientResponse(bufio.NewReader(strings.NewReader("ICAP/1.0 204 No Content\r\n\r\n")), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := resp.Date(); !errors.Is(err, ErrNoDate) {
+		t.Errorf("Wanted error:%v, got:%v", ErrNoDate, err)
+	}
+}
+
+func TestResponseContentLength(t *testing.T) {
+	sampleTable := []struct {
+		name          string
+		respStr       string
+		contentLength int64
+	}{
+		{
+			name: "modified chunked body",
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"Encapsulated: res-hdr=0, res-body=73\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"Transfer-Encoding: chunked\r\n\r\n" +
+				"b\r\nHello World\r\n" +
+				"6\r\n again\r\n" +
+				"0\r\n\r\n",
+			contentLength: 17,
+		},
+		{
+			name: "modified request body",
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"Encapsulated: req-hdr=0, req-body=82\r\n\r\n" +
+				"POST http://someurl.com/upload HTTP/1.1\r\n" +
+				"Host: someurl.com\r\n" +
+				"Content-Length: 11\r\n\r\n" +
+				"b\r\nHello World\r\n" +
+				"0\r\n\r\n",
+			contentLength: 11,
+		},
+		{
+			name: "modified headers only",
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"Encapsulated: res-hdr=0, null-body=19\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n\r\n",
+			contentLength: 0,
+		},
+		{
+			name: "no content",
+			respStr: "ICAP/1.0 204 No Content\r\n" +
+				"Encapsulated: null-body=0\r\n\r\n",
+			contentLength: -1,
+		},
+	}
+
+	for _, sample := range sampleTable {
+		resp, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr)), headerLimits{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if resp.ContentLength != sample.contentLength {
+			t.Errorf("%s: Wanted content length:%d, got:%d", sample.name, sample.contentLength, resp.ContentLength)
+		}
+
+		body, err := io.ReadAll(resp.Body())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if sample.contentLength >= 0 && int64(len(body)) != sample.contentLength {
+			t.Errorf("%s: Wanted the body to be %d bytes long, got:%d", sample.name, sample.contentLength, len(body))
+		}
+	}
+}
+
+func TestResponseReason(t *testing.T) {
+	sampleTable := []struct {
+		name    string
+		respStr string
+		reason  string
+	}{
+		{
+			name: "response description",
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"X-Response-Desc: URL category Gambling is blocked\r\n" +
+				"Encapsulated: null-body=0\r\n\r\n",
+			reason: "URL category Gambling is blocked",
+		},
+		{
+			name: "virus id",
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"X-Virus-ID: Eicar-Test-Signature\r\n" +
+				"Encapsulated: null-body=0\r\n\r\n",
+			reason: "Eicar-Test-Signature",
+		},
+		{
+			name: "infection found",
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"X-Infection-Found: Type=0; Resolution=2; Threat=EICAR;\r\n" +
+				"Encapsulated: null-body=0\r\n\r\n",
+			reason: "EICAR",
+		},
+		{
+			name: "status text",
+			respStr: "ICAP/1.0 204 No Modifications\r\n" +
+				"Encapsulated: null-body=0\r\n\r\n",
+			reason: "No Modifications",
+		},
+	}
+
+	for _, sample := range sampleTable {
+		resp, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr)), headerLimits{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if got := resp.Reason(); got != sample.reason {
+			t.Errorf("%s: Wanted reason:%s, got:%s", sample.name, sample.reason, got)
+		}
+	}
+}
+
+func TestToClientResponseBodyLooksLikeTrailer(t *testing.T) {
+	// the scanned content contains a last chunk followed by header lines, which must not end up in the ICAP headers
+	content := "0\r\n\r\nX-Next-Services: icap://evil:1344/x\r\n\r\n"
+
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"Encapsulated: res-hdr=0, res-body=65\r\n\r\n"
+	httpRespStr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n\r\n", len(content)) +
+		fmt.Sprintf("%x\r\n", len(content)) +
+		content + "\r\n" +
+		"0\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr+httpRespStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if services := resp.NextServices(); len(services) != 0 {
+		t.Logf("Wanted no next services, got: %v", services)
+		t.Fail()
+	}
+
+	if len(resp.Trailer) != 0 {
+		t.Logf("Wanted no trailers, got: %v", resp.Trailer)
+		t.Fail()
+	}
+
+	if body, _ := io.ReadAll(resp.ContentResponse.Body); string(body) != content {
+		t.Logf("Wanted http response body: %q, got: %q", content, string(body))
+		t.Fail()
+	}
+}
+
+func TestResponseBody(t *testing.T) {
+	httpReq, _ := http.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("modified request"))
+	httpResp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("modified response")),
+	}
+
+	sampleTable := []struct {
+		name   string
+		resp   Response
+		wanted string
+	}{
+		{
+			name:   "REQMOD",
+			resp:   Response{StatusCode: http.StatusOK, ContentRequest: httpReq},
+			wanted: "modified request",
+		},
+		{
+			name:   "RESPMOD",
+			resp:   Response{StatusCode: http.StatusOK, ContentRequest: httpReq, ContentResponse: httpResp},
+			wanted: "modified response",
+		},
+		{
+			name:   "204",
+			resp:   Response{StatusCode: http.StatusNoContent, ContentRequest: httpReq},
+			wanted: "",
+		},
+		{
+			name:   "no content",
+			resp:   Response{StatusCode: http.StatusOK},
+			wanted: "",
+		},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			body := sample.resp.Body()
+			defer body.Close()
+
+			if b, err := io.ReadAll(body); err != nil || string(b) != sample.wanted {
+				t.Errorf("Wanted body: %s, got: %s, err: %v", sample.wanted, string(b), err)
+			}
+		})
+	}
+}
+
+func TestResponseContentModified(t *testing.T) {
+	original := "This is data that was returned by an origin server."
+
+	type testSample struct {
+		respStr  string
+		modified bool
+	}
+
+	sampleTable := []testSample{
+		{
+			respStr: "ICAP/1.0 204 No Content\r\n" +
+				"ISTag: \"W3E4R7U9-L2E4-2\"\r\n\r\n",
+			modified: false,
+		},
+		{
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+				"Encapsulated: res-hdr=0, res-body=65\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"Content-Length: 51\r\n\r\n" +
+				"33\r\n" +
+				original + "\r\n" +
+				"0\r\n\r\n",
+			modified: false,
+		},
+		{
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+				"Encapsulated: res-hdr=0, res-body=65\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"Content-Length: 30\r\n\r\n" +
+				"1e\r\n" +
+				"This content has been removed.\r\n" +
+				"0\r\n\r\n",
+			modified: true,
+		},
+	}
+
+	for _, sample := range sampleTable {
+		resp, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr)), headerLimits{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		modified, err := resp.ContentModified([]byte(original))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if modified != sample.modified {
+			t.Logf("Wanted content modified: %v, got: %v", sample.modified, modified)
+			t.Fail()
+		}
+
+		if resp.ContentResponse != nil {
+			if body, _ := io.ReadAll(resp.ContentResponse.Body); len(body) == 0 {
+				t.Log("Wanted the body to be readable after the comparison")
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestToClientResponseOptBody(t *testing.T) {
+	optBody := "<service><engine>av</engine></service>"
+
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"Methods: RESPMOD\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"Opt-body-type: XML-Policy-Table-1.0\r\n" +
+		"Encapsulated: opt-body=0\r\n\r\n" +
+		fmt.Sprintf("%x\r\n", len(optBody)) +
+		optBody + "\r\n" +
+		"0\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if string(resp.OptBody) != optBody {
+		t.Logf("Wanted opt-body: %s, got: %s", optBody, string(resp.OptBody))
+		t.Fail()
+	}
+
+	if val := resp.Header.Get("Methods"); val != "RESPMOD" {
+		t.Logf("Wanted Methods header: %s, got: %s", "RESPMOD", val)
+		t.Fail()
+	}
+
+	if resp.ContentRequest != nil || resp.ContentResponse != nil {
+		t.Log("Wanted no encapsulated http messages")
+		t.Fail()
+	}
+}
+
+func TestToClientResponseRawHeaders(t *testing.T) {
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"Server: ICAP-Server-Software/1.0\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"X-Order: first\r\n" +
+		"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
+		"X-Order: second\r\n" +
+		"Encapsulated: null-body=0\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	wanted := []HeaderField{
+		{Key: "Server", Value: "ICAP-Server-Software/1.0"},
+		{Key: "ISTag", Value: "\"W3E4R7U9-L2E4-2\""},
+		{Key: "X-Order", Value: "first"},
+		{Key: "Date", Value: "Mon, 10 Jan 2000  09:55:21 GMT"},
+		{Key: "X-Order", Value: "second"},
+		{Key: "Encapsulated", Value: "null-body=0"},
+	}
+
+	if !reflect.DeepEqual(resp.RawHeaders, wanted) {
+		t.Logf("Wanted raw headers: %v, got: %v", wanted, resp.RawHeaders)
+		t.Fail()
+	}
+}
+
+func TestResponseApplyTo(t *testing.T) {
+	t.Run("modified response", func(t *testing.T) {
+		httpRespStr := "HTTP/1.1 403 Forbidden\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n"
+		respStr := "ICAP/1.0 200 OK\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpRespStr)) + "\r\n\r\n" +
+			httpRespStr +
+			"1e\r\nThis content has been removed.\r\n" +
+			"0\r\n\r\n"
+
+		resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		original := &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/zip"}, "X-Origin": []string{"kept"}},
+			ContentLength: 51,
+			Body:          io.NopCloser(strings.NewReader("This is data that was returned by an origin server.")),
+		}
+		existing := original
+
+		if err := resp.ApplyToResponse(existing); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if existing != original || existing.StatusCode != http.StatusForbidden || existing.Status != "403 Forbidden" {
+			t.Errorf("Wanted the status of the existing response to be 403 Forbidden, got: %s", existing.Status)
+		}
+
+		if existing.Header.Get("Content-Type") != "text/plain" || existing.Header.Get("X-Origin") != "" {
+			t.Errorf("Wanted the headers of the modified response, got: %v", existing.Header)
+		}
+
+		if existing.ContentLength != 30 || existing.Header.Get("Content-Length") != "30" || existing.TransferEncoding != nil {
+			t.Errorf("Wanted the length of the modified body, got: %d, %v", existing.ContentLength, existing.Header)
+		}
+
+		if body, _ := io.ReadAll(existing.Body); string(body) != "This content has been removed." {
+			t.Errorf("Wanted the modified body, got: %s", string(body))
+		}
+	})
+
+	t.Run("modified request", func(t *testing.T) {
+		httpReqStr := "POST /upload HTTP/1.1\r\n" +
+			"Host: www.origin-server.com\r\n" +
+			"Content-Length: 11\r\n\r\n"
+		respStr := "ICAP/1.0 200 OK\r\n" +
+			"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(len(httpReqStr)) + "\r\n\r\n" +
+			httpReqStr +
+			"7\r\nREMOVED\r\n" +
+			"0\r\n\r\n"
+
+		resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		existing, _ := http.NewRequest(http.MethodPost, "http://www.origin-server.com/upload", strings.NewReader("Hello World"))
+
+		if err := resp.ApplyToRequest(existing); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if existing.ContentLength != 7 || existing.Header.Get("Content-Length") != "7" {
+			t.Errorf("Wanted the length of the modified body, got: %d, %v", existing.ContentLength, existing.Header)
+		}
+
+		if body, _ := io.ReadAll(existing.Body); string(body) != "REMOVED" {
+			t.Errorf("Wanted the modified body, got: %s", string(body))
+		}
+	})
+
+	t.Run("no content", func(t *testing.T) {
+		resp := Response{StatusCode: http.StatusNoContent}
+		existing := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("original"))}
+
+		if err := resp.ApplyToResponse(existing); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if body, _ := io.ReadAll(existing.Body); existing.StatusCode != http.StatusOK || string(body) != "original" {
+			t.Errorf("Wanted the existing response to be left untouched, got: %d %s", existing.StatusCode, string(body))
+		}
+
+		if err := (&Response{StatusCode: http.StatusOK}).ApplyToRequest(&http.Request{}); !errors.Is(err, ErrNoContentRequest) {
+			t.Errorf("Wanted error: %v, got: %v", ErrNoContentRequest, err)
+		}
+	})
+}
+
+func TestResponseServeHTTP(t *testing.T) {
+	newOriginal := func() *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Content-Type": []string{"text/plain"},
+			},
+			Body: io.NopCloser(strings.NewReader("This is the original content.")),
+		}
+	}
+
+	type testSample struct {
+		respStr    string
+		statusCode int
+		header     http.Header
+		body       string
+	}
+
+	sampleTable := []testSample{
+		{
+			respStr: "ICAP/1.0 204 No Content\r\n" +
+				"ISTag: \"W3E4R7U9-L2E4-2\"\r\n\r\n",
+			statusCode: http.StatusOK,
+			header:     http.Header{"Content-Type": []string{"text/plain"}},
+			body:       "This is the original content.",
+		},
+		{
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+				"Encapsulated: res-hdr=0, res-body=88\r\n\r\n" +
+				"HTTP/1.1 403 Forbidden\r\n" +
+				"Content-Type: text/html\r\n" +
+				"X-Blocked: true\r\n" +
+				"Content-Length: 14\r\n\r\n" +
+				"e\r\n" +
+				"Access denied.\r\n" +
+				"0\r\n\r\n",
+			statusCode: http.StatusForbidden,
+			header:     http.Header{"Content-Type": []string{"text/html"}, "X-Blocked": []string{"true"}, "Content-Length": []string{"14"}},
+			body:       "Access denied.",
+		},
+	}
+
+	for _, sample := range sampleTable {
+		resp, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr)), headerLimits{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		recorder := httptest.NewRecorder()
+		if err := resp.ServeHTTP(recorder, newOriginal()); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if recorder.Code != sample.statusCode {
+			t.Logf("Wanted status code: %d, got: %d", sample.statusCode, recorder.Code)
+			t.Fail()
+		}
+
+		if !reflect.DeepEqual(recorder.Header(), sample.header) {
+			t.Logf("Wanted header: %v, got: %v", sample.header, recorder.Header())
+			t.Fail()
+		}
+
+		if recorder.Body.String() != sample.body {
+			t.Logf("Wanted body: %s, got: %s", sample.body, recorder.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestToClientResponseRepeatedHeaders(t *testing.T) {
+	respStr := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: \"W3E4R7U9-L2E4-2\"\r\n" +
+		"Encapsulated: res-hdr=0, null-body=148\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Set-Cookie: session=38afes7a8; HttpOnly; Path=/\r\n" +
+		"Set-Cookie: id=a3fWa; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\n" +
+		"Content-Length: 0\r\n\r\n"
+
+	resp, err := toClientResponse(bufio.NewReader(strings.NewReader(respStr)), headerLimits{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	wanted := []string{
+		"session=38afes7a8; HttpOnly; Path=/",
+		"id=a3fWa; Expires=Wed, 21 Oct 2015 07:28:00 GMT",
+	}
+
+	if got := resp.ContentResponse.Header.Values("Set-Cookie"); !reflect.DeepEqual(got, wanted) {
+		t.Logf("Wanted Set-Cookie headers: %v, got: %v", wanted, got)
+		t.Fail()
+	}
+
+	if cookies := resp.ContentResponse.Cookies(); len(cookies) != 2 || cookies[0].Name != "session" || cookies[1].Name != "id" {
+		t.Logf("Wanted the cookies session and id, got: %v", cookies)
+		t.Fail()
+	}
+}
+
+func TestToClientResponseHeaderTooLarge(t *testing.T) {
+	oversized := "ICAP/1.0 200 OK\r\n" +
+		"X-Oversized: " + strings.Repeat("a", 8192) + "\r\n" +
+		"Encapsulated: null-body=0\r\n\r\n"
+
+	sampleTable := []struct {
+		name    string
+		respStr string
+		limits  headerLimits
+		wantErr bool
+	}{
+		{
+			name:    "oversized single line",
+			respStr: oversized,
+			limits:  headerLimits{maxLine: 1024},
+			wantErr: true,
+		},
+		{
+			name:    "oversized headers",
+			respStr: oversized,
+			limits:  headerLimits{maxBytes: 4096},
+			wantErr: true,
+		},
+		{
+			name: "oversized encapsulated http header line",
+			respStr: "ICAP/1.0 200 OK\r\n" +
+				"Encapsulated: res-hdr=0, null-body=8229\r\n\r\n" +
+				"HTTP/1.1 200 OK\r\n" +
+				"X-Oversized: " + strings.Repeat("a", 8192) + "\r\n\r\n",
+			limits:  headerLimits{maxLine: 1024},
+			wantErr: true,
+		},
+		{
+			name:    "within the limits",
+			respStr: oversized,
+			limits:  headerLimits{maxBytes: 16384, maxLine: 8300},
+		},
+		{
+			name:    "no limits",
+			respStr: oversized,
+		},
+	}
+
+	for _, sample := range sampleTable {
+		_, err := toClientResponse(bufio.NewReader(strings.NewReader(sample.respStr)), sample.limits)
+
+		if sample.wantErr && !errors.Is(err, ErrHeaderTooLarge) {
+			t.Errorf("%s: Wanted error:%v, got:%v", sample.name, ErrHeaderTooLarge, err)
+		}
+
+		if !sample.wantErr && err != nil {
+			t.Errorf("%s: Wanted no error, got:%v", sample.name, err)
+		}
+	}
+}
+
+func FuzzToClientResponse(f *testing.F) {
+	f.Add("ICAP/1.0 200 OK\r\nMethods: RESPMOD\r\nISTag: ICAP-TEST\r\nEncapsulated: null-body=0\r\n\r\n")
+	f.Add("ICAP/1.0 204 No Modifications\r\nEncapsulated: null-body=0\r\n\r\n")
+	f.Add("ICAP/1.0 200 OK\r\nEncapsulated: opt-body=0\r\n\r\n5\r\nHello\r\n0\r\n\r\n")
+	f.Add("ICAP/1.0 200 OK\r\n" +
+		"Encapsulated: req-hdr=0, req-body=49\r\n\r\n" +
+		"POST /upload HTTP/1.1\r\n" +
+		"Host: example.com\r\n\r\n" +
+		"b\r\nHello World\r\n0\r\n\r\n")
+	f.Add("ICAP/1.0 200 OK\r\n" +
+		"Encapsulated: res-hdr=0, res-body=64\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Connection: close\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"b\r\nHello World\r\n0\r\n\r\n" +
+		"X-Trailer: value\r\n\r\n")
+
+	f.Fuzz(func(t *testing.T, msg string) {
+		// malformed messages must be rejected with an error, never with a panic
+		_, _ = toClientResponse(bufio.NewReader(strings.NewReader(msg)), headerLimits{})
+	})
+}
+
+func TestReadMessageDecreasingOffsets(t *testing.T) {
+	msg := "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=50, res-body=10\r\n\r\n" + strings.Repeat("a", 60)
+
+	if _, err := readMessage(bufio.NewReader(strings.NewReader(msg)), false, headerLimits{}); !errors.Is(err, ErrInvalidTCPMsg) {
+		t.Errorf("Wanted error:%v, got:%v", ErrInvalidTCPMsg, err)
+	}
+}
+
+// countingReader counts the bytes read from the reader
+type countingReader struct {
+	io.Reader
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+
+	return n, err
+}
+
+func TestReadMessageHeaderTooLarge(t *testing.T) {
+	const endless = 20 << 20
+
+	sampleTable := []struct {
+		name   string
+		prefix string
+		limits headerLimits
+	}{
+		{
+			name:   "oversized status line",
+			prefix: "ICAP/1.0 200 ",
+			limits: headerLimits{maxLine: 100},
+		},
+		{
+			name:   "oversized header line",
+			prefix: "ICAP/1.0 200 OK\r\nX-Oversized: ",
+			limits: headerLimits{maxLine: 100},
+		},
+		{
+			name:   "oversized headers",
+			prefix: "ICAP/1.0 200 OK\r\nX-Oversized: ",
+			limits: headerLimits{maxBytes: 1024},
+		},
+		{
+			name:   "oversized encapsulated headers",
+			prefix: "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=" + strconv.Itoa(endless) + "\r\n\r\n",
+			limits: headerLimits{maxBytes: 1024},
+		},
+		{
+			name:   "oversized encapsulated header line",
+			prefix: "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=" + strconv.Itoa(endless) + "\r\n\r\nHTTP/1.1 200 OK\r\nX-Oversized: ",
+			limits: headerLimits{maxLine: 100},
+		},
+		{
+			name:   "oversized chunk size line",
+			prefix: "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, res-body=19\r\n\r\nHTTP/1.1 200 OK\r\n\r\n",
+			limits: headerLimits{maxLine: 100},
+		},
+	}
+
+	for _, sample := range sampleTable {
+		t.Run(sample.name, func(t *testing.T) {
+			r := &countingReader{Reader: io.MultiReader(strings.NewReader(sample.prefix), &patternReadSeeker{size: endless})}
+
+			if _, err := readMessage(bufio.NewReader(r), false, sample.limits); !errors.Is(err, ErrHeaderTooLarge) {
+				t.Errorf("Wanted error:%v, got:%v", ErrHeaderTooLarge, err)
+			}
+
+			// the message is rejected long before the server sent it entirely
+			if r.read > 64<<10 {
+				t.Errorf("Wanted at most %d bytes to be read, got:%d", 64<<10, r.read)
+			}
+		})
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add("ICAP/1.0 204 No Modifications\r\nEncapsulated: null-body=0\r\n\r\n")
+	f.Add("ICAP/1.0 100 Continue\r\n\r\n")
+	f.Add("ICAP/1.0 200 OK\r\nEncapsulated: opt-body=0\r\n\r\n5\r\nHello\r\n0\r\n\r\n")
+	f.Add("ICAP/1.0 200 OK\r\n" +
+		"Encapsulated: res-hdr=0, res-body=64\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Connection: close\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"b\r\nHello World\r\n0\r\n\r\n")
+	f.Add("ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=50, res-body=10\r\n\r\n" + strings.Repeat("a", 60))
+
+	f.Fuzz(func(t *testing.T, msg string) {
+		// the server controls the message, a malformed one must be rejected with an error, never with a panic
+		for _, lenient := range []bool{false, true} {
+			_, _ = readMessage(bufio.NewReader(strings.NewReader(msg)), lenient, headerLimits{})
+		}
+	})
+}
+
+func FuzzSetEncapsulatedHeaderValue(f *testing.F) {
+	f.Add(uint8(0), "GET / HTTP/1.1\r\nHost: www.origin-server.com\r\n\r\n", "")
+	f.Add(uint8(0), "POST / HTTP/1.1\r\nHost: www.origin-server.com\r\n\r\n1e\r\nI am posting this information.\r\n0\r\n\r\n", "")
+	f.Add(uint8(1), "GET / HTTP/1.1\r\nHost: www.origin-server.com\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nb\r\nHello World\r\n0\r\n\r\n")
+	f.Add(uint8(2), "", "")
+
+	methods := []string{MethodREQMOD, MethodRESPMOD, MethodOPTIONS}
+
+	f.Fuzz(func(t *testing.T, method uint8, httpReqStr, httpRespStr string) {
+		// the ICAP message block is always built by the client, only the http messages are arbitrary
+		got := setEncapsulatedHeaderValue(methods[int(method)%len(methods)]+"\r\nEncapsulated: %s\r\n\r\n", httpReqStr, httpRespStr)
+
+		// the offsets must point into the encapsulated http messages
+		for _, match := range regexp.MustCompile(`(req-hdr|req-body|res-hdr|res-body|null-body)=(\d+)`).FindAllStringSubmatch(got, -1) {
+			if offset, _ := strconv.Atoi(match[2]); offset > len(httpReqStr)+len(httpRespStr) {
+				t.Errorf("Wanted the %s offset within the encapsulated messages, got:%d", match[1], offset)
+			}
+		}
+	})
+}
+
+// benchmarkMessage returns a 200 response with a chunked body of 64 KiB, as a server sends it
+func benchmarkMessage() []byte {
+	httpResp := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	msg := "ICAP/1.0 200 OK\r\nISTag: ICAP-TEST\r\nEncapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpResp)) + "\r\n\r\n" + httpResp
+
+	chunk := strings.Repeat("Hello World\r\n\r\n", 1024)
+	for i := 0; i < 4; i++ {
+		msg += fmt.Sprintf("%x\r\n%s\r\n", len(chunk), chunk)
+	}
+
+	return []byte(msg + "0\r\n\r\n")
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	msg := benchmarkMessage()
+	r := bufio.NewReader(nil)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(bytes.NewReader(msg))
+		if _, err := readMessage(r, false, headerLimits{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkToClientResponse(b *testing.B) {
+	msg := benchmarkMessage()
+	r := bufio.NewReader(nil)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(bytes.NewReader(msg))
+		if _, err := toClientResponse(r, headerLimits{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
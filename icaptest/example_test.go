@@ -0,0 +1,56 @@
+package icaptest_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	ic "github.com/egirna/icap-client"
+	"github.com/egirna/icap-client/icaptest"
+)
+
+func ExampleServer() {
+	server := icaptest.NewServer()
+	defer server.Close()
+
+	// the service does not modify any content
+	server.Handle("/respmod", icaptest.Reply{
+		StatusCode: http.StatusNoContent,
+		Header:     http.Header{"Istag": []string{"ICAP-TEST"}},
+	})
+
+	httpResp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: 11,
+		Body:          io.NopCloser(strings.NewReader("Hello World")),
+	}
+
+	req, err := ic.NewRequest(context.Background(), ic.MethodRESPMOD, server.URL+"/respmod", nil, httpResp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := ic.NewClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(resp.StatusCode, resp.Header.Get("ISTag"))
+	fmt.Println(strings.HasPrefix(server.Requests()[0], "RESPMOD "+server.URL+"/respmod ICAP/1.0"))
+	// Output:
+	// 204 ICAP-TEST
+	// true
+}
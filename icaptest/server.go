@@ -0,0 +1,300 @@
+// Package icaptest provides a scriptable ICAP server for testing ICAP integrations
+package icaptest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	crlf        = "\r\n"
+	icapVersion = "ICAP/1.0"
+)
+
+// Reply is the scripted reply of a service
+type Reply struct {
+	// StatusCode is the ICAP status code of the reply
+	StatusCode int
+	// Status is the status text of the reply, the text of the status code is used if not set
+	Status string
+	// Header are the ICAP headers of the reply, the Encapsulated header is computed by the server
+	Header http.Header
+	// ContentRequest is the raw header block of the encapsulated http request, for example,
+	// "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", no http request is encapsulated if not set
+	ContentRequest string
+	// ContentResponse is the raw header block of the encapsulated http response, for example,
+	// "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n", no http response is encapsulated if not set
+	ContentResponse string
+	// Body is the body of the last encapsulated http message, or the options body if no message is encapsulated
+	Body []byte
+}
+
+// Server is an ICAP server which answers the requests to a service path with the reply scripted for it,
+// the services which are not scripted answer with 404 Service Not Found
+type Server struct {
+	// URL is the base url of the server, for example, icap://127.0.0.1:49152
+	URL string
+
+	lstnr    net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	replies  map[string]Reply
+	requests []string
+}
+
+// NewServer starts a server on a free port of the loopback interface, it must be closed once done
+func NewServer() *Server {
+	lstnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("icaptest: failed to listen: %v", err))
+	}
+
+	s := &Server{
+		URL:     "icap://" + lstnr.Addr().String(),
+		lstnr:   lstnr,
+		replies: make(map[string]Reply),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s
+}
+
+// Handle scripts the reply of the service at the given path, for example, /respmod, it applies to all methods
+func (s *Server) Handle(path string, reply Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replies[path] = reply
+}
+
+// Requests returns the raw ICAP requests the server received so far, in the order they arrived
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+// Close stops the server and waits for the open connections to be done
+func (s *Server) Close() {
+	_ = s.lstnr.Close()
+	s.wg.Wait()
+}
+
+// serve accepts the connections until the server is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.lstnr.Accept()
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn answers the requests of the connection until the client closes it
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	for {
+		path, msg, err := readRequest(r, conn)
+		if msg != "" {
+			s.mu.Lock()
+			s.requests = append(s.requests, msg)
+			s.mu.Unlock()
+		}
+
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		reply, ok := s.replies[path]
+		s.mu.Unlock()
+
+		if !ok {
+			reply = Reply{StatusCode: http.StatusNotFound, Status: "Service Not Found"}
+		}
+
+		if _, err := io.WriteString(conn, reply.String()); err != nil {
+			return
+		}
+	}
+}
+
+// String returns the reply in its ICAP/1.0 wire
+func (r Reply) String() string {
+	status := r.Status
+	if status == "" {
+		status = http.StatusText(r.StatusCode)
+	}
+
+	msg := fmt.Sprintf("%s %d %s%s", icapVersion, r.StatusCode, status, crlf)
+
+	for header, values := range r.Header {
+		for _, value := range values {
+			msg += fmt.Sprintf("%s: %s%s", header, value, crlf)
+		}
+	}
+
+	entries := make([]string, 0)
+	if r.ContentRequest != "" {
+		entries = append(entries, "req-hdr=0")
+	}
+
+	if r.ContentResponse != "" {
+		entries = append(entries, fmt.Sprintf("res-hdr=%d", len(r.ContentRequest)))
+	}
+
+	offset := len(r.ContentRequest) + len(r.ContentResponse)
+
+	switch {
+	case r.Body == nil:
+		entries = append(entries, fmt.Sprintf("null-body=%d", offset))
+	case r.ContentResponse != "":
+		entries = append(entries, fmt.Sprintf("res-body=%d", offset))
+	case r.ContentRequest != "":
+		entries = append(entries, fmt.Sprintf("req-body=%d", offset))
+	default:
+		entries = append(entries, "opt-body=0")
+	}
+
+	msg += "Encapsulated: " + strings.Join(entries, ", ") + crlf + crlf
+	msg += r.ContentRequest + r.ContentResponse
+
+	if r.Body != nil {
+		if len(r.Body) > 0 {
+			msg += fmt.Sprintf("%x%s%s%s", len(r.Body), crlf, r.Body, crlf)
+		}
+
+		msg += "0" + crlf + crlf
+	}
+
+	return msg
+}
+
+// readRequest reads one entire ICAP request from the reader and returns the path of its service along with the raw message,
+// the rest of a preview is asked for with 100 Continue on the writer
+func readRequest(r *bufio.Reader, w io.Writer) (string, string, error) {
+	msg, err := r.ReadString('\n')
+	if err != nil {
+		return "", msg, err
+	}
+
+	ss := strings.Fields(msg)
+	if len(ss) != 3 {
+		return "", msg, fmt.Errorf("icaptest: malformed request line: %s", msg)
+	}
+
+	u, err := url.Parse(ss[1])
+	if err != nil {
+		return "", msg, err
+	}
+
+	encVal, preview := "", false
+
+	// reading the ICAP headers
+	for {
+		line, err := r.ReadString('\n')
+		msg += line
+		if err != nil {
+			return u.Path, msg, err
+		}
+
+		if line == crlf {
+			break
+		}
+
+		header, val, _ := strings.Cut(line, ":")
+		switch http.CanonicalHeaderKey(strings.TrimSpace(header)) {
+		case "Encapsulated":
+			encVal = strings.TrimSpace(val)
+		case "Preview":
+			preview = true
+		}
+	}
+
+	// the last entry of the Encapsulated header is either the body or the null-body
+	entries := strings.Split(encVal, ",")
+	name, offset, _ := strings.Cut(strings.TrimSpace(entries[len(entries)-1]), "=")
+
+	n, err := strconv.Atoi(offset)
+	if err != nil {
+		return u.Path, msg, nil
+	}
+
+	// reading the encapsulated headers
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return u.Path, msg + string(b), err
+	}
+	msg += string(b)
+
+	if name == "null-body" {
+		return u.Path, msg, nil
+	}
+
+	body, ieof, err := readChunkedBody(r)
+	msg += body
+	if err != nil || !preview || ieof {
+		return u.Path, msg, err
+	}
+
+	// the preview did not carry the entire body, so the rest is asked for
+	if _, err := io.WriteString(w, icapVersion+" 100 Continue"+crlf+crlf); err != nil {
+		return u.Path, msg, err
+	}
+
+	body, _, err = readChunkedBody(r)
+
+	return u.Path, msg + body, err
+}
+
+// readChunkedBody reads a raw chunked body from the reader,
+// it reports if the last chunk carries the ieof extension which ends a preview with the entire body
+func readChunkedBody(r *bufio.Reader) (string, bool, error) {
+	msg := ""
+
+	for {
+		line, err := r.ReadString('\n')
+		msg += line
+		if err != nil {
+			return msg, false, err
+		}
+
+		chunkSize, ext, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(chunkSize), 16, 64)
+		if err != nil {
+			return msg, false, err
+		}
+
+		if size == 0 {
+			line, err := r.ReadString('\n')
+			return msg + line, strings.TrimSpace(ext) == "ieof", err
+		}
+
+		chunk := make([]byte, size+int64(len(crlf)))
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return msg, false, err
+		}
+		msg += string(chunk)
+	}
+}
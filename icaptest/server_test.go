@@ -0,0 +1,74 @@
+package icaptest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	ic "github.com/egirna/icap-client"
+	"github.com/egirna/icap-client/icaptest"
+)
+
+func TestServer(t *testing.T) {
+	server := icaptest.NewServer()
+	defer server.Close()
+
+	server.Handle("/respmod", icaptest.Reply{
+		StatusCode:      http.StatusOK,
+		Header:          http.Header{"Istag": []string{"ICAP-TEST"}},
+		ContentResponse: "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\n\r\n",
+		Body:            []byte("Blocked"),
+	})
+
+	body := strings.Repeat("Hello World", 10)
+	httpResp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+
+	req, err := ic.NewRequest(context.Background(), ic.MethodRESPMOD, server.URL+"/respmod", nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rest of the body is asked for after the preview
+	if err := req.SetPreview(10); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := ic.NewClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.ContentResponse == nil {
+		t.Fatalf("Wanted a modified http response, got status:%d", resp.StatusCode)
+	}
+
+	if resp.ContentResponse.StatusCode != http.StatusForbidden {
+		t.Errorf("Wanted http status:%d, got:%d", http.StatusForbidden, resp.ContentResponse.StatusCode)
+	}
+
+	if b, _ := io.ReadAll(resp.ContentResponse.Body); string(b) != "Blocked" {
+		t.Errorf("Wanted http body:%s, got:%s", "Blocked", string(b))
+	}
+
+	if requests := server.Requests(); len(requests) != 1 || !strings.Contains(requests[0], body[10:]) {
+		t.Errorf("Wanted the entire body to be received, got:%v", requests)
+	}
+
+	// the services which are not scripted are not found
+	req, _ = ic.NewRequest(context.Background(), ic.MethodOPTIONS, server.URL+"/unknown", nil, nil)
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Wanted status:%d, got:%d, err:%v", http.StatusNotFound, resp.StatusCode, err)
+	}
+}
@@ -0,0 +1,161 @@
+package icapclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Pipeline scans both stages of a proxied exchange, the http request with the REQMOD service before it's forwarded
+// and the http response with the RESPMOD service before it's served. The OPTIONS of each service are requested once
+// and shared by the scans, they're requested again once their Options-TTL, or DefaultOptionsTTL, expired
+type Pipeline struct {
+	client     Client
+	reqmodURL  string
+	respmodURL string
+	// shareOptions is set if the OPTIONS of one service may configure the requests to the other one
+	shareOptions bool
+
+	mu      sync.Mutex
+	options map[string]cachedOptions
+}
+
+// cachedOptions is the OPTIONS response of a service along with the time it expires, it never expires if the time is zero
+type cachedOptions struct {
+	res     *Response
+	expires time.Time
+}
+
+// NewPipeline returns a pipeline which scans the requests with the REQMOD service and the responses with the RESPMOD service
+// through the client, the services may be the same
+func NewPipeline(client Client, reqmodURL, respmodURL string) *Pipeline {
+	return &Pipeline{
+		client:     client,
+		reqmodURL:  reqmodURL,
+		respmodURL: respmodURL,
+		options:    make(map[string]cachedOptions),
+	}
+}
+
+// NewSharedOptionsPipeline returns a pipeline like NewPipeline which treats the services as one logical service
+// if they're on the same server, only their paths differ. The OPTIONS of either configure the requests to both then,
+// as long as their Methods header lists the method of the request, otherwise the service is asked for its own OPTIONS
+func NewSharedOptionsPipeline(client Client, reqmodURL, respmodURL string) *Pipeline {
+	p := NewPipeline(client, reqmodURL, respmodURL)
+	p.shareOptions = sameServer(reqmodURL, respmodURL)
+
+	return p
+}
+
+// sameServer reports whether the urls address the same server, it's false if either can't be parsed
+func sameServer(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host
+}
+
+// ScanRequest scans the http request with the REQMOD service, configured as advertised by its OPTIONS
+func (p *Pipeline) ScanRequest(ctx context.Context, httpReq *http.Request) (Response, error) {
+	return p.scan(ctx, MethodREQMOD, p.reqmodURL, httpReq, nil)
+}
+
+// ScanResponse scans the http response to the request with the RESPMOD service, configured as advertised by its OPTIONS
+func (p *Pipeline) ScanResponse(ctx context.Context, httpReq *http.Request, httpResp *http.Response) (Response, error) {
+	return p.scan(ctx, MethodRESPMOD, p.respmodURL, httpReq, httpResp)
+}
+
+// scan makes the modification request to the service, configured by its OPTIONS
+func (p *Pipeline) scan(ctx context.Context, method, service string, httpReq *http.Request, httpResp *http.Response) (Response, error) {
+	opts, err := p.serviceOptions(ctx, method, service)
+	if err != nil {
+		return Response{}, err
+	}
+
+	req, err := NewRequest(ctx, method, service, httpReq, httpResp)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if err := req.UseOptions(opts); err != nil {
+		return Response{}, err
+	}
+
+	return p.client.Do(req)
+}
+
+// serviceOptions returns the OPTIONS response to configure the request of the method to the service with,
+// it's only requested if there's none cached or it expired. Concurrent scans may request it at the same time, the last response is kept then
+func (p *Pipeline) serviceOptions(ctx context.Context, method, service string) (*Response, error) {
+	clock := p.client.config.clock
+
+	if res, found := p.lookupOptions(method, service); found {
+		return res, nil
+	}
+
+	req, err := NewRequest(ctx, MethodOPTIONS, service, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("icap: options of %s: %w", service, err)
+	}
+
+	// a failed OPTIONS request tells nothing about the service, so it's not cached
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("icap: options of %s: %w: %d %s", service, ErrICAPFailure, res.StatusCode, res.Status)
+	}
+
+	cached := cachedOptions{res: &res}
+	if ttl := res.Options().OptionsTTL; ttl > 0 {
+		cached.expires = clock.Now().Add(ttl)
+	}
+
+	p.mu.Lock()
+	p.options[service] = cached
+	p.mu.Unlock()
+
+	return cached.res, nil
+}
+
+// lookupOptions returns the unexpired OPTIONS response cached for the service, or for the other service
+// if the pipeline shares them and the response lists the method
+func (p *Pipeline) lookupOptions(method, service string) (*Response, bool) {
+	now := p.client.config.clock.Now()
+
+	candidates := []string{service}
+	if p.shareOptions {
+		candidates = append(candidates, p.reqmodURL, p.respmodURL)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, candidate := range candidates {
+		cached, found := p.options[candidate]
+		if !found || (!cached.expires.IsZero() && !now.Before(cached.expires)) {
+			continue
+		}
+
+		if candidate != service && !slices.Contains(cached.res.Options().Methods, method) {
+			continue
+		}
+
+		return cached.res, true
+	}
+
+	return nil, false
+}
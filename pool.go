@@ -0,0 +1,228 @@
+package icapclient
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the connection statistics of a client
+type Stats struct {
+	// Dials is the amount of connections established to the icap servers
+	Dials int64
+	// Reuses is the amount of requests made on an idle connection of the pool
+	Reuses int64
+	// IdleClosed is the amount of idle connections closed, because the pool was full, they idled too long or the client shut down
+	IdleClosed int64
+	// ActiveConns is the amount of connections currently in use by requests
+	ActiveConns int64
+}
+
+// connPool keeps the idle connections to the icap servers for reuse, the connections are kept per scheme and host.
+// No connection is kept if the maximum of idle connections is 0 or less, the statistics are counted anyway
+type connPool struct {
+	mu          sync.Mutex
+	idle        map[string][]idleConn
+	maxIdle     int
+	idleTimeout time.Duration
+	clock       clock
+	// closed is set once the client shut down, the connections put back afterwards are closed
+	closed bool
+
+	dials      atomic.Int64
+	reuses     atomic.Int64
+	idleClosed atomic.Int64
+	active     atomic.Int64
+}
+
+// idleConn is a connection in the pool along with the time it was put back, the service it was last used for
+// and the time it was last pinged to keep it alive
+type idleConn struct {
+	conn    *ICAPConn
+	key     string
+	service string
+	at      time.Time
+	pinged  time.Time
+}
+
+// newConnPool returns a pool which keeps up to maxIdle idle connections per host, for at most idleTimeout if it's set,
+// the idle time is measured by the clock
+func newConnPool(maxIdle int, idleTimeout time.Duration, clock clock) *connPool {
+	return &connPool{
+		idle:        make(map[string][]idleConn),
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		clock:       clock,
+	}
+}
+
+// get takes the most recently used idle connection of the key, the connections which idled too long are closed on the way
+func (p *connPool) get(key string) *ICAPConn {
+	if p == nil || p.maxIdle <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for conns := p.idle[key]; len(conns) > 0; conns = p.idle[key] {
+		ic := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+
+		if p.idleTimeout > 0 && p.clock.Now().Sub(ic.at) > p.idleTimeout {
+			p.closeIdle(ic.conn)
+			continue
+		}
+
+		p.reuses.Add(1)
+
+		return ic.conn
+	}
+
+	return nil
+}
+
+// put puts the connection used for the service back into the pool, it's closed if the pool has no room for it
+func (p *connPool) put(key, service string, conn *ICAPConn) {
+	if p == nil || p.maxIdle <= 0 {
+		_ = conn.Close()
+		return
+	}
+
+	p.putIdle(idleConn{conn: conn, key: key, service: service, at: p.clock.Now()})
+}
+
+// putIdle puts the idle connection into the pool, it's closed if the pool has no room for it or it's closed,
+// for example, because a ping outlived the shutdown of the client
+func (p *connPool) putIdle(ic idleConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle[ic.key]) >= p.maxIdle {
+		p.closeIdle(ic.conn)
+		return
+	}
+
+	p.idle[ic.key] = append(p.idle[ic.key], ic)
+}
+
+// keepalive pings the connections which idled for the interval until the context is done, so the servers don't close them.
+// The connections are taken out of the pool while they're pinged, so no request can get them meanwhile,
+// those the ping fails on are closed
+func (p *connPool) keepalive(ctx context.Context, interval time.Duration, ping func(conn *ICAPConn, service string) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.clock.After(interval):
+		}
+
+		for _, ic := range p.takeIdle(interval) {
+			if err := ping(ic.conn, ic.service); err != nil {
+				p.closeIdle(ic.conn)
+				continue
+			}
+
+			ic.pinged = p.clock.Now()
+			p.putIdle(ic)
+		}
+	}
+}
+
+// takeIdle takes the connections out of the pool which were neither used nor pinged for the interval,
+// the connections which idled too long are closed on the way
+func (p *connPool) takeIdle(interval time.Duration) []idleConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var taken []idleConn
+	now := p.clock.Now()
+
+	for key, conns := range p.idle {
+		p.idle[key] = slices.DeleteFunc(conns, func(ic idleConn) bool {
+			switch {
+			case p.idleTimeout > 0 && now.Sub(ic.at) > p.idleTimeout:
+				p.closeIdle(ic.conn)
+				return true
+			case now.Sub(ic.at) >= interval && now.Sub(ic.pinged) >= interval:
+				taken = append(taken, ic)
+				return true
+			}
+
+			return false
+		})
+	}
+
+	return taken
+}
+
+// closeAll closes all idle connections of the pool, the connections put back afterwards are closed as well
+func (p *connPool) closeAll() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+
+	for key, conns := range p.idle {
+		for _, ic := range conns {
+			p.closeIdle(ic.conn)
+		}
+
+		delete(p.idle, key)
+	}
+}
+
+// closeIdle closes an idle connection and counts it
+func (p *connPool) closeIdle(conn *ICAPConn) {
+	_ = conn.Close()
+	p.idleClosed.Add(1)
+}
+
+// stats returns the current statistics of the pool
+func (p *connPool) stats() Stats {
+	if p == nil {
+		return Stats{}
+	}
+
+	return Stats{
+		Dials:       p.dials.Load(),
+		Reuses:      p.reuses.Load(),
+		IdleClosed:  p.idleClosed.Load(),
+		ActiveConns: p.active.Load(),
+	}
+}
+
+// maxPooledBufferBytes caps the size of the buffers kept for reuse, so a single large message doesn't pin its memory
+const maxPooledBufferBytes = 1 << 20
+
+// bufferPool keeps the buffers the messages of the servers are read into for reuse across the requests,
+// the data is copied out of them, so they're never shared
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer of the pool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	return buf
+}
+
+// putBuffer puts the buffer back into the pool, unless it grew too large to be kept
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferBytes {
+		return
+	}
+
+	bufferPool.Put(buf)
+}
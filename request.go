@@ -3,14 +3,20 @@ package icapclient
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 // Request represents the icap client request data
@@ -26,9 +32,26 @@ type Request struct {
 	previewSet            bool
 	bodyFittedInPreview   bool
 	remainingPreviewBytes []byte
+	rawURL                string
+	previewAdvertised     bool
+	timeout               time.Duration
+	rawBodyKind           string
+	rawBody               []byte
+	trace                 *ICAPTrace
+	rewriteHTTPRequest    func(dumped []byte) []byte
+	noAutoAcceptEncoding  bool
+	bodyFraming           BodyFraming
+	removedHTTPHeaders    []string
+	bodyTerminator        []byte
+	halfCloseAfterPreview bool
+	previewSeeker         io.ReadSeeker
+	previewHead           []byte
+	seekableSize          int64
 }
 
-// NewRequest returns a new Request given a context, method, url, http request and http response
+// NewRequest returns a new Request given a context, method, url, http request and http response.
+// A http request as received by a server, for example, by the http.Handler of a proxy, is turned into an outgoing one,
+// its absolute url is restored from the Host header
 // todo: method iota
 func NewRequest(ctx context.Context, method, urlStr string, httpReq *http.Request, httpResp *http.Response) (Request, error) {
 	u, err := url.Parse(urlStr)
@@ -37,6 +60,10 @@ func NewRequest(ctx context.Context, method, urlStr string, httpReq *http.Reques
 		return Request{}, err
 	}
 
+	if httpReq != nil && httpReq.RequestURI != "" {
+		httpReq = toOutgoingRequest(httpReq)
+	}
+
 	req := Request{
 		Method:       strings.ToUpper(method),
 		URL:          u,
@@ -53,12 +80,248 @@ func NewRequest(ctx context.Context, method, urlStr string, httpReq *http.Reques
 	return req, nil
 }
 
-// SetPreview sets the preview bytes in the icap header
+// NewRESPMODRequestFromFile returns a new RESPMOD Request which scans the given file as the body of the http response,
+// the size of the file is used as the Content-Length. The file is read when the request is sent and must be closed by the caller
+func NewRESPMODRequestFromFile(ctx context.Context, urlStr string, f *os.File, contentType string) (Request, error) {
+	return NewRESPMODRequestFromReadSeeker(ctx, urlStr, f, contentType)
+}
+
+// NewRESPMODRequestFromReadSeeker returns a new RESPMOD Request which scans the content of the reader as the body of the http response,
+// its size is used as the Content-Length. As the body can seek, it's streamed as the request is sent instead of being held in memory,
+// after a preview the rest is read from the end of the preview on if the server asks for it. The reader is read when the request is sent
+func NewRESPMODRequestFromReadSeeker(ctx context.Context, urlStr string, body io.ReadSeeker, contentType string) (Request, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Request{}, err
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return Request{}, err
+	}
+
+	httpResp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   []string{contentType},
+			"Content-Length": []string{strconv.FormatInt(size, 10)},
+		},
+		ContentLength: size,
+		Body:          readSeekNopCloser{body},
+	}
+
+	return NewRequest(ctx, MethodRESPMOD, urlStr, nil, httpResp)
+}
+
+// readSeekNopCloser is a body which can seek, closing it is left to its owner
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error { return nil }
+
+// SetRawURL sets the url of the icap service, the given string is used verbatim
+// in the ICAP request line instead of the re-serialized url
+func (r *Request) SetRawURL(urlStr string) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+
+	req := *r
+	req.URL = u
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	r.URL = u
+	r.rawURL = urlStr
+
+	return nil
+}
+
+// SetMethod sets the ICAP method of the request, for example, to reuse a request as a template for another method.
+// The method is validated against the http messages of the request, the request is left untouched if it doesn't fit
+func (r *Request) SetMethod(method string) error {
+	req := *r
+	req.Method = strings.ToUpper(method)
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	r.Method = req.Method
+
+	return nil
+}
+
+// SetAuthenticatedUser sets the X-Authenticated-User header, the user as authenticated by the proxy along with the scheme
+// of the authentication, for example, Local or LDAP. The header value is the base64 encoded scheme://user, an empty user removes it
+func (r *Request) SetAuthenticatedUser(scheme, user string) error {
+	if user == "" {
+		r.Header.Del(authUserHeader)
+		return nil
+	}
+
+	if scheme == "" || strings.Contains(scheme, "://") {
+		return fmt.Errorf("%w: scheme %q", ErrInvalidAuthenticatedUser, scheme)
+	}
+
+	r.Header.Set(authUserHeader, base64.StdEncoding.EncodeToString([]byte(scheme+"://"+user)))
+
+	return nil
+}
+
+// DecodeAuthenticatedUser returns the scheme and the user of a X-Authenticated-User header value,
+// for example, as echoed by the server or of a captured request
+func DecodeAuthenticatedUser(headerValue string) (scheme, user string, err error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(headerValue))
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrInvalidAuthenticatedUser, err)
+	}
+
+	scheme, user, found := strings.Cut(string(decoded), "://")
+	if !found || scheme == "" {
+		return "", "", fmt.Errorf("%w: %q", ErrInvalidAuthenticatedUser, string(decoded))
+	}
+
+	return scheme, user, nil
+}
+
+// rawBodyKinds are the kinds of the raw encapsulated body which fit the methods
+var rawBodyKinds = map[string]string{
+	MethodREQMOD:  "req-body",
+	MethodRESPMOD: "res-body",
+	MethodOPTIONS: "opt-body",
+}
+
+// SetRawEncapsulatedBody sets a raw payload as the encapsulated body, for custom services which do not expect a http message.
+// The kind must fit the method: req-body for REQMOD, res-body for RESPMOD and opt-body for OPTIONS. No preview applies.
+// A REQMOD or RESPMOD request still needs its http message to be created, as NewRequest requires it, but the message is not sent,
+// the raw body takes its place
+func (r *Request) SetRawEncapsulatedBody(kind string, body []byte) error {
+	if !slices.Contains([]string{"req-body", "res-body", "opt-body"}, kind) {
+		return fmt.Errorf("%w: %s", ErrInvalidEncapsulatedKind, kind)
+	}
+
+	if rawBodyKinds[r.Method] != kind {
+		return fmt.Errorf("%w: %s doesn't fit %s", ErrInvalidEncapsulatedKind, kind, r.Method)
+	}
+
+	r.rawBodyKind = kind
+	r.rawBody = body
+
+	return nil
+}
+
+// SetAllowOut sets the X-Allow-Out header, which lists the headers some servers are asked to return, for example, X-Infection-Found.
+// The header names are validated and comma-joined, an empty list removes the header
+func (r *Request) SetAllowOut(headers []string) error {
+	for _, header := range headers {
+		if !isHeaderName(header) {
+			return fmt.Errorf("%w: %q", ErrInvalidHeaderName, header)
+		}
+	}
+
+	if len(headers) == 0 {
+		r.Header.Del(allowOutHeader)
+		return nil
+	}
+
+	r.Header.Set(allowOutHeader, strings.Join(headers, ", "))
+
+	return nil
+}
+
+// isHeaderName determines if the string is a valid header name, i.e., a non-empty token as of RFC 7230
+func isHeaderName(str string) bool {
+	if str == "" {
+		return false
+	}
+
+	for _, c := range str {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Context returns the context of the request, the values of the context set by the caller are carried
+// to the hooks of the client and to the request the response refers to, for example, for logging or tracing middleware
+func (r *Request) Context() context.Context {
+	return r.ctx
+}
+
+// SetContext replaces the context of the request, for example, to change its deadline
+func (r *Request) SetContext(ctx context.Context) error {
+	if ctx == nil {
+		return ErrNoContext
+	}
+
+	r.ctx = ctx
+
+	return nil
+}
+
+// SetTrace sets the trace which records the wire conversation of the request when it is made by the client
+func (r *Request) SetTrace(trace *ICAPTrace) {
+	r.trace = trace
+}
+
+// RemoveHTTPHeader removes the header from the encapsulated http request and response as they're sent to the ICAP server,
+// including the headers the http stack adds while dumping the messages, like User-Agent. The messages themselves are left untouched
+func (r *Request) RemoveHTTPHeader(name string) {
+	r.removedHTTPHeaders = append(r.removedHTTPHeaders, name)
+}
+
+// SetTimeout sets the timeout of this request, it bounds dialing the server as well as reading and writing the messages.
+// The connection timeout of the client applies as well, whichever is earlier
+func (r *Request) SetTimeout(timeout time.Duration) {
+	r.timeout = timeout
+}
+
+// EstimatedSize returns the size of the ICAP message the request is sent as, the default headers of the default configuration
+// are accounted for, the ones of the client configuration are not. The body of an advertised preview is read to determine its preview portion
+func (r *Request) EstimatedSize() (int, error) {
+	req := *r
+	req.Header = r.Header.Clone()
+
+	if req.previewAdvertised && !req.previewSet {
+		if err := req.SetPreview(req.PreviewBytes); err != nil {
+			return 0, err
+		}
+	}
+
+	req.setDefaultRequestHeaders(DefaultConfig().DefaultAllow)
+
+	msg, err := toICAPRequest(req)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(msg), nil
+}
+
+// SetPreview sets the preview bytes in the icap header, a preview of 0 bytes sends the http headers only.
+// It fails with ErrInvalidPreviewSize if the size is negative, the request is left unchanged then
 // todo: defer close error
 func (r *Request) SetPreview(maxBytes int) (err error) {
 	var bodyBytes []byte
 	var previewBytes int
 
+	if maxBytes < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidPreviewSize, maxBytes)
+	}
+
+	// the preview might be set again, for example, when the client caps it
+	r.bodyFittedInPreview = false
+	r.remainingPreviewBytes = nil
+	r.previewSeeker, r.previewHead = nil, nil
+
 	// receiving the body bites to determine the preview bytes depending on the request ICAP method
 	if r.Method == MethodREQMOD {
 		if r.HTTPRequest == nil {
@@ -83,6 +346,13 @@ func (r *Request) SetPreview(maxBytes int) (err error) {
 			return nil
 		}
 
+		// a body which can seek and doesn't fit is previewed without reading it entirely
+		if seeker, ok := r.HTTPResponse.Body.(io.ReadSeeker); ok && len(r.HTTPResponse.TransferEncoding) == 0 {
+			if previewed, err := r.setSeekablePreview(seeker, maxBytes); err != nil || previewed {
+				return err
+			}
+		}
+
 		if r.HTTPResponse.Body != nil {
 			b, err := io.ReadAll(r.HTTPResponse.Body)
 			if err != nil {
@@ -128,11 +398,322 @@ func (r *Request) SetPreview(maxBytes int) (err error) {
 	return err
 }
 
+// streamedBody returns the body of the http response if it's streamed once the headers of the request are sent instead of being
+// held in memory, which is a body that can seek and is sent in full without a preview. It's nil for any other body
+func (r *Request) streamedBody() io.ReadSeeker {
+	if r.Method != MethodRESPMOD || r.HTTPResponse == nil || r.previewSet || r.rawBodyKind != "" ||
+		r.bodyFraming == BodyFramingContentLength || len(r.HTTPResponse.TransferEncoding) > 0 || r.HTTPResponse.ContentLength == 0 {
+		return nil
+	}
+
+	body, _ := r.HTTPResponse.Body.(io.ReadSeeker)
+
+	return body
+}
+
+// setSeekablePreview reads the preview of the body which can seek, the rest is read from the body once the server asks for it
+// instead of being held in memory. It reports whether the preview was set, which it's not if the entire body fits into it,
+// the body is at its start then
+func (r *Request) setSeekablePreview(body io.ReadSeeker, maxBytes int) (bool, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	if size <= int64(maxBytes) {
+		return false, nil
+	}
+
+	head := make([]byte, maxBytes)
+	if _, err := io.ReadFull(body, head); err != nil {
+		return false, err
+	}
+
+	r.previewSeeker = body
+	r.previewHead = head
+	r.seekableSize = size
+
+	r.Header.Set(previewHeader, strconv.Itoa(maxBytes))
+	r.PreviewBytes = maxBytes
+	r.previewSet = true
+
+	return true, nil
+}
+
+// ContentTypePreviews maps the content type prefixes to the preview sizes chosen by SetPreviewFromContentType,
+// the longest prefix the content type starts with wins and the empty prefix matches any other content type.
+// Executables and archives get large previews, text a small one, the sizes can be changed to tune them
+var ContentTypePreviews = map[string]int{
+	"":                             4096,
+	"text/":                        1024,
+	"image/":                       4096,
+	"application/pdf":              8192,
+	"application/zip":              16384,
+	"application/gzip":             16384,
+	"application/x-tar":            16384,
+	"application/x-7z-compressed":  16384,
+	"application/x-rar-compressed": 16384,
+	"application/vnd.rar":          16384,
+	"application/java-archive":     16384,
+	"application/octet-stream":     16384,
+	"application/x-msdownload":     32768,
+	"application/x-executable":     32768,
+	"application/vnd.microsoft.portable-executable": 32768,
+}
+
+// SetPreviewFromContentType sets the preview bytes as ContentTypePreviews lists them for the content type,
+// its parameters, for example, the charset, are ignored. No preview is set if no prefix matches
+func (r *Request) SetPreviewFromContentType(ct string) error {
+	size, found := previewForContentType(ContentTypePreviews, ct)
+	if !found {
+		return nil
+	}
+
+	return r.SetPreview(size)
+}
+
+// previewForContentType returns the preview size of the longest prefix of the previews the content type starts with,
+// its parameters are ignored
+func previewForContentType(previews map[string]int, ct string) (int, bool) {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(ct))
+	}
+
+	prefix, found := "", false
+	for p := range previews {
+		if strings.HasPrefix(mediaType, p) && (!found || len(p) > len(prefix)) {
+			prefix, found = p, true
+		}
+	}
+
+	return previews[prefix], found
+}
+
+// AdvertisePreview sets the preview bytes in the icap header without reading the body,
+// the body is read and split into the preview portion when the request is sent by the client
+func (r *Request) AdvertisePreview(maxBytes int) {
+	r.Header.Set(previewHeader, strconv.Itoa(maxBytes))
+	r.PreviewBytes = maxBytes
+	r.previewAdvertised = true
+}
+
+// clearPreview removes the preview of the request, the body read by SetPreview is kept in full
+func (r *Request) clearPreview() {
+	r.Header.Del(previewHeader)
+	r.PreviewBytes = 0
+	r.previewSet = false
+	r.previewAdvertised = false
+	r.bodyFittedInPreview = false
+	r.remainingPreviewBytes = nil
+	r.previewSeeker, r.previewHead = nil, nil
+}
+
+// UseOptions configures the request as advertised by the OPTIONS response of the service: the preview size,
+// the intersection of the Allow header with the one of the request, 204 by default, and the transfer rules
+// of the Transfer-Preview, Transfer-Complete and Transfer-Ignore headers for the extension of the http resource.
+// Content the service ignores is previewed with its headers only, even if a preview was set or advertised before,
+// otherwise such a preview takes precedence over the transfer rules. Content the service wants complete is sent without a preview,
+// as is any content if the service doesn't advertise a Preview header, a preview set or advertised before is removed then.
+// It fails with ErrMethodNotSupportedByService if the Methods header of the service doesn't list the method of the request
+func (r *Request) UseOptions(opts *Response) error {
+	if opts == nil {
+		return nil
+	}
+
+	// a service which doesn't advertise its methods is assumed to support the request
+	if methods := headerList(opts.Header, "Methods"); r.Method != MethodOPTIONS && len(methods) > 0 && !slices.Contains(methods, r.Method) {
+		return fmt.Errorf("%w: %s, the service supports %s", ErrMethodNotSupportedByService, r.Method, strings.Join(methods, ", "))
+	}
+
+	allowed := headerList(r.Header, "Allow")
+	if len(allowed) == 0 {
+		allowed = []string{"204"}
+	}
+
+	offered := headerList(opts.Header, "Allow")
+	allowed = slices.DeleteFunc(allowed, func(value string) bool {
+		return !slices.Contains(offered, value)
+	})
+
+	// the key is kept even if nothing is allowed, so the default Allow header is not added
+	r.Header["Allow"] = allowed
+
+	if r.Method == MethodOPTIONS {
+		return nil
+	}
+
+	// the service doesn't support previews, so the body is sent in full without a Preview header,
+	// a negative Preview is taken as such, as ServiceOptions does
+	if opts.Header.Get(previewHeader) == "" || opts.PreviewBytes < 0 {
+		r.clearPreview()
+		return nil
+	}
+
+	switch rule := transferRule(opts.Header, r.resourceExtension()); {
+	case rule == "Transfer-Ignore":
+		return r.SetPreview(0)
+	case r.previewSet || r.previewAdvertised:
+		return nil
+	case rule == "Transfer-Complete":
+		return nil
+	default:
+		return r.SetPreview(opts.PreviewBytes)
+	}
+}
+
+// transferRule returns the transfer header of the OPTIONS response which lists the extension, for example, Transfer-Preview.
+// An extension listed explicitly takes precedence over the list with the * wildcard, an empty string is returned if none lists it
+func transferRule(hdr http.Header, ext string) string {
+	for _, value := range []string{ext, "*"} {
+		if value == "" {
+			continue
+		}
+
+		for _, rule := range []string{"Transfer-Ignore", "Transfer-Preview", "Transfer-Complete"} {
+			if slices.ContainsFunc(headerList(hdr, rule), func(element string) bool {
+				return strings.EqualFold(element, value)
+			}) {
+				return rule
+			}
+		}
+	}
+
+	return ""
+}
+
+// resourceExtension returns the file extension of the http resource the request carries, without the leading dot
+func (r *Request) resourceExtension() string {
+	var u *url.URL
+
+	switch {
+	case r.HTTPRequest != nil:
+		u = r.HTTPRequest.URL
+	case r.HTTPResponse != nil && r.HTTPResponse.Request != nil:
+		u = r.HTTPResponse.Request.URL
+	}
+
+	if u == nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(path.Ext(u.Path), ".")
+}
+
+// contentType returns the media type of the encapsulated http message which carries the body, without its parameters
+func (r *Request) contentType() string {
+	var ct string
+
+	switch {
+	case r.Method == MethodRESPMOD && r.HTTPResponse != nil:
+		ct = r.HTTPResponse.Header.Get("Content-Type")
+	case r.Method == MethodREQMOD && r.HTTPRequest != nil:
+		ct = r.HTTPRequest.Header.Get("Content-Type")
+	}
+
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(ct))
+	}
+
+	return mediaType
+}
+
+// contentTypeMatches determines if the media type is one of the types, a type which ends with a slash matches all of its subtypes,
+// for example, video/
+func contentTypeMatches(mediaType string, types []string) bool {
+	if mediaType == "" {
+		return false
+	}
+
+	return slices.ContainsFunc(types, func(t string) bool {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if strings.HasSuffix(t, "/") {
+			return strings.HasPrefix(mediaType, t)
+		}
+
+		return mediaType == t
+	})
+}
+
+// forward returns a new request to the given service which carries the content of the response,
+// the modified http messages if the server modified them, the original ones otherwise.
+// The ICAP headers and the preview of the request are carried over, the Encapsulated header is computed anew
+// and the service url is used verbatim in the ICAP request line
+func (r *Request) forward(urlStr string, res Response) (Request, error) {
+	httpReq, httpResp := r.HTTPRequest, r.HTTPResponse
+
+	// a 204 never modifies the content, even if the server encapsulated a http message in it
+	modified := res.StatusCode != http.StatusNoContent
+
+	if r.Method == MethodREQMOD && modified && res.ContentRequest != nil {
+		httpReq = toOutgoingRequest(res.ContentRequest)
+	}
+
+	if r.Method == MethodRESPMOD && modified && res.ContentResponse != nil {
+		httpResp = res.ContentResponse
+	}
+
+	req, err := NewRequest(r.ctx, r.Method, urlStr, httpReq, httpResp)
+	if err != nil {
+		return Request{}, err
+	}
+
+	req.rawURL = urlStr
+	req.trace = r.trace
+	req.removedHTTPHeaders = slices.Clone(r.removedHTTPHeaders)
+	req.Header = r.Header.Clone()
+	req.Header.Del(encapsulatedHeader)
+	req.Header.Del(previewHeader)
+
+	// the body of the forwarded content is read and split once it is sent to the next service
+	if r.previewSet || r.previewAdvertised {
+		req.AdvertisePreview(r.PreviewBytes)
+	}
+
+	return req, nil
+}
+
+// toOutgoingRequest turns a http request read from the wire into one that can be dumped as an outgoing request
+func toOutgoingRequest(req *http.Request) *http.Request {
+	outReq := req.Clone(req.Context())
+	outReq.RequestURI = ""
+
+	// the clone must not consume the body of the original request
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			outReq.Body = body
+		}
+	}
+
+	if outReq.URL.Host == "" {
+		outReq.URL.Host = outReq.Host
+	}
+
+	if outReq.URL.Scheme == "" {
+		outReq.URL.Scheme = "http"
+		if req.TLS != nil {
+			outReq.URL.Scheme = "https"
+		}
+	}
+
+	return outReq
+}
+
 // setDefaultRequestHeaders is called by the client before sending the request
-// to the ICAP server to ensure all required headers are set
-func (r *Request) setDefaultRequestHeaders() {
-	if _, exists := r.Header["Allow"]; !exists {
-		r.Header.Add("Allow", "204") // assigning 204 by default if Allow not provided
+// to the ICAP server to ensure all required headers are set, the Allow header lists the default codes if not provided
+func (r *Request) setDefaultRequestHeaders(defaultAllow []int) {
+	if _, exists := r.Header["Allow"]; !exists && len(defaultAllow) > 0 {
+		codes := make([]string, 0, len(defaultAllow))
+		for _, code := range defaultAllow {
+			codes = append(codes, strconv.Itoa(code))
+		}
+
+		r.Header.Set("Allow", strings.Join(codes, ", "))
 	}
 
 	if _, exists := r.Header["Host"]; !exists {
@@ -141,11 +722,52 @@ func (r *Request) setDefaultRequestHeaders() {
 	}
 }
 
+// bodySize returns the size of the body of the encapsulated http message, the raw body included, -1 if it's unknown
+func (r *Request) bodySize() int64 {
+	switch {
+	case r.rawBodyKind != "":
+		return int64(len(r.rawBody))
+	case r.Method == MethodREQMOD && r.HTTPRequest != nil:
+		if r.HTTPRequest.Body == nil || r.HTTPRequest.Body == http.NoBody {
+			return 0
+		}
+
+		// a body of an outgoing request with a length of 0 is of unknown size
+		if r.HTTPRequest.ContentLength == 0 {
+			return -1
+		}
+
+		return r.HTTPRequest.ContentLength
+	case r.Method == MethodRESPMOD && r.HTTPResponse != nil:
+		if r.HTTPResponse.Body == nil || r.HTTPResponse.Body == http.NoBody {
+			return 0
+		}
+
+		return r.HTTPResponse.ContentLength
+	}
+
+	return 0
+}
+
+// suppressAllow204 removes 204 from the Allow header, the header is removed entirely if it allows nothing else
+func (r *Request) suppressAllow204() {
+	allowed := slices.DeleteFunc(headerList(r.Header, "Allow"), func(value string) bool {
+		return value == "204"
+	})
+
+	if len(allowed) == 0 {
+		r.Header.Del("Allow")
+		return
+	}
+
+	r.Header.Set("Allow", strings.Join(allowed, ", "))
+}
+
 // extendHeader extends the current ICAP Request header with a new header
 func (r *Request) extendHeader(hdr http.Header) error {
 	for header, values := range hdr {
 
-		if header == previewHeader && r.previewSet {
+		if header == previewHeader && (r.previewSet || r.previewAdvertised) {
 			continue
 		}
 
@@ -153,6 +775,11 @@ func (r *Request) extendHeader(hdr http.Header) error {
 			continue
 		}
 
+		// the headers to return are chosen by the request, not by the server
+		if _, exists := r.Header[allowOutHeader]; exists && header == allowOutHeader {
+			continue
+		}
+
 		for _, value := range values {
 			if header == previewHeader {
 				pb, err := strconv.Atoi(value)
@@ -194,7 +821,7 @@ func (r *Request) validate() error {
 
 	// check if the ICAP url is valid and contains all required fields
 	{
-		if r.URL.Scheme != schemeICAP {
+		if r.URL.Scheme != schemeICAP && r.URL.Scheme != schemeICAPS {
 			err = errors.Join(err, ErrInvalidScheme)
 		}
 
@@ -216,6 +843,39 @@ func (r *Request) validate() error {
 		if r.Method == MethodRESPMOD && r.HTTPResponse == nil {
 			err = errors.Join(err, ErrRESPMODWithoutResp)
 		}
+
+		if r.rawBodyKind != "" && rawBodyKinds[r.Method] != r.rawBodyKind {
+			err = errors.Join(err, fmt.Errorf("%w: %s doesn't fit %s", ErrInvalidEncapsulatedKind, r.rawBodyKind, r.Method))
+		}
+	}
+
+	return err
+}
+
+// validateStrict checks if the headers of the ICAP request comply with RFC 3507, beyond what's needed to send it
+func (r *Request) validateStrict() error {
+	var err error
+
+	if hosts := r.Header.Values("Host"); len(hosts) != 1 || strings.TrimSpace(hosts[0]) == "" {
+		err = errors.Join(err, ErrMissingHostHeader)
+	}
+
+	// the preview is a non-negative size, which only applies to the modification requests
+	if previews := r.Header.Values(previewHeader); len(previews) > 0 {
+		size, convErr := strconv.Atoi(previews[0])
+
+		switch {
+		case len(previews) > 1, convErr != nil, size < 0:
+			err = errors.Join(err, fmt.Errorf("%w: %q", ErrInvalidPreviewHeader, previews))
+		case r.Method == MethodOPTIONS:
+			err = errors.Join(err, fmt.Errorf("%w: not allowed for %s", ErrInvalidPreviewHeader, r.Method))
+		case size != r.PreviewBytes:
+			err = errors.Join(err, fmt.Errorf("%w: %d differs from the preview of %d bytes", ErrInvalidPreviewHeader, size, r.PreviewBytes))
+		}
+	}
+
+	if _, exists := r.Header[encapsulatedHeader]; exists {
+		err = errors.Join(err, ErrInvalidEncapsulatedHeader)
 	}
 
 	return err
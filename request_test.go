@@ -1,11 +1,13 @@
 package icapclient
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"strconv"
@@ -99,9 +101,49 @@ func TestRequest(t *testing.T) {
 
 	})
 
+	t.Run("server-side http request", func(t *testing.T) {
+		type result struct {
+			msg string
+			err error
+		}
+		results := make(chan result, 1)
+
+		// the proxy modifies the request of its client as it's received by the handler
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req, err := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/reqmod", r, nil)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+
+			msg, err := toICAPRequest(req)
+			results <- result{msg: string(msg), err: err}
+		}))
+		defer srv.Close()
+
+		resp, err := http.Post(srv.URL+"/upload?name=file.txt", "text/plain", strings.NewReader("Hello World"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		res := <-results
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+
+		if wanted := "\r\n\r\nPOST " + srv.URL + "/upload?name=file.txt HTTP/1.1\r\n"; !strings.Contains(res.msg, wanted) {
+			t.Errorf("Wanted the request line:%q, got:%q", wanted, res.msg)
+		}
+
+		if wanted := "\r\n\r\nb\r\nHello World\r\n0\r\n\r\n"; !strings.HasSuffix(res.msg, wanted) {
+			t.Errorf("Wanted the body:%q, got:%q", wanted, res.msg)
+		}
+	})
+
 	t.Run("setDefaultRequestHeaders", func(t *testing.T) {
 		req, _ := NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1344/something", nil, nil)
-		req.setDefaultRequestHeaders()
+		req.setDefaultRequestHeaders(DefaultConfig().DefaultAllow)
 
 		if val, exists := req.Header["Allow"]; !exists || len(val) < 1 || val[0] != "204" {
 			t.Log("Must have Allow header with 204 as value")
@@ -116,7 +158,7 @@ func TestRequest(t *testing.T) {
 
 		req, _ = NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1344/something", nil, nil)
 		req.Header.Set("Host", "somehost")
-		req.setDefaultRequestHeaders()
+		req.setDefaultRequestHeaders(DefaultConfig().DefaultAllow)
 
 		if val, exists := req.Header["Host"]; !exists || len(val) < 1 || val[0] != "somehost" {
 			t.Logf("Must have Host header with %s as value", "somehost")
@@ -162,7 +204,7 @@ func TestRequest(t *testing.T) {
 		for _, sample := range sampleTable {
 			req, _ := NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1344/something", nil, nil)
 			if sample.defaultHeaders {
-				req.setDefaultRequestHeaders()
+				req.setDefaultRequestHeaders(DefaultConfig().DefaultAllow)
 			}
 
 			if err := req.extendHeader(sample.extendingHeader); err != nil {
@@ -188,6 +230,405 @@ func TestRequest(t *testing.T) {
 
 	})
 
+	t.Run("UseOptions", func(t *testing.T) {
+		type testSample struct {
+			name          string
+			resourceURL   string
+			optHeader     http.Header
+			wantedPreview int
+			wantedAllow   []string
+		}
+
+		sampleTable := []testSample{
+			{
+				name:        "preview everything",
+				resourceURL: "http://example.com/file.txt",
+				optHeader: http.Header{
+					"Allow":            []string{"204"},
+					"Preview":          []string{"4"},
+					"Transfer-Preview": []string{"*"},
+				},
+				wantedPreview: 4,
+				wantedAllow:   []string{"204"},
+			},
+			{
+				name:        "complete listed extension",
+				resourceURL: "http://example.com/file.exe",
+				optHeader: http.Header{
+					"Allow":             []string{"204"},
+					"Preview":           []string{"4"},
+					"Transfer-Preview":  []string{"*"},
+					"Transfer-Complete": []string{"bat, exe"},
+				},
+				wantedPreview: -1,
+				wantedAllow:   []string{"204"},
+			},
+			{
+				name:        "ignore listed extension",
+				resourceURL: "http://example.com/file.JPG",
+				optHeader: http.Header{
+					"Allow":            []string{"204"},
+					"Preview":          []string{"4"},
+					"Transfer-Preview": []string{"*"},
+					"Transfer-Ignore":  []string{"jpg, png"},
+				},
+				wantedPreview: 0,
+				wantedAllow:   []string{"204"},
+			},
+			{
+				name:        "no 204 allowed",
+				resourceURL: "http://example.com/file.txt",
+				optHeader: http.Header{
+					"Preview": []string{"4"},
+				},
+				wantedPreview: 4,
+				wantedAllow:   []string{},
+			},
+			{
+				name:        "no preview advertised",
+				resourceURL: "http://example.com/file.txt",
+				optHeader: http.Header{
+					"Allow":            []string{"204"},
+					"Transfer-Preview": []string{"*"},
+				},
+				wantedPreview: -1,
+				wantedAllow:   []string{"204"},
+			},
+		}
+
+		for _, sample := range sampleTable {
+			optResp, err := toClientResponse(bufio.NewReader(strings.NewReader(icapOptionsReply(sample.optHeader))), headerLimits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			httpReq, _ := http.NewRequest(http.MethodPost, sample.resourceURL, strings.NewReader("Hello World"))
+			req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+			if err := req.UseOptions(&optResp); err != nil {
+				t.Fatal(err)
+			}
+
+			// configured manually, as it's done without the options
+			manualHTTPReq, _ := http.NewRequest(http.MethodPost, sample.resourceURL, strings.NewReader("Hello World"))
+			manualReq, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", manualHTTPReq, nil)
+			manualReq.Header["Allow"] = sample.wantedAllow
+			if sample.wantedPreview >= 0 {
+				if err := manualReq.SetPreview(sample.wantedPreview); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !reflect.DeepEqual(req.Header, manualReq.Header) {
+				t.Errorf("%s: Wanted header:%v, got:%v", sample.name, manualReq.Header, req.Header)
+			}
+
+			if req.previewSet != manualReq.previewSet || req.PreviewBytes != manualReq.PreviewBytes {
+				t.Errorf("%s: Wanted preview set:%t of %d bytes, got:%t of %d bytes",
+					sample.name, manualReq.previewSet, manualReq.PreviewBytes, req.previewSet, req.PreviewBytes)
+			}
+		}
+	})
+
+	t.Run("UseOptions rejects the methods the service doesn't support", func(t *testing.T) {
+		optResp, err := toClientResponse(bufio.NewReader(strings.NewReader(icapOptionsReply(http.Header{
+			"Methods": []string{"RESPMOD"},
+			"Allow":   []string{"204"},
+			"Preview": []string{"4"},
+		}))), headerLimits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		httpReq, _ := http.NewRequest(http.MethodPost, "http://example.com/file.txt", strings.NewReader("Hello World"))
+		req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/respmod", httpReq, nil)
+
+		if err := req.UseOptions(&optResp); !errors.Is(err, ErrMethodNotSupportedByService) {
+			t.Errorf("Wanted error:%v, got:%v", ErrMethodNotSupportedByService, err)
+		}
+
+		if req.previewSet || req.Header.Get("Allow") != "" {
+			t.Errorf("Wanted the request to be left as is, got preview set:%t, Allow:%s", req.previewSet, req.Header.Get("Allow"))
+		}
+
+		optReq, _ := NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1344/respmod", nil, nil)
+		if err := optReq.UseOptions(&optResp); err != nil {
+			t.Errorf("Wanted the OPTIONS request to be accepted, got:%v", err)
+		}
+	})
+
+	t.Run("UseOptions ignores the preview set before", func(t *testing.T) {
+		optResp, err := toClientResponse(bufio.NewReader(strings.NewReader(icapOptionsReply(http.Header{
+			"Allow":            []string{"204"},
+			"Preview":          []string{"4"},
+			"Transfer-Preview": []string{"*"},
+			"Transfer-Ignore":  []string{"txt"},
+		}))), headerLimits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		httpReq, _ := http.NewRequest(http.MethodPost, "http://example.com/file.txt", strings.NewReader("Hello World"))
+		req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+
+		if err := req.SetPreview(4); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := req.UseOptions(&optResp); err != nil {
+			t.Fatal(err)
+		}
+
+		if req.PreviewBytes != 0 || req.Header.Get("Preview") != "0" {
+			t.Errorf("Wanted a preview of 0 bytes, got:%d, header:%s", req.PreviewBytes, req.Header.Get("Preview"))
+		}
+
+		msg, err := toICAPRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(string(msg), "Hell") {
+			t.Errorf("Wanted no body bytes previewed, got:%q", string(msg))
+		}
+	})
+
+	t.Run("EstimatedSize", func(t *testing.T) {
+		newHTTPResp := func() *http.Response {
+			return &http.Response{
+				Status:        "200 OK",
+				StatusCode:    http.StatusOK,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": []string{"text/plain"}},
+				ContentLength: 19,
+				Body:          io.NopCloser(strings.NewReader("This is a GOOD FILE")),
+			}
+		}
+
+		sampleTable := []struct {
+			name string
+			req  func() Request
+		}{
+			{
+				name: "OPTIONS",
+				req: func() Request {
+					req, _ := NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1344/something", nil, nil)
+					return req
+				},
+			},
+			{
+				name: "REQMOD",
+				req: func() Request {
+					httpReq, _ := http.NewRequest(http.MethodPost, "http://someurl.com/upload", strings.NewReader("Hello World"))
+					req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+					return req
+				},
+			},
+			{
+				name: "RESPMOD with preview",
+				req: func() Request {
+					req, _ := NewRequest(context.Background(), MethodRESPMOD, "icap://localhost:1344/something", nil, newHTTPResp())
+					_ = req.SetPreview(4)
+					return req
+				},
+			},
+			{
+				name: "RESPMOD with advertised preview",
+				req: func() Request {
+					req, _ := NewRequest(context.Background(), MethodRESPMOD, "icap://localhost:1344/something", nil, newHTTPResp())
+					req.AdvertisePreview(4)
+					return req
+				},
+			},
+		}
+
+		client, _ := NewClient()
+
+		for _, sample := range sampleTable {
+			req := sample.req()
+
+			size, err := req.EstimatedSize()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the request is prepared and marshaled as the client sends it
+			if err := client.prepare(&req); err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := toICAPRequest(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size != len(msg) {
+				t.Errorf("%s: Wanted estimated size:%d, got:%d", sample.name, len(msg), size)
+			}
+		}
+	})
+
+	t.Run("SetPreviewFromContentType", func(t *testing.T) {
+		previewBytes := func(ct string) int {
+			httpResp := &http.Response{
+				Status:     "200 OK",
+				StatusCode: http.StatusOK,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"Content-Type": []string{ct}},
+				Body:       io.NopCloser(strings.NewReader(strings.Repeat("a", 64<<10))),
+			}
+
+			req, _ := NewRequest(context.Background(), MethodRESPMOD, "icap://localhost:1344/something", nil, httpResp)
+			if err := req.SetPreviewFromContentType(ct); err != nil {
+				t.Fatal(err)
+			}
+
+			if !req.previewSet {
+				t.Errorf("Wanted a preview to be set for %s", ct)
+			}
+
+			return req.PreviewBytes
+		}
+
+		zip, text := previewBytes("application/zip"), previewBytes("text/plain; charset=utf-8")
+		if zip <= text {
+			t.Errorf("Wanted a larger preview for application/zip than for text/plain, got:%d and %d", zip, text)
+		}
+
+		if text != ContentTypePreviews["text/"] {
+			t.Errorf("Wanted the preview of text/plain:%d, got:%d", ContentTypePreviews["text/"], text)
+		}
+
+		if other := previewBytes("video/mp4"); other != ContentTypePreviews[""] {
+			t.Errorf("Wanted the default preview:%d, got:%d", ContentTypePreviews[""], other)
+		}
+	})
+
+	t.Run("SetMethod", func(t *testing.T) {
+		httpReq, _ := http.NewRequest(http.MethodGet, "http://someurl.com", nil)
+
+		req, err := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if err := req.SetMethod(MethodRESPMOD); !errors.Is(err, ErrRESPMODWithoutResp) {
+			t.Errorf("Wanted error:%v, got:%v", ErrRESPMODWithoutResp, err)
+		}
+
+		if err := req.SetMethod("TRACE"); !errors.Is(err, ErrMethodNotAllowed) {
+			t.Errorf("Wanted error:%v, got:%v", ErrMethodNotAllowed, err)
+		}
+
+		// the request is left untouched by an invalid method
+		if req.Method != MethodREQMOD {
+			t.Errorf("Wanted method: %s, got: %s", MethodREQMOD, req.Method)
+		}
+
+		req.HTTPRequest = nil
+		req.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+
+		if err := req.SetMethod("respmod"); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if req.Method != MethodRESPMOD {
+			t.Errorf("Wanted method: %s, got: %s", MethodRESPMOD, req.Method)
+		}
+	})
+
+	t.Run("AuthenticatedUser", func(t *testing.T) {
+		req, _ := NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1344/something", nil, nil)
+
+		if err := req.SetAuthenticatedUser("WinNT", `EXAMPLE\jdoe`); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		scheme, user, err := DecodeAuthenticatedUser(req.Header.Get("X-Authenticated-User"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if scheme != "WinNT" || user != `EXAMPLE\jdoe` {
+			t.Errorf("Wanted scheme: WinNT and user: EXAMPLE\\jdoe, got: %s and %s", scheme, user)
+		}
+
+		if err := req.SetAuthenticatedUser("", "jdoe"); !errors.Is(err, ErrInvalidAuthenticatedUser) {
+			t.Errorf("Wanted error:%v, got:%v", ErrInvalidAuthenticatedUser, err)
+		}
+
+		for _, value := range []string{"not base64!", "amRvZQ=="} {
+			if _, _, err := DecodeAuthenticatedUser(value); !errors.Is(err, ErrInvalidAuthenticatedUser) {
+				t.Errorf("Wanted error:%v for %q, got:%v", ErrInvalidAuthenticatedUser, value, err)
+			}
+		}
+
+		if err := req.SetAuthenticatedUser("Local", ""); err != nil || req.Header.Get("X-Authenticated-User") != "" {
+			t.Errorf("Wanted the header to be removed, got: %v, %v", req.Header, err)
+		}
+	})
+
+	t.Run("SetAllowOut", func(t *testing.T) {
+		type testSample struct {
+			headers       []string
+			allowOutValue []string
+			optionsHeader http.Header
+			err           error
+		}
+
+		sampleTable := []testSample{
+			{
+				headers:       []string{"X-Infection-Found", "X-Virus-ID"},
+				allowOutValue: []string{"X-Infection-Found, X-Virus-ID"},
+			},
+			{
+				headers:       []string{"X-Infection-Found"},
+				allowOutValue: []string{"X-Infection-Found"},
+				optionsHeader: http.Header{"X-Allow-Out": []string{"X-Violations-Found"}},
+			},
+			{
+				headers: []string{"X-Infection-Found", "X Virus: ID"},
+				err:     ErrInvalidHeaderName,
+			},
+			{
+				headers: []string{},
+			},
+		}
+
+		for _, sample := range sampleTable {
+			req, _ := NewRequest(context.Background(), MethodOPTIONS, "icap://localhost:1344/something", nil, nil)
+
+			if err := req.SetAllowOut(sample.headers); !errors.Is(err, sample.err) {
+				t.Errorf("Wanted error:%v, got:%v", sample.err, err)
+			}
+
+			// the header set by the request is preserved when extending it with the OPTIONS response
+			if err := req.extendHeader(sample.optionsHeader); err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if val := req.Header["X-Allow-Out"]; !reflect.DeepEqual(val, sample.allowOutValue) {
+				t.Errorf("Wanted X-Allow-Out header with value: %v, got: %v", sample.allowOutValue, val)
+			}
+
+			if len(sample.allowOutValue) == 0 {
+				continue
+			}
+
+			msg, err := toICAPRequest(req)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if wanted := "X-Allow-Out: " + sample.allowOutValue[0] + crlf; !strings.Contains(string(msg), wanted) {
+				t.Errorf("Wanted the message to contain: %q, got: %q", wanted, string(msg))
+			}
+		}
+	})
+
 	t.Run("SetPreview", func(t *testing.T) {
 
 		type testSample struct {
@@ -307,4 +748,61 @@ func TestRequest(t *testing.T) {
 
 	})
 
+	t.Run("SetPreview rejects a negative size", func(t *testing.T) {
+		const bodyStr = "Hello World! Bye Bye World!"
+
+		httpReq, _ := http.NewRequest(http.MethodPost, "http://someurl.com", strings.NewReader(bodyStr))
+		reqmod, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+		respmod, _ := NewRESPMODRequestFromReadSeeker(context.Background(), "icap://localhost:1344/something", strings.NewReader(bodyStr), "text/plain")
+
+		for _, req := range []Request{reqmod, respmod} {
+			if err := req.SetPreview(-5); !errors.Is(err, ErrInvalidPreviewSize) {
+				t.Errorf("Wanted %v for %s, got: %v", ErrInvalidPreviewSize, req.Method, err)
+			}
+
+			if _, exists := req.Header["Preview"]; exists || req.previewSet {
+				t.Errorf("Wanted no preview for %s, got: %v", req.Method, req.Header["Preview"])
+			}
+
+			var bdyBytes []byte
+			if req.Method == MethodREQMOD {
+				bdyBytes, _ = io.ReadAll(req.HTTPRequest.Body)
+			} else {
+				bdyBytes, _ = io.ReadAll(req.HTTPResponse.Body)
+			}
+
+			if string(bdyBytes) != bodyStr {
+				t.Errorf("Wanted the body of %s to be left unread, got: %q", req.Method, string(bdyBytes))
+			}
+		}
+
+		// a negative Preview of the service is taken as no preview support
+		opts, err := toClientResponse(bufio.NewReader(strings.NewReader(icapOptionsReply(http.Header{"Preview": {"-1"}}))), headerLimits{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		req, _ := NewRequest(context.Background(), MethodREQMOD, "icap://localhost:1344/something", httpReq, nil)
+		req.AdvertisePreview(4)
+		if err := req.UseOptions(&opts); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if _, exists := req.Header["Preview"]; exists || req.PreviewBytes != 0 {
+			t.Errorf("Wanted no preview, got: %v", req.Header["Preview"])
+		}
+	})
+
+}
+
+// icapOptionsReply returns the reply of a service to an OPTIONS request with the given headers
+func icapOptionsReply(hdr http.Header) string {
+	reply := "ICAP/1.0 200 OK\r\n"
+	for key, values := range hdr {
+		for _, value := range values {
+			reply += key + ": " + value + "\r\n"
+		}
+	}
+
+	return reply + "Encapsulated: null-body=0\r\n\r\n"
 }
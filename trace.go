@@ -0,0 +1,58 @@
+package icapclient
+
+import (
+	"time"
+)
+
+// ICAPTrace records the wire conversation of a request, it is filled by the client while the request is made.
+// The connect times stay zero if the request reuses a pooled connection, the Duration is measured from the start of the request
+type ICAPTrace struct {
+	ConnectStart    time.Time
+	ConnectDuration time.Duration
+	Exchanges       []TraceExchange
+	Duration        time.Duration
+
+	start time.Time
+}
+
+// TraceExchange is a single message sent to the icap server along with the reply received for it
+type TraceExchange struct {
+	SentAt   time.Time
+	Sent     []byte
+	Received []byte
+	Duration time.Duration
+}
+
+// started records the start of the request
+func (t *ICAPTrace) started(start time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.start = start
+}
+
+// connected records the connection to the icap server which started at the given time
+func (t *ICAPTrace) connected(start time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.ConnectStart = start
+	t.ConnectDuration = time.Since(start)
+}
+
+// exchanged records a message sent at the given time and the reply received for it
+func (t *ICAPTrace) exchanged(start time.Time, sent, received []byte) {
+	if t == nil {
+		return
+	}
+
+	t.Exchanges = append(t.Exchanges, TraceExchange{
+		SentAt:   start,
+		Sent:     append([]byte(nil), sent...),
+		Received: append([]byte(nil), received...),
+		Duration: time.Since(start),
+	})
+	t.Duration = time.Since(t.start)
+}